@@ -3,23 +3,132 @@ package main
 import (
 	"golang.org/x/crypto/ssh"
 
+	"errors"
 	"fmt"
-	"log"
 	"strings"
 )
 
+// 单个连接认证过程中的状态 认证回调在握手的goroutine中顺序调用 不需要加锁
+type authContext struct {
+	connContext
+	attempts int
+	handled  bool // 本次尝试是否已经由密码或keyboard-interactive回调记录
+}
+
+// 记录一次认证尝试 返回对应的日志
+func (context *authContext) newAuthLog(conn ssh.ConnMetadata, method string, accepted bool) authLog {
+	context.attempts++
+	return authLog{
+		Method:   method,
+		User:     conn.User(),
+		Attempt:  context.attempts,
+		Accepted: accepted,
+	}
+}
+
+var errAuthRejected = errors.New("authentication rejected")
+
+// x/crypto/ssh缓存公钥回调的结果 同一个公钥再次尝试时不调用回调 直接把缓存的错误传给认证日志回调
+// 认证日志回调据此识别已经记录过的公钥
+var errPublicKeyRejected = errors.New("public key rejected")
+
 // 密码回调函数
-func (cfg *config) getPasswordCallback() func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+func (cfg *config) getPasswordCallback(context *authContext) func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
 	if !cfg.Auth.PasswordAuth.Enabled {
 		return nil
 	}
 	return func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-		log.Printf("New conncetion(src/dst): %s (%s)\n", conn.RemoteAddr().String(), conn.LocalAddr().String())
-		log.Printf("Authentication for ['%s','%s'] is accept\n", conn.User(), string(password))
+		accepted := cfg.passwordPolicy.accept(conn.RemoteAddr(), conn.User(), string(password))
+		context.logEvent(passwordAuthLog{
+			authLog:  context.newAuthLog(conn, "password", accepted),
+			Password: string(password),
+		})
+		context.handled = true
+		if !accepted {
+			return nil, errAuthRejected
+		}
 		return nil, nil
 	}
 }
 
+// 公钥回调函数 同一个公钥只会被调用一次 查询公钥时接受后不会调用认证日志回调
+func (cfg *config) getPublicKeyCallback(context *authContext) func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if !cfg.Auth.PublicKeyAuth.Enabled {
+		return nil
+	}
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		accepted := cfg.Auth.PublicKeyAuth.Accepted
+		if len(cfg.acceptedKeys) != 0 {
+			accepted = cfg.acceptedKeys[string(key.Marshal())]
+		}
+		context.logEvent(publicKeyAuthLog{
+			authLog:         context.newAuthLog(conn, "publickey", accepted),
+			KeyType:         key.Type(),
+			PublicKey:       strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+			PublicKeySHA256: ssh.FingerprintSHA256(key),
+		})
+		if !accepted {
+			return nil, errPublicKeyRejected
+		}
+		return nil, nil
+	}
+}
+
+// keyboard-interactive回调函数 第一个回答作为密码判断是否接受
+func (cfg *config) getKeyboardInteractiveCallback(context *authContext) func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	if !cfg.Auth.KeyboardInteractiveAuth.Enabled {
+		return nil
+	}
+	questions := make([]string, len(cfg.Auth.KeyboardInteractiveAuth.Questions))
+	echos := make([]bool, len(cfg.Auth.KeyboardInteractiveAuth.Questions))
+	for i, question := range cfg.Auth.KeyboardInteractiveAuth.Questions {
+		questions[i] = question.Text
+		echos[i] = question.Echo
+	}
+	return func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		answers, err := client(conn.User(), cfg.Auth.KeyboardInteractiveAuth.Instruction, questions, echos)
+		if err != nil {
+			return nil, err
+		}
+		accepted := false
+		if len(answers) > 0 {
+			accepted = cfg.keyboardInteractivePolicy.accept(conn.RemoteAddr(), conn.User(), answers[0])
+		}
+		entry := keyboardInteractiveAuthLog{
+			authLog: context.newAuthLog(conn, "keyboard-interactive", accepted),
+		}
+		for i, answer := range answers {
+			question := ""
+			if i < len(questions) {
+				question = questions[i]
+			}
+			entry.Answers = append(entry.Answers, keyboardInteractiveAnswer{question, answer})
+		}
+		context.logEvent(entry)
+		context.handled = true
+		if !accepted {
+			return nil, errAuthRejected
+		}
+		return nil, nil
+	}
+}
+
+// 认证日志回调函数 记录没有被具体方法的回调记录的尝试 例如none和未启用的方法
+func (cfg *config) getAuthLogCallback(context *authContext) func(conn ssh.ConnMetadata, method string, err error) {
+	return func(conn ssh.ConnMetadata, method string, err error) {
+		// 公钥回调已经记录 接受的公钥和被拒绝的公钥都可能来自缓存 没有再次调用回调
+		if method == "publickey" && (err == nil || err == errPublicKeyRejected) {
+			return
+		}
+		if context.handled {
+			context.handled = false
+			return
+		}
+		context.logEvent(context.newAuthLog(conn, method, err == nil))
+		context.handled = false
+	}
+}
+
 // ssh banner回调函数
 func (cfg *config) getBannerCallback() func(conn ssh.ConnMetadata) string {
 	if cfg.SSHProto.Banner == "" {
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+// 同一个被拒绝的公钥尝试两次时 第二次来自x/crypto/ssh的缓存 不应再记录一次
+func TestRepeatedPublicKeyLoggedOnce(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	stop := captureEvents(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wait := dialTestServer(t, cfg, &ssh.ClientConfig{
+		User: "root",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer, signer), ssh.Password("123456")},
+	})
+	wait()
+
+	var methods []string
+	for _, entry := range stop() {
+		switch entry := entry.(type) {
+		case authLog:
+			methods = append(methods, entry.Method)
+			if entry.Attempt != len(methods) {
+				t.Errorf("%v attempt = %v, want %v", entry.Method, entry.Attempt, len(methods))
+			}
+		case publicKeyAuthLog:
+			methods = append(methods, entry.Method)
+			if entry.Attempt != len(methods) || entry.Accepted {
+				t.Errorf("publickey attempt = %v accepted = %v, want %v false", entry.Attempt, entry.Accepted, len(methods))
+			}
+		case passwordAuthLog:
+			methods = append(methods, entry.Method)
+			if entry.Attempt != len(methods) || !entry.Accepted {
+				t.Errorf("password attempt = %v accepted = %v, want %v true", entry.Attempt, entry.Accepted, len(methods))
+			}
+		}
+	}
+	want := []string{"none", "publickey", "password"}
+	if len(methods) != len(want) {
+		t.Fatalf("auth events = %v, want %v", methods, want)
+	}
+	for i := range want {
+		if methods[i] != want[i] {
+			t.Fatalf("auth events = %v, want %v", methods, want)
+		}
+	}
+}
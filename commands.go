@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"io"
-	"strconv"
+	"path"
 	"strings"
+
+	"golang.org/x/term"
 )
 
 type readLiner interface {
@@ -16,6 +18,7 @@ type commandContext struct {
 	stdin          readLiner
 	stdout, stderr io.Writer
 	pty            bool
+	session        *shellSession
 }
 
 type command interface {
@@ -24,10 +27,36 @@ type command interface {
 
 var commands = map[string]command{
 	"sh":    cmdShell{},
+	"bash":  cmdShell{},
 	"true":  cmdTrue{},
 	"false": cmdFalse{},
 	"echo":  cmdEcho{},
 	"cat":   cmdCat{},
+	"ls":    cmdLs{},
+	"cd":    cmdCd{},
+	"pwd":   cmdPwd{},
+	"mkdir": cmdMkdir{},
+	"rm":    cmdRm{},
+	"cp":    cmdCp{},
+	"mv":    cmdMv{},
+	"touch": cmdTouch{},
+	"chmod": cmdChmod{},
+
+	"uname":    cmdUname{},
+	"whoami":   cmdWhoami{},
+	"id":       cmdId{},
+	"hostname": cmdHostname{},
+	"uptime":   cmdUptime{},
+	"w":        cmdW{},
+	"free":     cmdFree{},
+	"nproc":    cmdNproc{},
+	"lscpu":    cmdLscpu{},
+	"df":       cmdDf{},
+	"wget":     cmdWget{},
+	"curl":     cmdCurl{},
+	"tftp":     cmdTftp{},
+	"ftpget":   cmdFtpget{},
+	"scp":      cmdScp{},
 }
 
 var shellProgram = []string{"sh"}
@@ -36,7 +65,22 @@ func executeProgram(context commandContext) (uint32, error) {
 	if len(context.args) == 0 {
 		return 0, nil
 	}
-	command := commands[context.args[0]]
+	// 带路径的命令先在虚拟文件系统中查找 存在并且可执行时再按文件名查找 例如/bin/echo
+	if strings.Contains(context.args[0], "/") {
+		info, err := context.session.fs.Stat(context.absPath(context.args[0]))
+		switch {
+		case err != nil:
+			_, err := fmt.Fprintf(context.stderr, "%v: %v\n", context.args[0], err)
+			return 127, err
+		case info.IsDir():
+			_, err := fmt.Fprintf(context.stderr, "%v: Is a directory\n", context.args[0])
+			return 126, err
+		case info.Mode().Perm()&0111 == 0:
+			_, err := fmt.Fprintf(context.stderr, "%v: Permission denied\n", context.args[0])
+			return 126, err
+		}
+	}
+	command := commands[path.Base(context.args[0])]
 	if command == nil {
 		_, err := fmt.Fprintf(context.stderr, "%v: command not found\n", context.args[0])
 		return 127, err
@@ -44,41 +88,159 @@ func executeProgram(context commandContext) (uint32, error) {
 	return command.execute(context)
 }
 
+// 解析后的命令行选项
+type options struct {
+	flags    map[byte]bool
+	values   map[byte]string
+	operands []string
+}
+
+// 按GNU的方式解析命令行选项 选项可以出现在操作数之间 "--"之后都是操作数
+// short中的字母后跟':'表示该选项带参数 long把长选项映射到对应的短选项
+func parseOptions(args []string, short string, long map[string]byte) (options, error) {
+	opts := options{flags: map[byte]bool{}, values: map[byte]string{}}
+	takesValue := func(flag byte) bool {
+		i := strings.IndexByte(short, flag)
+		return i >= 0 && i+1 < len(short) && short[i+1] == ':'
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			opts.operands = append(opts.operands, args[i+1:]...)
+			return opts, nil
+		case strings.HasPrefix(arg, "--"):
+			name, value := arg[2:], ""
+			hasValue := false
+			if j := strings.IndexByte(name, '='); j >= 0 {
+				name, value, hasValue = name[:j], name[j+1:], true
+			}
+			flag, ok := long[name]
+			if !ok {
+				return opts, fmt.Errorf("unrecognized option '%v'", arg)
+			}
+			if takesValue(flag) {
+				if !hasValue {
+					if i+1 >= len(args) {
+						return opts, fmt.Errorf("option '--%v' requires an argument", name)
+					}
+					i++
+					value = args[i]
+				}
+				opts.values[flag] = value
+			} else if hasValue {
+				return opts, fmt.Errorf("option '--%v' doesn't allow an argument", name)
+			}
+			opts.flags[flag] = true
+		case len(arg) > 1 && arg[0] == '-':
+			for j := 1; j < len(arg); j++ {
+				flag := arg[j]
+				if flag == ':' || strings.IndexByte(short, flag) < 0 {
+					return opts, fmt.Errorf("invalid option -- '%c'", flag)
+				}
+				opts.flags[flag] = true
+				if takesValue(flag) {
+					value := arg[j+1:]
+					if value == "" {
+						if i+1 >= len(args) {
+							return opts, fmt.Errorf("option requires an argument -- '%c'", flag)
+						}
+						i++
+						value = args[i]
+					}
+					opts.values[flag] = value
+					break
+				}
+			}
+		default:
+			opts.operands = append(opts.operands, arg)
+		}
+	}
+	return opts, nil
+}
+
+// 输出命令名和错误信息到标准错误
+func (context commandContext) errorf(format string, args ...interface{}) error {
+	_, err := fmt.Fprintf(context.stderr, "%v: %v\n", context.args[0], fmt.Sprintf(format, args...))
+	return err
+}
+
+// 输出用法错误 返回status作为退出状态
+func (context commandContext) usageError(usage error, status uint32) (uint32, error) {
+	_, err := fmt.Fprintf(context.stderr, "%v: %v\nTry '%v --help' for more information.\n", context.args[0], usage, context.args[0])
+	return status, err
+}
+
+// 标准输出是否是终端 被重定向或者在管道中时不是
+func (context commandContext) isTerminal() bool {
+	_, ok := context.stdout.(*term.Terminal)
+	return context.pty && ok
+}
+
 type cmdShell struct{}
 
 func (cmdShell) execute(context commandContext) (uint32, error) {
-	var prompt string
-	if context.pty {
-		prompt = "$ "
+	if len(context.args) > 1 && context.args[1] == "-c" {
+		if len(context.args) < 3 {
+			_, err := fmt.Fprintf(context.stderr, "%v: -c: option requires an argument\n", context.args[0])
+			return 2, err
+		}
+		status, err := context.runScript(context.args[2])
+		if exit, ok := err.(shellExit); ok {
+			return exit.status, nil
+		}
+		return status, err
 	}
-	var line string
-	var err error
 	for {
-		_, err = fmt.Fprint(context.stdout, prompt)
+		var prompt string
+		if context.pty {
+			prompt = context.session.prompt()
+		}
+		list, err := context.readCommands(prompt)
 		if err != nil {
-			return 0, err
+			return context.session.status, err
+		}
+		if list == nil {
+			continue
+		}
+		_, err = context.runList(list)
+		if exit, ok := err.(shellExit); ok {
+			return exit.status, nil
 		}
-		line, err = context.stdin.ReadLine()
 		if err != nil {
 			return 0, err
 		}
-		args := strings.Fields(line)
-		if len(args) > 0 && args[0] == "exit" {
-			var err error
-			var status uint64
-			if len(args) > 1 {
-				status, err = strconv.ParseUint(args[1], 10, 32)
-				if err != nil {
-					status = 255
-				}
+	}
+}
+
+// 读取并解析一条完整的命令 输入不完整时继续读取下一行 语法错误时返回nil
+func (context commandContext) readCommands(prompt string) (*shellList, error) {
+	var input string
+	for {
+		if _, err := fmt.Fprint(context.stdout, prompt); err != nil {
+			return nil, err
+		}
+		line, err := context.stdin.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		input += line
+		list, err := parseShell(input)
+		if err == errIncompleteInput {
+			input += "\n"
+			if context.pty {
+				prompt = "> "
 			}
-			return uint32(status), nil
+			continue
 		}
-		newContext := context
-		newContext.args = strings.Fields(line)
-		if _, err = executeProgram(newContext); err != nil {
-			return 0, err
+		if err != nil {
+			context.session.status = 2
+			if _, err := fmt.Fprintf(context.stderr, "sh: %v\n", err); err != nil {
+				return nil, err
+			}
+			return nil, nil
 		}
+		return list, nil
 	}
 }
 
@@ -104,21 +266,45 @@ func (cmdEcho) execute(context commandContext) (uint32, error) {
 type cmdCat struct{}
 
 func (cmdCat) execute(context commandContext) (uint32, error) {
-	if len(context.args) > 1 {
-		for _, file := range context.args[1:] {
-			if _, err := fmt.Fprintf(context.stderr, "%v: %v: No such file or directory\n", context.args[0], file); err != nil {
-				return 0, err
+	files := context.args[1:]
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var status uint32
+	for _, file := range files {
+		if file == "-" {
+			if err := copyLines(context.stdout, context.stdin); err != nil {
+				return status, err
 			}
+			continue
+		}
+		data, err := context.session.fs.ReadFile(context.absPath(file))
+		if err != nil {
+			status = 1
+			if _, err := fmt.Fprintf(context.stderr, "%v: %v: %v\n", context.args[0], file, err); err != nil {
+				return status, err
+			}
+			continue
+		}
+		if _, err := context.stdout.Write(data); err != nil {
+			return status, err
 		}
-		return 1, nil
 	}
-	var line string
-	var err error
-	for err == nil {
-		line, err = context.stdin.ReadLine()
-		if err == nil {
-			_, err = fmt.Fprintln(context.stdout, line)
+	return status, nil
+}
+
+// 把输入的每一行写到输出 直到输入结束
+func copyLines(w io.Writer, r readLiner) error {
+	for {
+		line, err := r.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
 		}
 	}
-	return 0, err
 }
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+// 带路径的命令必须是虚拟文件系统中存在的可执行文件
+func TestCommandPathLookup(t *testing.T) {
+	tests := []struct {
+		script string
+		stdout string
+		stderr string
+		status uint32
+	}{
+		{`/bin/echo hi`, "hi\n", "", 0},
+		{`/usr/bin/echo hi`, "hi\n", "", 0},
+		{`cd /usr; bin/echo hi`, "hi\n", "", 0},
+		{`/nope/ls`, "", "/nope/ls: No such file or directory\n", 127},
+		{`./ls`, "", "./ls: No such file or directory\n", 127},
+		{`/tmp/wget`, "", "/tmp/wget: No such file or directory\n", 127},
+		{`/tmp`, "", "/tmp: Is a directory\n", 126},
+		{`echo x > /tmp/wget; /tmp/wget`, "", "/tmp/wget: Permission denied\n", 126},
+		{`echo x > /tmp/echo; chmod +x /tmp/echo; /tmp/echo ok`, "ok\n", "", 0},
+		{`cp /bin/ls /tmp/ls; /tmp/ls / >/dev/null`, "", "", 0},
+		{`echo x > /tmp/x; chmod 755 /tmp/x; /tmp/x`, "", "/tmp/x: command not found\n", 127},
+	}
+	cfg := newTestConfig(t, "recording:\n  enabled: false\n")
+	for _, test := range tests {
+		stdout, stderr, status := runTestScript(t, newTestShellSession(cfg), test.script)
+		if stdout != test.stdout || stderr != test.stderr || status != test.status {
+			t.Errorf("%q: stdout %q stderr %q status %v, want %q %q %v", test.script, stdout, stderr, status, test.stdout, test.stderr, test.status)
+		}
+	}
+}
@@ -1,38 +1,155 @@
 package main
 
 import (
+	"github.com/adrg/xdg"
 	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
 
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // server 配置文件 对应yaml文件中的server
 type serverConfig struct {
-	ListenAddress string   `yaml:"listen_address"`
-	HostKeys      []string `yaml:"host_keys"`
+	ListenAddress string           `yaml:"listen_address"` // 未配置listeners时使用
+	Protocol      string           `yaml:"protocol"`       // ssh或telnet
+	ProxyProtocol string           `yaml:"proxy_protocol"` // off optional或required
+	HostKeys      []string         `yaml:"host_keys"`
+	Listeners     []listenerConfig `yaml:"listeners"`
+}
+
+// 监听地址 对应yaml文件中server.listeners的每一项
+// ssh_proto telnet auth和persona的结构与全局配置相同 只覆盖其中设置的字段
+type listenerConfig struct {
+	Address       string        `yaml:"address"`
+	Protocol      string        `yaml:"protocol"`       // 为空时使用server.protocol
+	ProxyProtocol string        `yaml:"proxy_protocol"` // 为空时使用server.proxy_protocol
+	HostKeys      []string      `yaml:"host_keys"`
+	SSHProto      yaml.MapSlice `yaml:"ssh_proto"`
+	Telnet        yaml.MapSlice `yaml:"telnet"`
+	Auth          yaml.MapSlice `yaml:"auth"`
+	Persona       yaml.MapSlice `yaml:"persona"`
+}
+
+// 用监听地址的设置覆盖全局配置
+func (listener listenerConfig) apply(cfg *config) error {
+	for _, item := range listener.SSHProto {
+		if item.Key != "profile" {
+			continue
+		}
+		name, _ := item.Value.(string)
+		profile, ok := serverProfiles[name]
+		if !ok {
+			return fmt.Errorf("ssh_proto.profile: unknown profile %q, available: %v", item.Value, profileNames())
+		}
+		profile.apply(cfg)
+	}
+	overrides := []struct {
+		key   string
+		value yaml.MapSlice
+		out   interface{}
+	}{
+		{"ssh_proto", listener.SSHProto, &cfg.SSHProto},
+		{"telnet", listener.Telnet, &cfg.Telnet},
+		{"auth", listener.Auth, &cfg.Auth},
+		{"persona", listener.Persona, &cfg.Persona},
+	}
+	for _, override := range overrides {
+		if override.value == nil {
+			continue
+		}
+		data, err := yaml.Marshal(override.value)
+		if err != nil {
+			return fmt.Errorf("%v: %w", override.key, err)
+		}
+		if err := yaml.UnmarshalStrict(data, override.out); err != nil {
+			return fmt.Errorf("%v: %w", override.key, err)
+		}
+	}
+	cfg.Server.ListenAddress = listener.Address
+	if listener.Protocol != "" {
+		cfg.Server.Protocol = listener.Protocol
+	}
+	if listener.ProxyProtocol != "" {
+		cfg.Server.ProxyProtocol = listener.ProxyProtocol
+	}
+	if listener.HostKeys != nil {
+		cfg.Server.HostKeys = listener.HostKeys
+	}
+	cfg.Server.Listeners = nil
+	return nil
+}
+
+// 监听地址的主机密钥所在的子目录
+func listenerKeyDir(address string) string {
+	return strings.NewReplacer(":", "_", "[", "", "]", "", "/", "_").Replace(address)
 }
 
 // 日志配置文件 对应yaml文件中的logging
+// 未配置outputs时 file/json/debug决定唯一的默认输出
 type loggingConfig struct {
-	File       string `yaml:"file"`
-	JSON       bool   `yaml:"json"`
-	Timestamps bool   `yaml:"timestamps"`
-	Debug      bool   `yaml:"debug"`
+	File       string            `yaml:"file"`
+	Rotation   logRotationConfig `yaml:"rotation"`
+	JSON       bool              `yaml:"json"`
+	Timestamps bool              `yaml:"timestamps"`
+	Debug      bool              `yaml:"debug"`
+	QueueSize  int               `yaml:"queue_size"`
+	Outputs    []outputConfig    `yaml:"outputs"`
+}
+
+// 事件输出配置 对应yaml文件中logging.outputs的每一项
+type outputConfig struct {
+	Type   string `yaml:"type"`   // stderr, stdout, file, syslog, webhook
+	Format string `yaml:"format"` // text, json
+	Debug  bool   `yaml:"debug"`
+
+	// file
+	Path     string            `yaml:"path"`
+	Rotation logRotationConfig `yaml:"rotation"`
+
+	// syslog
+	Network  string `yaml:"network"`
+	Address  string `yaml:"address"`
+	Tag      string `yaml:"tag"`
+	Facility string `yaml:"facility"`
+
+	// webhook
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+}
+
+// 日志文件轮转配置 对应yaml文件中的logging.rotation
+type logRotationConfig struct {
+	MaxSize    int64         `yaml:"max_size"` // 单位MB 为0时不按大小轮转
+	MaxAge     time.Duration `yaml:"max_age"`  // 为0时不按时间轮转
+	MaxBackups int           `yaml:"max_backups"`
+	Compress   bool          `yaml:"compress"`
 }
 
 // 认证配置文件 对应yaml文件中的auth
 type authConfig struct {
-	MaxTries     int              `yaml:"max_tries"`
-	NoAuth       bool             `yaml:"no_auth"`
-	PasswordAuth commonAuthConfig `yaml:"password_auth"`
-	//PublicKeyAuth commonAuthConfig `yaml:"public_key_auth"`
+	MaxTries      int                 `yaml:"max_tries"`
+	NoAuth        bool                `yaml:"no_auth"`
+	PasswordAuth  passwordAuthConfig  `yaml:"password_auth"`
+	PublicKeyAuth publicKeyAuthConfig `yaml:"public_key_auth"`
+
+	KeyboardInteractiveAuth keyboardInteractiveAuthConfig `yaml:"keyboard_interactive_auth"`
 }
 
 // 认证的两种情况
@@ -41,49 +158,320 @@ type commonAuthConfig struct {
 	Accepted bool `yaml:"accepted"`
 }
 
+// 公钥认证 accepted_keys不为空时只接受其中的公钥 忽略accepted 格式同authorized_keys
+type publicKeyAuthConfig struct {
+	commonAuthConfig `yaml:",inline"`
+	AcceptedKeys     []string `yaml:"accepted_keys"`
+}
+
+// keyboard-interactive认证 第一个问题的回答按password_auth.policy判断
+// accepted为没有策略规则命中时的结果
+type keyboardInteractiveAuthConfig struct {
+	commonAuthConfig `yaml:",inline"`
+	Instruction      string                        `yaml:"instruction"`
+	Questions        []keyboardInteractiveQuestion `yaml:"questions"`
+}
+
+type keyboardInteractiveQuestion struct {
+	Text string `yaml:"text"`
+	Echo bool   `yaml:"echo"`
+}
+
+// 密码认证 accepted为没有策略规则命中时的结果
+type passwordAuthConfig struct {
+	commonAuthConfig `yaml:",inline"`
+	Policy           credentialPolicyConfig `yaml:"policy"`
+}
+
 // ssh 协议的配置文件 对应yaml文件中的ssh_proto
 type sshProtoConfig struct {
+	Profile string `yaml:"profile"` // 内置的服务器配置 作为本节以及认证方法和persona的默认值
 	Version string `yaml:"version"`
 	Banner  string `yaml:"banner"`
+	// 通告的算法及顺序 为空时使用x/crypto/ssh的默认值
+	KeyExchanges      []string `yaml:"key_exchanges"`
+	Ciphers           []string `yaml:"ciphers"`
+	MACs              []string `yaml:"macs"`
+	HostKeyAlgorithms []string `yaml:"host_key_algorithms"` // 使用的主机密钥类型及顺序
+	AnnounceHostKeys  bool     `yaml:"announce_host_keys"`  // 认证后通过hostkeys-00@openssh.com通告所有主机密钥
 }
 
 // 整个ssh的配置
 type config struct {
-	Server   serverConfig   `yaml:"server"`
-	Logging  loggingConfig  `yaml:"logging"`
-	Auth     authConfig     `yaml:"auth"`
-	SSHProto sshProtoConfig `yaml:"ssh_proto"`
+	Server     serverConfig     `yaml:"server"`
+	Logging    loggingConfig    `yaml:"logging"`
+	Auth       authConfig       `yaml:"auth"`
+	SSHProto   sshProtoConfig   `yaml:"ssh_proto"`
+	Telnet     telnetConfig     `yaml:"telnet"`
+	Filesystem filesystemConfig `yaml:"filesystem"`
+	Persona    personaConfig    `yaml:"persona"`
+	Downloads  downloadsConfig  `yaml:"downloads"`
+	Recording  recordingConfig  `yaml:"recording"`
 
 	parsedHostKeys []ssh.Signer // 存放解析后的主机密钥
-	sshConfig      *ssh.ServerConfig
+	passwordPolicy *credentialPolicy
+	// keyboard-interactive使用与密码认证相同的规则 只有默认结果不同
+	keyboardInteractivePolicy *credentialPolicy
+	acceptedKeys              map[string]bool // 解析后的公钥 键为公钥的wire格式
+	sshConfig                 *ssh.ServerConfig
+	filesystem                *vfs      // 文件系统模板 每个会话从它创建自己的副本
+	listeners                 []*config // 每个监听地址的完整配置 未配置listeners时只有自身
+}
+
+// 监听地址对应的配置 没有时返回nil
+func (cfg *config) listenerConfig(address string) *config {
+	for _, listenerCfg := range cfg.listeners {
+		if listenerCfg.Server.ListenAddress == address {
+			return listenerCfg
+		}
+	}
+	return nil
+}
+
+// 所有监听地址
+func (cfg *config) listenAddresses() []string {
+	var addresses []string
+	for _, listenerCfg := range cfg.listeners {
+		addresses = append(addresses, listenerCfg.Server.ListenAddress)
+	}
+	return addresses
 }
 
 // 1.默认配置文件
 func getDefaultConfig() *config {
 	cfg := &config{}
 	cfg.Server.ListenAddress = "127.0.0.1:2222"
+	cfg.Server.Protocol = "ssh"
+	cfg.Server.ProxyProtocol = proxyProtocolOff
 	cfg.Logging.Timestamps = true
+	cfg.Logging.QueueSize = 1024
 	cfg.Auth.PasswordAuth.Enabled = true
 	cfg.Auth.PasswordAuth.Accepted = true
-	//cfg.Auth.PublicKeyAuth.Enabled = true
+	cfg.Auth.PublicKeyAuth.Enabled = true
+	cfg.Auth.KeyboardInteractiveAuth.Accepted = true
+	cfg.Auth.KeyboardInteractiveAuth.Questions = []keyboardInteractiveQuestion{{Text: "Password: "}}
 	cfg.SSHProto.Version = "SSH-2.0-gossh-honey"
 	cfg.SSHProto.Banner = "This is an SSH honeypot. Everything is logged and monitored."
+	cfg.SSHProto.AnnounceHostKeys = true
+	cfg.Telnet.PasswordPrompt = "Password: "
+	cfg.Telnet.MaxTries = 3
+	cfg.Filesystem.MaxFileSize = 10 * 1024 * 1024
+	cfg.Filesystem.MaxSessionSize = 100 * 1024 * 1024
+	cfg.Persona = defaultPersona()
+	cfg.Downloads.QuarantineDir = path.Join(xdg.DataHome, "gossh-honey", "downloads")
+	cfg.Downloads.MaxSize = 10 * 1024 * 1024
+	cfg.Downloads.Timeout = 30 * time.Second
+	cfg.Recording.Enabled = true
+	cfg.Recording.Directory = path.Join(xdg.DataHome, "gossh-honey", "recordings")
+	cfg.Recording.MaxSize = 10 * 1024 * 1024
 	return cfg
 }
 
+// 1.1校验配置文件 错误信息中带上对应的yaml字段名
+func (cfg *config) validate() error {
+	if err := validateListenAddress(cfg.Server.ListenAddress); err != nil {
+		return fmt.Errorf("server.listen_address: %w", err)
+	}
+	if err := validateProtocol(cfg.Server.Protocol); err != nil {
+		return fmt.Errorf("server.protocol: %w", err)
+	}
+	if err := validateProxyProtocol(cfg.Server.ProxyProtocol); err != nil {
+		return fmt.Errorf("server.proxy_protocol: %w", err)
+	}
+	for i, keyFile := range cfg.Server.HostKeys {
+		if keyFile == "" {
+			return fmt.Errorf("server.host_keys[%v]: empty path", i)
+		}
+	}
+	addresses := map[string]bool{}
+	for i, listener := range cfg.Server.Listeners {
+		if err := validateListenAddress(listener.Address); err != nil {
+			return fmt.Errorf("server.listeners[%v].address: %w", i, err)
+		}
+		if addresses[listener.Address] {
+			return fmt.Errorf("server.listeners[%v].address: duplicate address %q", i, listener.Address)
+		}
+		addresses[listener.Address] = true
+		if listener.Protocol != "" {
+			if err := validateProtocol(listener.Protocol); err != nil {
+				return fmt.Errorf("server.listeners[%v].protocol: %w", i, err)
+			}
+		}
+		if listener.ProxyProtocol != "" {
+			if err := validateProxyProtocol(listener.ProxyProtocol); err != nil {
+				return fmt.Errorf("server.listeners[%v].proxy_protocol: %w", i, err)
+			}
+		}
+		for j, keyFile := range listener.HostKeys {
+			if keyFile == "" {
+				return fmt.Errorf("server.listeners[%v].host_keys[%v]: empty path", i, j)
+			}
+		}
+	}
+	if cfg.Logging.Rotation.MaxSize < 0 {
+		return fmt.Errorf("logging.rotation.max_size: must not be negative, got %v", cfg.Logging.Rotation.MaxSize)
+	}
+	if cfg.Logging.Rotation.MaxAge < 0 {
+		return fmt.Errorf("logging.rotation.max_age: must not be negative, got %v", cfg.Logging.Rotation.MaxAge)
+	}
+	if cfg.Logging.Rotation.MaxBackups < 0 {
+		return fmt.Errorf("logging.rotation.max_backups: must not be negative, got %v", cfg.Logging.Rotation.MaxBackups)
+	}
+	if cfg.Logging.QueueSize <= 0 {
+		return fmt.Errorf("logging.queue_size: must be positive, got %v", cfg.Logging.QueueSize)
+	}
+	for i, output := range cfg.Logging.Outputs {
+		if err := output.validate(); err != nil {
+			return fmt.Errorf("logging.outputs[%v].%w", i, err)
+		}
+	}
+	if cfg.Auth.MaxTries < 0 {
+		return fmt.Errorf("auth.max_tries: must not be negative, got %v", cfg.Auth.MaxTries)
+	}
+	if err := cfg.Auth.PasswordAuth.Policy.validate(); err != nil {
+		return fmt.Errorf("auth.password_auth.policy.%w", err)
+	}
+	if cfg.Auth.KeyboardInteractiveAuth.Enabled && len(cfg.Auth.KeyboardInteractiveAuth.Questions) == 0 {
+		return errors.New("auth.keyboard_interactive_auth.questions: at least one question is required")
+	}
+	if cfg.Filesystem.MaxFileSize < 0 {
+		return fmt.Errorf("filesystem.max_file_size: must not be negative, got %v", cfg.Filesystem.MaxFileSize)
+	}
+	if cfg.Filesystem.MaxSessionSize < 0 {
+		return fmt.Errorf("filesystem.max_session_size: must not be negative, got %v", cfg.Filesystem.MaxSessionSize)
+	}
+	if err := cfg.Persona.validate(); err != nil {
+		return fmt.Errorf("persona.%w", err)
+	}
+	if err := cfg.Downloads.validate(); err != nil {
+		return fmt.Errorf("downloads.%w", err)
+	}
+	if err := cfg.Recording.validate(); err != nil {
+		return fmt.Errorf("recording.%w", err)
+	}
+	if err := cfg.Telnet.validate(); err != nil {
+		return fmt.Errorf("telnet.%w", err)
+	}
+	if !strings.HasPrefix(cfg.SSHProto.Version, "SSH-2.0-") {
+		return fmt.Errorf("ssh_proto.version: %q does not start with \"SSH-2.0-\"", cfg.SSHProto.Version)
+	}
+	if strings.ContainsAny(cfg.SSHProto.Version, "\r\n") {
+		return fmt.Errorf("ssh_proto.version: %q contains a line break", cfg.SSHProto.Version)
+	}
+	if err := validateAlgorithms(cfg.SSHProto.KeyExchanges, supportedKeyExchanges); err != nil {
+		return fmt.Errorf("ssh_proto.key_exchanges%w", err)
+	}
+	if err := validateAlgorithms(cfg.SSHProto.Ciphers, supportedCiphers); err != nil {
+		return fmt.Errorf("ssh_proto.ciphers%w", err)
+	}
+	if err := validateAlgorithms(cfg.SSHProto.MACs, supportedMACs); err != nil {
+		return fmt.Errorf("ssh_proto.macs%w", err)
+	}
+	if err := validateAlgorithms(cfg.SSHProto.HostKeyAlgorithms, supportedHostKeyTypes); err != nil {
+		return fmt.Errorf("ssh_proto.host_key_algorithms%w", err)
+	}
+	return nil
+}
+
+func (output outputConfig) validate() error {
+	switch output.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("format: unsupported format %q", output.Format)
+	}
+	switch output.Type {
+	case "stderr", "stdout":
+	case "file":
+		if output.Path == "" {
+			return errors.New("path: required for file outputs")
+		}
+		if output.Rotation.MaxSize < 0 || output.Rotation.MaxAge < 0 || output.Rotation.MaxBackups < 0 {
+			return errors.New("rotation: values must not be negative")
+		}
+	case "syslog":
+		if _, err := parseSyslogFacility(output.Facility); err != nil {
+			return fmt.Errorf("facility: %w", err)
+		}
+	case "webhook":
+		if output.URL == "" {
+			return errors.New("url: required for webhook outputs")
+		}
+		if output.Timeout < 0 {
+			return fmt.Errorf("timeout: must not be negative, got %v", output.Timeout)
+		}
+	case "":
+		return errors.New("type: required")
+	default:
+		return fmt.Errorf("type: unsupported output type %q", output.Type)
+	}
+	return nil
+}
+
+func validateProtocol(protocol string) error {
+	switch protocol {
+	case "ssh", "telnet":
+		return nil
+	default:
+		return fmt.Errorf("unsupported protocol %q", protocol)
+	}
+}
+
+func validateListenAddress(address string) error {
+	if address == "" {
+		return errors.New("empty address")
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	}
+	return nil
+}
+
+// 主机密钥类型 与OpenSSH默认生成的密钥一致
+type keyType int
+
+const (
+	rsaKey keyType = iota
+	ecdsaKey
+	ed25519Key
+)
+
+func (t keyType) String() string {
+	switch t {
+	case rsaKey:
+		return "rsa"
+	case ecdsaKey:
+		return "ecdsa"
+	case ed25519Key:
+		return "ed25519"
+	default:
+		return fmt.Sprintf("keyType(%d)", int(t))
+	}
+}
+
+// 默认生成的主机密钥 顺序即hostkeys-00@openssh.com中通告的顺序
+var defaultKeyTypes = []keyType{rsaKey, ecdsaKey, ed25519Key}
+
 // 2.设置默认的主机密钥
 func (cfg *config) setDefaultHostKeys(dataDir string) error {
-	keyFile, err := generateKey(dataDir) // 在指定路径中生成hostkey
-	if err != nil {
-		return nil
+	for _, t := range defaultKeyTypes {
+		keyFile, err := generateKey(dataDir, t) // 在指定路径中生成hostkey
+		if err != nil {
+			return err
+		}
+		cfg.Server.HostKeys = append(cfg.Server.HostKeys, keyFile)
 	}
-	cfg.Server.HostKeys = append(cfg.Server.HostKeys, keyFile)
 	return nil
 }
 
 // 2.1生成密钥
-func generateKey(dataDir string) (string, error) {
-	keyFile := path.Join(dataDir, "host_rsa_key")
+func generateKey(dataDir string, t keyType) (string, error) {
+	keyFile := path.Join(dataDir, fmt.Sprintf("host_%v_key", t))
 	if _, err := os.Stat(keyFile); err == nil {
 		return keyFile, nil
 	} else if !os.IsNotExist(err) {
@@ -99,9 +487,19 @@ func generateKey(dataDir string) (string, error) {
 	}
 
 	var key interface{}
+	var err error
 
-	// 调用rsa的GenerateKey方法产生密钥
-	key, err := rsa.GenerateKey(rand.Reader, 3072)
+	// 根据密钥类型产生密钥 RSA与ssh-keygen默认一样为3072位
+	switch t {
+	case rsaKey:
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	case ecdsaKey:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ed25519Key:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported key type %v", t)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -116,20 +514,43 @@ func generateKey(dataDir string) (string, error) {
 	return keyFile, nil
 }
 
-// 3.获取ssh 配置文件
+// 3.获取ssh 配置文件 认证回调在每个连接建立时由createSSHConfig设置
 func (cfg *config) setupSSHConfig() error {
 	sshConfig := &ssh.ServerConfig{
-		NoClientAuth:     cfg.Auth.NoAuth,
-		MaxAuthTries:     cfg.Auth.MaxTries,
-		PasswordCallback: cfg.getPasswordCallback(),
-		//PublicKeyCallback: cfg.getPublicKeyCallback(),
+		NoClientAuth:   cfg.Auth.NoAuth,
+		MaxAuthTries:   cfg.Auth.MaxTries,
 		BannerCallback: cfg.getBannerCallback(),
 		ServerVersion:  cfg.SSHProto.Version,
 	}
+	sshConfig.KeyExchanges = cfg.SSHProto.KeyExchanges
+	sshConfig.Ciphers = cfg.SSHProto.Ciphers
+	sshConfig.MACs = cfg.SSHProto.MACs
 	// 3.1解析主机密钥
 	if err := cfg.parseHostKeys(); err != nil {
 		return err
 	}
+	passwordPolicy, err := newCredentialPolicy(cfg.Auth.PasswordAuth.Policy, cfg.Auth.PasswordAuth.Accepted)
+	if err != nil {
+		return fmt.Errorf("auth.password_auth.policy.%w", err)
+	}
+	cfg.passwordPolicy = passwordPolicy
+	// keyboard-interactive使用相同的规则 只有没有规则命中时的结果不同
+	keyboardInteractivePolicy, err := newCredentialPolicy(cfg.Auth.PasswordAuth.Policy, cfg.Auth.KeyboardInteractiveAuth.Accepted)
+	if err != nil {
+		return fmt.Errorf("auth.password_auth.policy.%w", err)
+	}
+	cfg.keyboardInteractivePolicy = keyboardInteractivePolicy
+	cfg.passwordPolicy.scope = cfg.Server.ListenAddress
+	cfg.keyboardInteractivePolicy.scope = cfg.Server.ListenAddress
+	// 解析接受的公钥
+	cfg.acceptedKeys = map[string]bool{}
+	for i, line := range cfg.Auth.PublicKeyAuth.AcceptedKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("auth.public_key_auth.accepted_keys[%v]: %w", i, err)
+		}
+		cfg.acceptedKeys[string(key.Marshal())] = true
+	}
 	for _, key := range cfg.parsedHostKeys {
 		// 添加主机密钥
 		sshConfig.AddHostKey(key)
@@ -143,10 +564,26 @@ func (cfg *config) parseHostKeys() error {
 	for _, keyFile := range cfg.Server.HostKeys {
 		signer, err := loadKey(keyFile) // 加载keyFile
 		if err != nil {
-			return err
+			return fmt.Errorf("server.host_keys: %q: %w", keyFile, err)
 		}
 		cfg.parsedHostKeys = append(cfg.parsedHostKeys, signer)
 	}
+	if len(cfg.SSHProto.HostKeyAlgorithms) == 0 || len(cfg.parsedHostKeys) == 0 {
+		return nil
+	}
+	// 按配置的类型筛选和排序 类型相同的密钥保持原来的顺序
+	var signers []ssh.Signer
+	for _, algorithm := range cfg.SSHProto.HostKeyAlgorithms {
+		for _, signer := range cfg.parsedHostKeys {
+			if signer.PublicKey().Type() == algorithm {
+				signers = append(signers, signer)
+			}
+		}
+	}
+	if len(signers) == 0 {
+		return fmt.Errorf("ssh_proto.host_key_algorithms: none of the host keys is of type %v", strings.Join(cfg.SSHProto.HostKeyAlgorithms, ", "))
+	}
+	cfg.parsedHostKeys = signers
 	return nil
 }
 
@@ -158,3 +595,13 @@ func loadKey(keyFile string) (ssh.Signer, error) {
 	}
 	return ssh.ParsePrivateKey(keyBytes)
 }
+
+// 4.为单个连接创建ssh配置文件 认证回调记录该连接的每一次认证尝试
+func (cfg *config) createSSHConfig(context *authContext) *ssh.ServerConfig {
+	sshConfig := *cfg.sshConfig
+	sshConfig.PasswordCallback = cfg.getPasswordCallback(context)
+	sshConfig.PublicKeyCallback = cfg.getPublicKeyCallback(context)
+	sshConfig.KeyboardInteractiveCallback = cfg.getKeyboardInteractiveCallback(context)
+	sshConfig.AuthLogCallback = cfg.getAuthLogCallback(context)
+	return &sshConfig
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProfileOverrides(t *testing.T) {
+	tests := []struct {
+		config string
+		want   []string
+	}{
+		{"ssh_proto:\n  profile: dropbear-2019.78\n", nil},
+		{"ssh_proto:\n  profile: dropbear-2019.78\n  ciphers: [aes128-ctr]\npersona:\n  hostname: gw\n", nil},
+		{"ssh_proto:\n  profile: dropbear-2019.78\n  version: SSH-2.0-x\n  banner: \"\"\n", []string{"ssh_proto.version", "ssh_proto.banner"}},
+		{"persona:\n  kernel:\n    release: 6.1.0\n  os: {}\n", []string{"persona.kernel", "persona.os"}},
+	}
+	for _, test := range tests {
+		if got := profileOverrides(test.config); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("profileOverrides(%q) = %v, want %v", test.config, got, test.want)
+		}
+	}
+}
+
+// 发布的配置文件中设置profile后不能有覆盖它的字段
+func TestShippedConfigUsesProfile(t *testing.T) {
+	data, err := ioutil.ReadFile("config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configString := strings.Replace(string(data), "  profile: \"\"", "  profile: dropbear-2019.78", 1)
+	if fields := profileOverrides(configString); len(fields) != 0 {
+		t.Errorf("config.yaml overrides profile fields %v", fields)
+	}
+	cfg, err := parseConfig(configString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := serverProfiles["dropbear-2019.78"]
+	if cfg.SSHProto.Version != profile.version || cfg.SSHProto.Banner != "" || cfg.Persona.OS != profile.os {
+		t.Errorf("version %q banner %q os %v, want profile values", cfg.SSHProto.Version, cfg.SSHProto.Banner, cfg.Persona.OS)
+	}
+}
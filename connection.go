@@ -3,20 +3,52 @@ package main
 import (
 	"golang.org/x/crypto/ssh"
 
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type connContext struct {
 	ssh.ConnMetadata
 	cfg            *config
+	connID         string // 全局唯一的连接ID
 	noMoreSessions bool
 }
 
 type channelContext struct {
 	connContext
 	channelID int
+	sessionID string // 全局唯一的会话ID 由连接ID和channelID组成
+	fs        *vfs   // 该会话的写时复制文件系统 同一连接的不同会话互不影响 只有session通道使用
+}
+
+func newChannelContext(context connContext, channelID int) channelContext {
+	return channelContext{connContext: context, channelID: channelID, sessionID: fmt.Sprintf("%v-%v", context.connID, channelID)}
+}
+
+// 握手完成前的连接信息 只有地址可用
+type preAuthConnMetadata struct {
+	net.Conn
+}
+
+func (preAuthConnMetadata) User() string          { return "" }
+func (preAuthConnMetadata) SessionID() []byte     { return nil }
+func (preAuthConnMetadata) ClientVersion() []byte { return nil }
+func (preAuthConnMetadata) ServerVersion() []byte { return nil }
+
+// 生成随机的连接ID
+func newConnID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand不可用时退化为基于时间的ID
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
 }
 
 var channelHandlers = map[string]func(newChannel ssh.NewChannel, context channelContext) error{
@@ -26,27 +58,43 @@ var channelHandlers = map[string]func(newChannel ssh.NewChannel, context channel
 
 // 连接操作
 func handleConnection(conn net.Conn, cfg *config) {
-	serverConn, newChannels, requests, err := ssh.NewServerConn(conn, cfg.sshConfig) //必须为Request和NewChannel通道提供服务
+	sniffer := newHandshakeSniffer(conn)
+	auth := &authContext{connContext: connContext{ConnMetadata: preAuthConnMetadata{conn}, cfg: cfg, connID: newConnID()}}
+	serverConn, newChannels, requests, err := ssh.NewServerConn(sniffer, cfg.createSSHConfig(auth)) //必须为Request和NewChannel通道提供服务
 	if err != nil {
-		log.Printf("Failed to establish SSH connection: %v", err)
+		auth.logEvent(sniffer.failureLog(auth.attempts, err))
 		conn.Close()
 		return
 	}
 	var channels sync.WaitGroup
-	context := connContext{ConnMetadata: serverConn, cfg: cfg}
+	context := auth.connContext
+	context.ConnMetadata = serverConn
 	defer func() {
 		serverConn.Close()
 		channels.Wait()
 		context.logEvent(connectionCloseLog{})
 	}()
 
-	context.logEvent(connectionLog{
+	entry := connectionLog{
+		Protocol:      "ssh",
+		LocalAddress:  serverConn.LocalAddr().String(),
 		ClientVersion: string(serverConn.ClientVersion()),
-	})
+	}
+	if kexInit := sniffer.clientKexInit(); kexInit != nil {
+		entry.HASSH, entry.HASSHAlgorithms = kexInit.hassh()
+		entry.KexAlgorithms = kexInit.KexAlgos
+		entry.HostKeyAlgorithms = kexInit.ServerHostKeyAlgos
+		entry.Ciphers = kexInit.CiphersClientServer
+		entry.MACs = kexInit.MACsClientServer
+		entry.Compression = kexInit.CompressionClientServer
+	}
+	context.logEvent(entry)
 
-	if _, _, err := serverConn.SendRequest("hostkeys-00@openssh.com", false, createHostkeysRequestPayload(cfg.parsedHostKeys)); err != nil {
-		log.Printf("Failed to send hostkeys-00@openssh.com request: %v", err)
-		return
+	if cfg.SSHProto.AnnounceHostKeys {
+		if _, _, err := serverConn.SendRequest("hostkeys-00@openssh.com", false, createHostkeysRequestPayload(cfg.parsedHostKeys)); err != nil {
+			log.Printf("Failed to send hostkeys-00@openssh.com request: %v", err)
+			return
+		}
 	}
 
 	channelID := 0
@@ -95,7 +143,7 @@ func handleConnection(conn net.Conn, cfg *config) {
 					log.Printf("Failed to handle new channel: %v", err)
 					serverConn.Close()
 				}
-			}(channelContext{context, channelID})
+			}(newChannelContext(context, channelID))
 			channelID++
 		}
 	}
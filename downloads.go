@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 下载配置 对应yaml文件中的downloads
+// fetch为false时不访问网络 下载命令输出伪造的结果
+type downloadsConfig struct {
+	Fetch         bool          `yaml:"fetch"`
+	QuarantineDir string        `yaml:"quarantine_dir"` // 下载和上传的文件以SHA-256命名保存在这里
+	MaxSize       int64         `yaml:"max_size"`       // 单个文件的最大字节数
+	Timeout       time.Duration `yaml:"timeout"`
+	AllowPrivate  bool          `yaml:"allow_private"` // 是否允许访问内网和本机地址
+}
+
+func (downloads downloadsConfig) validate() error {
+	if downloads.Fetch && downloads.QuarantineDir == "" {
+		return errors.New("quarantine_dir: required when fetch is enabled")
+	}
+	if downloads.MaxSize <= 0 {
+		return fmt.Errorf("max_size: must be positive, got %v", downloads.MaxSize)
+	}
+	if downloads.Timeout <= 0 {
+		return fmt.Errorf("timeout: must be positive, got %v", downloads.Timeout)
+	}
+	return nil
+}
+
+var (
+	errDownloadTooLarge = errors.New("file too large")
+	errForbiddenAddress = errors.New("Connection refused")
+)
+
+// 下载的结果
+type download struct {
+	data        []byte
+	status      int    // HTTP状态码 其他协议为0
+	statusText  string // 例如200 OK
+	contentType string
+}
+
+// 按URL的协议下载文件 userAgent只用于HTTP
+func (downloads downloadsConfig) fetch(rawURL string, userAgent string) (*download, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return downloads.fetchHTTP(u, userAgent)
+	case "ftp":
+		return downloads.fetchFTP(u)
+	case "tftp":
+		return downloads.fetchTFTP(u)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+}
+
+// 拒绝连接内网和本机地址 防止攻击者利用蜜罐访问内部服务
+func (downloads downloadsConfig) checkAddress(ip net.IP) error {
+	if downloads.AllowPrivate {
+		return nil
+	}
+	if ip == nil || ip.IsLoopback() || isPrivateIP(ip) || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return errForbiddenAddress
+	}
+	return nil
+}
+
+// 内网地址段 包括运营商级NAT
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析主机名 返回第一个地址
+func (downloads downloadsConfig) lookup(host string) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), downloads.Timeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address for %v", host)
+	}
+	return ips[0].IP, nil
+}
+
+func (downloads downloadsConfig) dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout: downloads.Timeout,
+		Control: func(network, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return downloads.checkAddress(net.ParseIP(host))
+		},
+	}
+}
+
+// 读取全部内容 超过max_size时返回错误
+func (downloads downloadsConfig) readAll(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, downloads.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > downloads.MaxSize {
+		return nil, errDownloadTooLarge
+	}
+	return data, nil
+}
+
+func (downloads downloadsConfig) fetchHTTP(u *url.URL, userAgent string) (*download, error) {
+	client := &http.Client{
+		Timeout: downloads.Timeout,
+		Transport: &http.Transport{
+			DialContext:     downloads.dialer().DialContext,
+			Proxy:           nil,
+			IdleConnTimeout: time.Second,
+		},
+	}
+	request, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", userAgent)
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := downloads.readAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &download{data, response.StatusCode, response.Status, response.Header.Get("Content-Type")}, nil
+}
+
+// 被动模式的FTP下载 数据连接使用控制连接的地址 不使用服务器返回的地址
+func (downloads downloadsConfig) fetchFTP(u *url.URL) (*download, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "21")
+	}
+	conn, err := downloads.dialer().Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(downloads.Timeout))
+	reader := bufio.NewReader(conn)
+	command := func(line string, expected ...string) (string, error) {
+		if line != "" {
+			if _, err := fmt.Fprintf(conn, "%v\r\n", line); err != nil {
+				return "", err
+			}
+		}
+		for {
+			reply, err := reader.ReadString('\n')
+			if err != nil {
+				return "", err
+			}
+			// 多行回复的最后一行是"代码 "
+			if len(reply) < 4 || reply[3] == '-' {
+				continue
+			}
+			for _, code := range expected {
+				if strings.HasPrefix(reply, code) {
+					return strings.TrimSpace(reply), nil
+				}
+			}
+			return "", fmt.Errorf("unexpected reply %q", strings.TrimSpace(reply))
+		}
+	}
+	user, password := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	if _, err := command("", "220"); err != nil {
+		return nil, err
+	}
+	if reply, err := command("USER "+user, "230", "331"); err != nil {
+		return nil, err
+	} else if strings.HasPrefix(reply, "331") {
+		if _, err := command("PASS "+password, "230", "202"); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := command("TYPE I", "200"); err != nil {
+		return nil, err
+	}
+	reply, err := command("PASV", "227")
+	if err != nil {
+		return nil, err
+	}
+	start, end := strings.IndexByte(reply, '('), strings.IndexByte(reply, ')')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid PASV reply %q", reply)
+	}
+	fields := strings.Split(reply[start+1:end], ",")
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid PASV reply %q", reply)
+	}
+	p1, _ := strconv.Atoi(fields[4])
+	p2, _ := strconv.Atoi(fields[5])
+	controlHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	dataConn, err := downloads.dialer().Dial("tcp", net.JoinHostPort(controlHost, strconv.Itoa(p1*256+p2)))
+	if err != nil {
+		return nil, err
+	}
+	defer dataConn.Close()
+	dataConn.SetDeadline(time.Now().Add(downloads.Timeout))
+	if _, err := command("RETR "+strings.TrimPrefix(u.Path, "/"), "150", "125"); err != nil {
+		return nil, err
+	}
+	data, err := downloads.readAll(dataConn)
+	if err != nil {
+		return nil, err
+	}
+	return &download{data: data}, nil
+}
+
+// TFTP下载 使用octet模式
+func (downloads downloadsConfig) fetchTFTP(u *url.URL) (*download, error) {
+	port := u.Port()
+	if port == "" {
+		port = "69"
+	}
+	ip, err := downloads.lookup(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if err := downloads.checkAddress(ip); err != nil {
+		return nil, err
+	}
+	server, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(downloads.Timeout))
+	request := append([]byte{0, 1}, strings.TrimPrefix(u.Path, "/")+"\x00octet\x00"...)
+	if _, err := conn.WriteTo(request, server); err != nil {
+		return nil, err
+	}
+	var data []byte
+	var peer net.Addr
+	expected := uint16(1)
+	buffer := make([]byte, 4+512)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return nil, err
+		}
+		// 服务器从新的端口回复 之后只接受该端口的数据
+		if !addr.(*net.UDPAddr).IP.Equal(server.IP) || (peer != nil && addr.String() != peer.String()) {
+			continue
+		}
+		peer = addr
+		if n < 4 {
+			return nil, errors.New("short TFTP packet")
+		}
+		switch binary.BigEndian.Uint16(buffer) {
+		case 3:
+		case 5:
+			return nil, fmt.Errorf("TFTP error: %v", strings.TrimRight(string(buffer[4:n]), "\x00"))
+		default:
+			return nil, errors.New("unexpected TFTP packet")
+		}
+		block := binary.BigEndian.Uint16(buffer[2:])
+		if block == expected {
+			data = append(data, buffer[4:n]...)
+			if int64(len(data)) > downloads.MaxSize {
+				return nil, errDownloadTooLarge
+			}
+			expected++
+		}
+		ack := []byte{0, 4, buffer[2], buffer[3]}
+		if _, err := conn.WriteTo(ack, peer); err != nil {
+			return nil, err
+		}
+		if block == expected-1 && n < len(buffer) {
+			return &download{data: data}, nil
+		}
+	}
+}
+
+// 保存到隔离目录 文件名为内容的SHA-256 返回SHA-256
+func (downloads downloadsConfig) quarantine(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:])
+	if err := os.MkdirAll(downloads.QuarantineDir, 0700); err != nil {
+		return name, err
+	}
+	file := path.Join(downloads.QuarantineDir, name)
+	if fileExists(file) {
+		return name, nil
+	}
+	// 先写入临时文件再重命名 避免留下不完整的文件 同时保存相同内容时各自使用不同的临时文件
+	tmp, err := ioutil.TempFile(downloads.QuarantineDir, name+".*")
+	if err != nil {
+		return name, err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return name, err
+}
+
+// 不下载时伪造的文件内容 大小由URL决定 同一个URL每次相同
+func fakeDownload(rawURL string) []byte {
+	sum := sha256.Sum256([]byte(rawURL))
+	size := 2048 + int(binary.BigEndian.Uint32(sum[:])%(60*1024))
+	return fakeBinary[:size]
+}
+
+// 伪造的服务器地址 同一个主机名每次相同
+func fakeAddress(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	sum := sha256.Sum256([]byte(host))
+	return fmt.Sprintf("%v.%v.%v.%v", 23+sum[0]%180, sum[1], sum[2], 1+sum[3]%254)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 同时保存相同内容时互不干扰 不留下临时文件
+func TestQuarantineConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	downloads := downloadsConfig{QuarantineDir: dir}
+	data := []byte("#!/bin/sh\necho pwned\n")
+	sum := sha256.Sum256(data)
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if name, err := downloads.quarantine(data); err != nil || name != hex.EncodeToString(sum[:]) {
+				t.Errorf("quarantine() = %v, %v", name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != hex.EncodeToString(sum[:]) {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Fatalf("files = %v, want only the SHA-256", names)
+	}
+	saved, err := ioutil.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if err != nil || string(saved) != string(data) {
+		t.Errorf("saved %q, %v", saved, err)
+	}
+}
+
+// 主机名解析失败时不再下载 只记录一次未下载的事件
+func TestWgetResolveFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := newTestConfig(t, "recording:\n  enabled: false\ndownloads:\n  fetch: true\n  timeout: 2s\n  quarantine_dir: "+dir+"\n")
+	stop := captureEvents(t)
+	_, stderr, status := runTestScript(t, newTestShellSession(cfg), "wget http://nonexistent.invalid/x.sh")
+	var downloads []downloadLog
+	for _, entry := range stop() {
+		if entry, ok := entry.(downloadLog); ok {
+			downloads = append(downloads, entry)
+		}
+	}
+	if status != 4 || !strings.HasSuffix(stderr, "wget: unable to resolve host address ‘nonexistent.invalid’\n") {
+		t.Errorf("status %v, stderr %q", status, stderr)
+	}
+	if len(downloads) != 1 || downloads[0].Fetched || downloads[0].Error == "" || downloads[0].URL != "http://nonexistent.invalid/x.sh" {
+		t.Errorf("download events = %+v, want one failed event", downloads)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 一条待输出的事件
+type event struct {
+	time         time.Time
+	source       string
+	connectionID string
+	sessionID    string // 不属于某个会话的事件为空
+	entry        logEntry
+}
+
+func (e event) isDebug() bool {
+	return strings.HasPrefix(e.entry.eventType(), "debug_")
+}
+
+// 文本格式 与log包的默认格式一致
+func (e event) text(timestamps bool) string {
+	id := e.sessionID
+	if id == "" {
+		id = e.connectionID
+	}
+	line := strings.TrimSuffix(fmt.Sprintf("[%v] [%v] %v", e.source, id, e.entry), "\n")
+	if timestamps {
+		line = fmt.Sprintf("%v %v", e.time.Format("2006/01/02 15:04:05"), line)
+	}
+	return line
+}
+
+// JSON格式
+func (e event) json(timestamps bool) ([]byte, error) {
+	var jsonEntry interface{}
+	if timestamps {
+		jsonEntry = struct {
+			Time         string   `json:"time"`
+			Source       string   `json:"source"`
+			ConnectionID string   `json:"connection_id"`
+			SessionID    string   `json:"session_id,omitempty"`
+			EventType    string   `json:"event_type"`
+			Event        logEntry `json:"event"`
+		}{e.time.Format(time.RFC3339), e.source, e.connectionID, e.sessionID, e.entry.eventType(), e.entry}
+	} else {
+		jsonEntry = struct {
+			Source       string   `json:"source"`
+			ConnectionID string   `json:"connection_id"`
+			SessionID    string   `json:"session_id,omitempty"`
+			EventType    string   `json:"event_type"`
+			Event        logEntry `json:"event"`
+		}{e.source, e.connectionID, e.sessionID, e.entry.eventType(), e.entry}
+	}
+	return json.Marshal(jsonEntry)
+}
+
+// 按输出格式序列化事件 结果以换行结尾
+func (e event) format(format string, timestamps bool) ([]byte, error) {
+	if format == "json" {
+		logBytes, err := e.json(timestamps)
+		if err != nil {
+			return nil, err
+		}
+		return append(logBytes, '\n'), nil
+	}
+	return []byte(e.text(timestamps) + "\n"), nil
+}
+
+// 事件输出
+type eventSink interface {
+	write(e event) error
+	close() error
+}
+
+// 输出到io.Writer stderr stdout和日志文件都使用该实现
+type writerSink struct {
+	writer     io.Writer
+	format     string
+	timestamps bool
+	closer     func() error
+}
+
+func (sink writerSink) write(e event) error {
+	logBytes, err := e.format(sink.format, sink.timestamps)
+	if err != nil {
+		return err
+	}
+	_, err = sink.writer.Write(logBytes)
+	return err
+}
+
+func (sink writerSink) close() error {
+	if sink.closer == nil {
+		return nil
+	}
+	return sink.closer()
+}
+
+// 通过HTTP POST将每条事件发送到webhook
+type webhookSink struct {
+	client     *http.Client
+	url        string
+	headers    map[string]string
+	format     string
+	timestamps bool
+}
+
+func (sink webhookSink) write(e event) error {
+	body, err := e.format(sink.format, sink.timestamps)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, sink.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if sink.format == "json" {
+		request.Header.Set("Content-Type", "application/json")
+	} else {
+		request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	for name, value := range sink.headers {
+		request.Header.Set(name, value)
+	}
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if _, err := io.Copy(io.Discard, response.Body); err != nil {
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %v", response.Status)
+	}
+	return nil
+}
+
+func (sink webhookSink) close() error {
+	sink.client.CloseIdleConnections()
+	return nil
+}
+
+// 根据配置创建事件输出
+func newEventSink(output outputConfig, timestamps bool) (eventSink, error) {
+	switch output.Type {
+	case "stderr":
+		return writerSink{writer: os.Stderr, format: output.Format, timestamps: timestamps}, nil
+	case "stdout":
+		return writerSink{writer: os.Stdout, format: output.Format, timestamps: timestamps}, nil
+	case "file":
+		file, err := acquireLogFile(output.Path, output.Rotation)
+		if err != nil {
+			return nil, err
+		}
+		return writerSink{writer: file, format: output.Format, timestamps: timestamps, closer: func() error {
+			return releaseLogFile(file)
+		}}, nil
+	case "syslog":
+		return newSyslogSink(output)
+	case "webhook":
+		timeout := output.Timeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		return webhookSink{
+			client:     &http.Client{Timeout: timeout},
+			url:        output.URL,
+			headers:    output.Headers,
+			format:     output.Format,
+			timestamps: timestamps,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output type %q", output.Type)
+	}
+}
+
+// 带有限长度队列的异步输出 队列满时丢弃事件 不阻塞ssh会话
+type queuedSink struct {
+	name    string
+	sink    eventSink
+	debug   bool
+	queue   chan event
+	dropped uint64
+	done    chan struct{}
+}
+
+func newQueuedSink(name string, sink eventSink, debug bool, queueSize int) *queuedSink {
+	output := &queuedSink{
+		name:  name,
+		sink:  sink,
+		debug: debug,
+		queue: make(chan event, queueSize),
+		done:  make(chan struct{}),
+	}
+	go output.run()
+	return output
+}
+
+func (output *queuedSink) publish(e event) {
+	if e.isDebug() && !output.debug {
+		return
+	}
+	select {
+	case output.queue <- e:
+	default:
+		atomic.AddUint64(&output.dropped, 1)
+	}
+}
+
+func (output *queuedSink) run() {
+	defer close(output.done)
+	for e := range output.queue {
+		if dropped := atomic.SwapUint64(&output.dropped, 0); dropped != 0 {
+			log.Printf("Output %v is too slow, dropped %v events", output.name, dropped)
+		}
+		if err := output.sink.write(e); err != nil {
+			log.Printf("Failed to write event to output %v: %v", output.name, err)
+		}
+	}
+	if err := output.sink.close(); err != nil {
+		log.Printf("Failed to close output %v: %v", output.name, err)
+	}
+}
+
+// 关闭队列并等待剩余事件输出完成
+func (output *queuedSink) close() {
+	close(output.queue)
+	<-output.done
+}
+
+// 把事件分发给所有输出
+type eventDispatcher struct {
+	outputs []*queuedSink
+}
+
+func (dispatcher *eventDispatcher) publish(e event) {
+	for _, output := range dispatcher.outputs {
+		output.publish(e)
+	}
+}
+
+func (dispatcher *eventDispatcher) close() {
+	for _, output := range dispatcher.outputs {
+		output.close()
+	}
+}
+
+// 当前使用的事件分发器 配置重新加载时整体替换
+var events = struct {
+	sync.RWMutex
+	dispatcher *eventDispatcher
+}{}
+
+func publishEvent(e event) {
+	events.RLock()
+	defer events.RUnlock()
+	if events.dispatcher == nil {
+		return
+	}
+	events.dispatcher.publish(e)
+}
+
+// 未配置outputs时根据logging.file/json/debug生成默认输出
+func defaultOutputs(cfg loggingConfig) []outputConfig {
+	output := outputConfig{Type: "stderr", Format: "text", Debug: cfg.Debug}
+	if cfg.File != "" {
+		output.Type = "file"
+		output.Path = cfg.File
+		output.Rotation = cfg.Rotation
+	}
+	if cfg.JSON {
+		output.Format = "json"
+	}
+	return []outputConfig{output}
+}
+
+// 根据配置创建所有事件输出 替换之前的输出
+// 事件输出是全局的 重新加载后已有连接的事件也会写到新的输出
+func setupEventSinks(cfg loggingConfig) error {
+	dispatcher, err := newEventDispatcher(cfg)
+	if err != nil {
+		return err
+	}
+	useEventDispatcher(dispatcher)
+	return nil
+}
+
+// 打开配置中的所有事件输出 之后由useEventDispatcher生效或者close关闭
+func newEventDispatcher(cfg loggingConfig) (*eventDispatcher, error) {
+	outputs := cfg.Outputs
+	if len(outputs) == 0 {
+		outputs = defaultOutputs(cfg)
+	}
+	dispatcher := &eventDispatcher{}
+	for i, output := range outputs {
+		sink, err := newEventSink(output, cfg.Timestamps)
+		if err != nil {
+			dispatcher.close()
+			return nil, fmt.Errorf("logging.outputs[%v]: %w", i, err)
+		}
+		name := fmt.Sprintf("%v (%v)", i, output.Type)
+		dispatcher.outputs = append(dispatcher.outputs, newQueuedSink(name, sink, output.Debug, cfg.QueueSize))
+	}
+	return dispatcher, nil
+}
+
+// 切换事件输出 关闭之前的输出
+func useEventDispatcher(dispatcher *eventDispatcher) {
+	events.Lock()
+	oldDispatcher := events.dispatcher
+	events.dispatcher = dispatcher
+	events.Unlock()
+	if oldDispatcher != nil {
+		oldDispatcher.close()
+	}
+}
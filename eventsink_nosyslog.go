@@ -0,0 +1,15 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "errors"
+
+func parseSyslogFacility(facility string) (int, error) {
+	return 0, nil
+}
+
+// 该平台没有syslog
+func newSyslogSink(output outputConfig) (eventSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
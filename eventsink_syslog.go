@@ -0,0 +1,70 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"":         syslog.LOG_DAEMON,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"user":     syslog.LOG_USER,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+func parseSyslogFacility(facility string) (syslog.Priority, error) {
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return 0, fmt.Errorf("unsupported syslog facility %q", facility)
+	}
+	return priority, nil
+}
+
+// 输出到syslog 时间戳由syslog添加
+type syslogSink struct {
+	writer *syslog.Writer
+	format string
+}
+
+func newSyslogSink(output outputConfig) (eventSink, error) {
+	facility, err := parseSyslogFacility(output.Facility)
+	if err != nil {
+		return nil, err
+	}
+	tag := output.Tag
+	if tag == "" {
+		tag = "gossh-honey"
+	}
+	writer, err := syslog.Dial(output.Network, output.Address, facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{writer, output.Format}, nil
+}
+
+func (sink syslogSink) write(e event) error {
+	logBytes, err := e.format(sink.format, false)
+	if err != nil {
+		return err
+	}
+	if e.isDebug() {
+		return sink.writer.Debug(string(logBytes))
+	}
+	return sink.writer.Info(string(logBytes))
+}
+
+func (sink syslogSink) close() error {
+	return sink.writer.Close()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 虚拟文件系统配置 对应yaml文件中的filesystem
+type filesystemConfig struct {
+	// 宿主机上的目录 其中的内容覆盖在内置的Linux目录结构之上
+	Template       string `yaml:"template"`
+	MaxFileSize    int64  `yaml:"max_file_size"`    // 单个文件的最大字节数
+	MaxSessionSize int64  `yaml:"max_session_size"` // 每个会话最多写入的字节数
+}
+
+// 没有配置大小限制时 SFTP和scp上传的文件在内存中缓存的上限
+const maxBufferedUpload = 256 * 1024 * 1024
+
+// 上传时单个文件在内存中缓存的上限 max_file_size为0时使用max_session_size
+func (cfg filesystemConfig) maxUploadSize() int64 {
+	switch {
+	case cfg.MaxFileSize > 0:
+		return cfg.MaxFileSize
+	case cfg.MaxSessionSize > 0:
+		return cfg.MaxSessionSize
+	default:
+		return maxBufferedUpload
+	}
+}
+
+// 内置模板中的目录
+var templateDirs = []string{
+	"/boot", "/dev", "/etc", "/etc/cron.d", "/etc/init.d", "/etc/ssh", "/etc/systemd", "/home", "/media", "/mnt", "/opt",
+	"/proc", "/root", "/root/.ssh", "/run", "/srv", "/sys", "/usr", "/usr/bin", "/usr/sbin", "/usr/lib", "/usr/lib64", "/usr/local",
+	"/usr/local/bin", "/usr/local/sbin", "/usr/share", "/var", "/var/backups", "/var/cache", "/var/lib", "/var/log",
+	"/var/mail", "/var/spool", "/var/spool/cron", "/var/www",
+}
+
+// 内置模板中的文件
+var templateFiles = map[string]string{
+	"/etc/passwd": `root:x:0:0:root:/root:/bin/bash
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+bin:x:2:2:bin:/bin:/usr/sbin/nologin
+sys:x:3:3:sys:/dev:/usr/sbin/nologin
+sync:x:4:65534:sync:/bin:/bin/sync
+games:x:5:60:games:/usr/games:/usr/sbin/nologin
+man:x:6:12:man:/var/cache/man:/usr/sbin/nologin
+lp:x:7:7:lp:/var/spool/lpd:/usr/sbin/nologin
+mail:x:8:8:mail:/var/mail:/usr/sbin/nologin
+news:x:9:9:news:/var/spool/news:/usr/sbin/nologin
+www-data:x:33:33:www-data:/var/www:/usr/sbin/nologin
+backup:x:34:34:backup:/var/backups:/usr/sbin/nologin
+nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin
+sshd:x:110:65534::/run/sshd:/usr/sbin/nologin
+`,
+	"/etc/group": `root:x:0:
+daemon:x:1:
+bin:x:2:
+sys:x:3:
+adm:x:4:syslog
+tty:x:5:
+disk:x:6:
+mail:x:8:
+shadow:x:42:
+sudo:x:27:
+www-data:x:33:
+users:x:100:
+nogroup:x:65534:
+`,
+	"/etc/shadow": `root:$6$Yr1kPz4q$7yM2cJ0b3vWbN6mA7gA1wq1S0m6n8v0T2j6xJmV0H2cQ6m2b1fM3hUuQbR4u9yZt1a0fJ1yW7k0v3pD8c9x5e.:19453:0:99999:7:::
+daemon:*:19453:0:99999:7:::
+bin:*:19453:0:99999:7:::
+sys:*:19453:0:99999:7:::
+www-data:*:19453:0:99999:7:::
+nobody:*:19453:0:99999:7:::
+sshd:*:19453:0:99999:7:::
+`,
+	"/etc/resolv.conf":           "nameserver 127.0.0.53\noptions edns0 trust-ad\nsearch .\n",
+	"/etc/shells":                "# /etc/shells: valid login shells\n/bin/sh\n/bin/bash\n/usr/bin/bash\n/bin/dash\n/usr/bin/dash\n",
+	"/etc/crontab":               "SHELL=/bin/sh\nPATH=/usr/local/sbin:/usr/local/bin:/sbin:/bin:/usr/sbin:/usr/bin\n\n17 *\t* * *\troot    cd / && run-parts --report /etc/cron.hourly\n",
+	"/etc/ssh/sshd_config":       "Include /etc/ssh/sshd_config.d/*.conf\nPermitRootLogin yes\nPasswordAuthentication yes\nKbdInteractiveAuthentication no\nUsePAM yes\nX11Forwarding yes\nPrintMotd no\nAcceptEnv LANG LC_*\nSubsystem\tsftp\t/usr/lib/openssh/sftp-server\n",
+	"/root/.bashrc":              "# ~/.bashrc: executed by bash(1) for non-login shells.\n\n[ -z \"$PS1\" ] && return\n\nHISTCONTROL=ignoredups:ignorespace\nshopt -s histappend\nHISTSIZE=1000\nHISTFILESIZE=2000\n",
+	"/root/.profile":             "# ~/.profile: executed by Bourne-compatible login shells.\n\nif [ \"$BASH\" ]; then\n  if [ -f ~/.bashrc ]; then\n    . ~/.bashrc\n  fi\nfi\n\nmesg n 2> /dev/null || true\n",
+	"/root/.ssh/authorized_keys": "",
+	"/var/log/auth.log":          "",
+	"/var/log/syslog":            "",
+}
+
+// 内置模板中的符号链接
+var templateSymlinks = map[string]string{
+	"/bin":   "usr/bin",
+	"/sbin":  "usr/sbin",
+	"/lib":   "usr/lib",
+	"/lib64": "usr/lib64",
+}
+
+// 伪造的可执行文件内容 不同文件使用其中不同长度的前缀
+var fakeBinary = func() []byte {
+	data := make([]byte, 160*1024)
+	copy(data, "\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x03\x00\x3e\x00\x01\x00\x00\x00")
+	for i := 64; i < len(data); i++ {
+		data[i] = byte(i*7919>>3) ^ byte(i>>9)
+	}
+	return data
+}()
+
+// 根据配置构建文件系统模板
+func (cfg *config) setupFilesystem() error {
+	fs := newVFS(cfg.Filesystem.MaxFileSize, cfg.Filesystem.MaxSessionSize)
+	// 模板中的时间固定为系统安装时间附近
+	installed := time.Now().Add(-127 * 24 * time.Hour).Truncate(time.Hour)
+	for _, dir := range templateDirs {
+		mode := os.FileMode(0755)
+		if dir == "/root" || dir == "/root/.ssh" {
+			mode = 0700
+		}
+		if err := fs.addNode(dir, &vfsNode{mode: os.ModeDir | mode, user: "root", group: "root", mtime: installed}); err != nil {
+			return err
+		}
+	}
+	if err := fs.addNode("/tmp", &vfsNode{mode: os.ModeDir | os.ModeSticky | 0777, user: "root", group: "root", mtime: time.Now()}); err != nil {
+		return err
+	}
+	if err := fs.addNode("/var/tmp", &vfsNode{mode: os.ModeDir | os.ModeSticky | 0777, user: "root", group: "root", mtime: installed}); err != nil {
+		return err
+	}
+	for link, target := range templateSymlinks {
+		if err := fs.addNode(link, &vfsNode{mode: os.ModeSymlink | 0777, user: "root", group: "root", mtime: installed, target: target}); err != nil {
+			return err
+		}
+	}
+	for file, content := range templateFiles {
+		mode := os.FileMode(0644)
+		group := "root"
+		if file == "/etc/shadow" {
+			mode = 0640
+			group = "shadow"
+		}
+		if strings.HasPrefix(file, "/root/.ssh/") {
+			mode = 0600
+		}
+		if err := fs.addNode(file, &vfsNode{mode: mode, user: "root", group: group, mtime: installed, data: []byte(content)}); err != nil {
+			return err
+		}
+	}
+	// 主机信息相关的文件由persona生成
+	for file, content := range cfg.Persona.files() {
+		if err := fs.addNode(file, &vfsNode{mode: 0644, user: "root", group: "root", mtime: installed, data: []byte(content)}); err != nil {
+			return err
+		}
+	}
+	for file, generate := range cfg.Persona.procFiles() {
+		if err := fs.addNode(file, &vfsNode{mode: 0444, user: "root", group: "root", mtime: cfg.Persona.bootTime(), generate: generate}); err != nil {
+			return err
+		}
+	}
+	if err := fs.addNode("/dev/null", &vfsNode{mode: os.ModeDevice | os.ModeCharDevice | 0666, user: "root", group: "root", mtime: installed}); err != nil {
+		return err
+	}
+	// 每个模拟的命令对应一个可执行文件
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		size := 24*1024 + (i*37%97)*1300
+		if err := fs.addNode(path.Join("/usr/bin", name), &vfsNode{mode: 0755, user: "root", group: "root", mtime: installed, data: fakeBinary[:size]}); err != nil {
+			return err
+		}
+	}
+	if cfg.Filesystem.Template != "" {
+		if err := importTemplate(fs, cfg.Filesystem.Template); err != nil {
+			return fmt.Errorf("filesystem.template: %w", err)
+		}
+	}
+	fs.freeze()
+	cfg.filesystem = fs
+	return nil
+}
+
+// 为新的会话创建文件系统 普通用户的主目录不存在时自动创建
+func newSessionFilesystem(cfg *config, user string) *vfs {
+	fs := cfg.filesystem.newSession(user)
+	if user != "root" && user != "" && !strings.Contains(user, "/") {
+		if err := fs.MkdirAll(path.Join("/home", user), 0755); err != nil {
+			log.Printf("Failed to create home directory for user %q: %v", user, err)
+		}
+	}
+	return fs
+}
+
+// 导入宿主机上的目录作为模板 文件的所有者都为root
+func importTemplate(fs *vfs, dir string) error {
+	return filepath.Walk(dir, func(hostPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, hostPath)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		vfsPath := "/" + filepath.ToSlash(rel)
+		node := &vfsNode{mode: info.Mode(), user: "root", group: "root", mtime: info.ModTime()}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(hostPath)
+			if err != nil {
+				return err
+			}
+			node.target = filepath.ToSlash(target)
+		case info.IsDir():
+		case info.Mode().IsRegular():
+			if fs.maxFile > 0 && info.Size() > fs.maxFile {
+				return fmt.Errorf("%v: file larger than filesystem.max_file_size", hostPath)
+			}
+			data, err := ioutil.ReadFile(hostPath)
+			if err != nil {
+				return err
+			}
+			node.data = data
+		default:
+			// 忽略设备文件等特殊文件
+			return nil
+		}
+		return fs.addNode(vfsPath, node)
+	})
+}
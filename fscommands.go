@@ -0,0 +1,1111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 终端的默认宽度 用于ls的多列输出
+const terminalWidth = 80
+
+// ls的一个输出项
+type lsEntry struct {
+	vfsFileInfo
+	path string // 文件在虚拟文件系统中的路径
+}
+
+type cmdLs struct{}
+
+func (cmdLs) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "laAdhtrSF1R", map[string]byte{
+		"all":            'a',
+		"almost-all":     'A',
+		"directory":      'd',
+		"human-readable": 'h',
+		"reverse":        'r',
+		"classify":       'F',
+		"recursive":      'R',
+	})
+	if err != nil {
+		return context.usageError(err, 2)
+	}
+	operands := opts.operands
+	if len(operands) == 0 {
+		operands = []string{"."}
+	}
+	fs := context.session.fs
+	var status uint32
+	var files []lsEntry
+	var dirs []string
+	for _, operand := range operands {
+		p := context.absPath(operand)
+		// 长格式和-d时不跟随命令行中的符号链接
+		stat := fs.Stat
+		if opts.flags['l'] || opts.flags['d'] || opts.flags['F'] {
+			stat = fs.Lstat
+		}
+		info, err := stat(p)
+		if err != nil {
+			status = 2
+			if err := context.errorf("cannot access '%v': %v", operand, err); err != nil {
+				return status, err
+			}
+			continue
+		}
+		info.name = operand
+		if info.IsDir() && !opts.flags['d'] {
+			dirs = append(dirs, operand)
+		} else {
+			files = append(files, lsEntry{info, p})
+		}
+	}
+	sortEntries(files, opts)
+	sort.Strings(dirs)
+	if err := context.printEntries(files, opts); err != nil {
+		return status, err
+	}
+	for i, dir := range dirs {
+		if len(files) > 0 || i > 0 {
+			if _, err := fmt.Fprintln(context.stdout); err != nil {
+				return status, err
+			}
+		}
+		header := len(operands) > 1 || opts.flags['R']
+		ok, err := context.listDir(dir, context.absPath(dir), opts, header)
+		if err != nil {
+			return status, err
+		}
+		if !ok {
+			status = 2
+		}
+	}
+	return status, nil
+}
+
+// 列出目录的内容 -R时递归列出子目录
+func (context commandContext) listDir(name string, p string, opts options, header bool) (bool, error) {
+	fs := context.session.fs
+	infos, err := fs.ReadDir(p)
+	if err != nil {
+		return false, context.errorf("cannot open directory '%v': %v", name, err)
+	}
+	var entries []lsEntry
+	if opts.flags['a'] {
+		for _, dot := range []string{".", ".."} {
+			info, err := fs.Stat(path.Join(p, dot))
+			if err != nil {
+				return false, context.errorf("cannot access '%v': %v", path.Join(name, dot), err)
+			}
+			info.name = dot
+			entries = append(entries, lsEntry{info, path.Join(p, dot)})
+		}
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.name, ".") && !opts.flags['a'] && !opts.flags['A'] {
+			continue
+		}
+		entries = append(entries, lsEntry{info, path.Join(p, info.name)})
+	}
+	sortEntries(entries, opts)
+	if header {
+		if _, err := fmt.Fprintf(context.stdout, "%v:\n", name); err != nil {
+			return false, err
+		}
+	}
+	if opts.flags['l'] {
+		var blocks int64
+		for _, entry := range entries {
+			blocks += diskBlocks(entry.vfsFileInfo)
+		}
+		total := strconv.FormatInt(blocks, 10)
+		if opts.flags['h'] {
+			total = humanSize(blocks * 1024)
+		}
+		if _, err := fmt.Fprintf(context.stdout, "total %v\n", total); err != nil {
+			return false, err
+		}
+	}
+	if err := context.printEntries(entries, opts); err != nil {
+		return false, err
+	}
+	ok := true
+	if opts.flags['R'] {
+		for _, entry := range entries {
+			if !entry.IsDir() || entry.name == "." || entry.name == ".." {
+				continue
+			}
+			if _, err := fmt.Fprintln(context.stdout); err != nil {
+				return false, err
+			}
+			subOK, err := context.listDir(path.Join(name, entry.name), entry.path, opts, true)
+			if err != nil {
+				return false, err
+			}
+			ok = ok && subOK
+		}
+	}
+	return ok, nil
+}
+
+func sortEntries(entries []lsEntry, opts options) {
+	less := func(a, b lsEntry) bool { return a.name < b.name }
+	switch {
+	case opts.flags['t']:
+		less = func(a, b lsEntry) bool {
+			if !a.mtime.Equal(b.mtime) {
+				return a.mtime.After(b.mtime)
+			}
+			return a.name < b.name
+		}
+	case opts.flags['S']:
+		less = func(a, b lsEntry) bool {
+			if a.size != b.size {
+				return a.size > b.size
+			}
+			return a.name < b.name
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if opts.flags['r'] {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+}
+
+// 输出ls的结果
+func (context commandContext) printEntries(entries []lsEntry, opts options) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if !opts.flags['l'] {
+		names := make([]string, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.name + classify(entry.vfsFileInfo, opts)
+		}
+		if context.isTerminal() && !opts.flags['1'] {
+			return printColumns(context.stdout, names, terminalWidth)
+		}
+		for _, name := range names {
+			if _, err := fmt.Fprintln(context.stdout, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// 长格式 各列按最宽的值对齐
+	var linkWidth, userWidth, groupWidth, sizeWidth int
+	sizes := make([]string, len(entries))
+	for i, entry := range entries {
+		sizes[i] = strconv.FormatInt(entry.size, 10)
+		if opts.flags['h'] {
+			sizes[i] = humanSize(entry.size)
+		}
+		linkWidth = maxInt(linkWidth, len(strconv.Itoa(entry.nlink)))
+		userWidth = maxInt(userWidth, len(entry.user))
+		groupWidth = maxInt(groupWidth, len(entry.group))
+		sizeWidth = maxInt(sizeWidth, len(sizes[i]))
+	}
+	for i, entry := range entries {
+		name := entry.name
+		if entry.mode&os.ModeSymlink != 0 {
+			if target, err := context.session.fs.Readlink(entry.path); err == nil {
+				name += " -> " + target
+			}
+		} else {
+			name += classify(entry.vfsFileInfo, opts)
+		}
+		_, err := fmt.Fprintf(context.stdout, "%v %*d %-*v %-*v %*v %v %v\n",
+			formatMode(entry.mode), linkWidth, entry.nlink, userWidth, entry.user, groupWidth, entry.group,
+			sizeWidth, sizes[i], formatTime(entry.mtime), name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按列输出 与GNU ls一样先填满一列再填下一列
+func printColumns(w io.Writer, names []string, width int) error {
+	for cols := len(names); cols >= 1; cols-- {
+		rows := (len(names) + cols - 1) / cols
+		widths := make([]int, cols)
+		for i, name := range names {
+			widths[i/rows] = maxInt(widths[i/rows], len(name)+2)
+		}
+		total := -2
+		for _, w := range widths {
+			total += w
+		}
+		if total >= width && cols > 1 {
+			continue
+		}
+		for row := 0; row < rows; row++ {
+			var line strings.Builder
+			for col := 0; col < cols; col++ {
+				i := col*rows + row
+				if i >= len(names) {
+					break
+				}
+				line.WriteString(names[i])
+				if i+rows < len(names) {
+					line.WriteString(strings.Repeat(" ", widths[col]-len(names[i])))
+				}
+			}
+			if _, err := fmt.Fprintln(w, line.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// -F时文件名后的类型标记
+func classify(info vfsFileInfo, opts options) string {
+	if !opts.flags['F'] {
+		return ""
+	}
+	switch {
+	case info.IsDir():
+		return "/"
+	case info.mode&os.ModeSymlink != 0:
+		return "@"
+	case info.mode.IsRegular() && info.mode&0111 != 0:
+		return "*"
+	}
+	return ""
+}
+
+// 按ls -l的格式输出文件类型和权限 例如drwxr-xr-x
+func formatMode(mode os.FileMode) string {
+	b := []byte("----------")
+	switch {
+	case mode.IsDir():
+		b[0] = 'd'
+	case mode&os.ModeSymlink != 0:
+		b[0] = 'l'
+	case mode&os.ModeCharDevice != 0:
+		b[0] = 'c'
+	case mode&os.ModeDevice != 0:
+		b[0] = 'b'
+	case mode&os.ModeNamedPipe != 0:
+		b[0] = 'p'
+	case mode&os.ModeSocket != 0:
+		b[0] = 's'
+	}
+	const rwx = "rwxrwxrwx"
+	for i := 0; i < 9; i++ {
+		if mode&(1<<uint(8-i)) != 0 {
+			b[i+1] = rwx[i]
+		}
+	}
+	special := func(i int, set bool, lower byte) {
+		if !set {
+			return
+		}
+		if b[i] == '-' {
+			b[i] = lower - 'a' + 'A'
+		} else {
+			b[i] = lower
+		}
+	}
+	special(3, mode&os.ModeSetuid != 0, 's')
+	special(6, mode&os.ModeSetgid != 0, 's')
+	special(9, mode&os.ModeSticky != 0, 't')
+	return string(b)
+}
+
+// 半年内的时间显示时分 更早的显示年份
+func formatTime(t time.Time) string {
+	if time.Since(t) > 182*24*time.Hour || time.Until(t) > time.Hour {
+		return t.Format("Jan _2  2006")
+	}
+	return t.Format("Jan _2 15:04")
+}
+
+// 按ls -h的格式输出大小 例如4.0K 24K 1.2M
+func humanSize(size int64) string {
+	if size < 1024 {
+		return strconv.FormatInt(size, 10)
+	}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < 6 {
+		value /= 1024
+		unit++
+	}
+	suffix := "KMGTPE"[unit-1 : unit]
+	if value < 10 {
+		return fmt.Sprintf("%.1f%v", float64(int64(value*10+0.999))/10, suffix)
+	}
+	return fmt.Sprintf("%v%v", int64(value+0.999), suffix)
+}
+
+// 文件占用的1K块数 按4K的文件系统块计算
+func diskBlocks(info vfsFileInfo) int64 {
+	if info.mode&os.ModeSymlink != 0 || info.mode&os.ModeDevice != 0 {
+		return 0
+	}
+	return (info.size + 4095) / 4096 * 4
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// cd是shell的内部命令 修改当前会话的工作目录
+type cmdCd struct{}
+
+func (cmdCd) execute(context commandContext) (uint32, error) {
+	args := context.args[1:]
+	for len(args) > 0 && (args[0] == "-L" || args[0] == "-P" || args[0] == "--") {
+		args = args[1:]
+	}
+	session := context.session
+	var dir string
+	switch {
+	case len(args) > 1:
+		_, err := fmt.Fprintln(context.stderr, "sh: cd: too many arguments")
+		return 1, err
+	case len(args) == 0:
+		dir = session.vars["HOME"]
+		if dir == "" {
+			_, err := fmt.Fprintln(context.stderr, "sh: cd: HOME not set")
+			return 1, err
+		}
+	case args[0] == "-":
+		dir = session.vars["OLDPWD"]
+		if dir == "" {
+			_, err := fmt.Fprintln(context.stderr, "sh: cd: OLDPWD not set")
+			return 1, err
+		}
+	default:
+		dir = args[0]
+	}
+	p := context.absPath(dir)
+	info, err := session.fs.Stat(p)
+	if err == nil && !info.IsDir() {
+		err = errNotDir
+	}
+	if err != nil {
+		_, err := fmt.Fprintf(context.stderr, "sh: cd: %v: %v\n", dir, err)
+		return 1, err
+	}
+	session.vars["OLDPWD"] = session.cwd
+	session.vars["PWD"] = p
+	session.cwd = p
+	if len(args) == 1 && args[0] == "-" {
+		_, err := fmt.Fprintln(context.stdout, p)
+		return 0, err
+	}
+	return 0, nil
+}
+
+type cmdPwd struct{}
+
+func (cmdPwd) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "LP", nil)
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	cwd := context.session.cwd
+	if opts.flags['P'] {
+		if resolved, err := context.session.fs.Realpath(cwd); err == nil {
+			cwd = resolved
+		}
+	}
+	_, err = fmt.Fprintln(context.stdout, cwd)
+	return 0, err
+}
+
+type cmdMkdir struct{}
+
+func (cmdMkdir) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "pvm:", map[string]byte{"parents": 'p', "verbose": 'v', "mode": 'm'})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	if len(opts.operands) == 0 {
+		return context.usageError(errors.New("missing operand"), 1)
+	}
+	mode := os.FileMode(0755)
+	if spec, ok := opts.values['m']; ok {
+		parsed, ok := parseFileMode(spec, 0777, true)
+		if !ok {
+			return context.usageError(fmt.Errorf("invalid mode '%v'", spec), 1)
+		}
+		mode = parsed
+	}
+	fs := context.session.fs
+	var status uint32
+	for _, operand := range opts.operands {
+		p := context.absPath(operand)
+		var err error
+		if opts.flags['p'] {
+			if info, statErr := fs.Stat(p); statErr == nil && !info.IsDir() {
+				err = errFileExists
+			} else {
+				err = fs.MkdirAll(p, 0755)
+			}
+		} else {
+			err = fs.Mkdir(p, mode.Perm())
+		}
+		if err == nil && opts.values['m'] != "" {
+			err = fs.Chmod(p, mode)
+		}
+		if err != nil {
+			status = 1
+			if err := context.errorf("cannot create directory '%v': %v", operand, err); err != nil {
+				return status, err
+			}
+			continue
+		}
+		if opts.flags['v'] {
+			if _, err := fmt.Fprintf(context.stdout, "%v: created directory '%v'\n", context.args[0], operand); err != nil {
+				return status, err
+			}
+		}
+	}
+	return status, nil
+}
+
+type cmdRm struct{}
+
+func (cmdRm) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "rRfivdI", map[string]byte{
+		"recursive":        'r',
+		"force":            'f',
+		"interactive":      'i',
+		"verbose":          'v',
+		"dir":              'd',
+		"no-preserve-root": 'P',
+		"preserve-root":    'p',
+	})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	recursive := opts.flags['r'] || opts.flags['R']
+	force := opts.flags['f']
+	if len(opts.operands) == 0 {
+		if force {
+			return 0, nil
+		}
+		return context.usageError(errors.New("missing operand"), 1)
+	}
+	fs := context.session.fs
+	var status uint32
+	for _, operand := range opts.operands {
+		if base := path.Base(operand); base == "." || base == ".." {
+			status = 1
+			if err := context.errorf("refusing to remove '.' or '..' directory: skipping '%v'", operand); err != nil {
+				return status, err
+			}
+			continue
+		}
+		p := context.absPath(operand)
+		info, err := fs.Lstat(p)
+		if err != nil {
+			if force && err == errNoSuchFile {
+				continue
+			}
+			status = 1
+			if err := context.errorf("cannot remove '%v': %v", operand, err); err != nil {
+				return status, err
+			}
+			continue
+		}
+		if resolved, _ := fs.Realpath(p); resolved == "/" && recursive && !opts.flags['P'] {
+			status = 1
+			if err := context.errorf("it is dangerous to operate recursively on '/'"); err != nil {
+				return status, err
+			}
+			if err := context.errorf("use --no-preserve-root to override this failsafe"); err != nil {
+				return status, err
+			}
+			continue
+		}
+		switch {
+		case info.IsDir() && recursive:
+			err = fs.RemoveAll(p)
+		case info.IsDir() && !opts.flags['d']:
+			err = errIsDir
+		default:
+			err = fs.Remove(p)
+		}
+		if err != nil {
+			status = 1
+			if err := context.errorf("cannot remove '%v': %v", operand, err); err != nil {
+				return status, err
+			}
+			continue
+		}
+		if opts.flags['v'] {
+			format := "removed '%v'\n"
+			if info.IsDir() {
+				format = "removed directory '%v'\n"
+			}
+			if _, err := fmt.Fprintf(context.stdout, format, operand); err != nil {
+				return status, err
+			}
+		}
+	}
+	return status, nil
+}
+
+// 解析cp和mv的操作数 返回源文件 目标路径和目标是否为目录 操作数错误时返回false
+func (context commandContext) copyTargets(opts options) ([]string, string, bool, bool, error) {
+	operands := opts.operands
+	target, hasTarget := opts.values['t']
+	if !hasTarget {
+		if len(operands) == 0 {
+			_, err := context.usageError(errors.New("missing file operand"), 1)
+			return nil, "", false, false, err
+		}
+		if len(operands) == 1 {
+			_, err := context.usageError(fmt.Errorf("missing destination file operand after '%v'", operands[0]), 1)
+			return nil, "", false, false, err
+		}
+		target = operands[len(operands)-1]
+		operands = operands[:len(operands)-1]
+	}
+	info, err := context.session.fs.Stat(context.absPath(target))
+	targetIsDir := err == nil && info.IsDir()
+	if !targetIsDir && (hasTarget || len(operands) > 1) {
+		return nil, "", false, false, context.errorf("target '%v' is not a directory", target)
+	}
+	return operands, target, targetIsDir, true, nil
+}
+
+type cmdCp struct{}
+
+func (cmdCp) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "rRapfinvt:", map[string]byte{
+		"recursive":        'r',
+		"archive":          'a',
+		"force":            'f',
+		"interactive":      'i',
+		"no-clobber":       'n',
+		"verbose":          'v',
+		"target-directory": 't',
+	})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	sources, target, targetIsDir, ok, err := context.copyTargets(opts)
+	if err != nil || !ok {
+		return 1, err
+	}
+	copier := fileCopier{
+		context:   context,
+		recursive: opts.flags['r'] || opts.flags['R'] || opts.flags['a'],
+		preserve:  opts.flags['p'] || opts.flags['a'],
+		noClobber: opts.flags['n'],
+		verbose:   opts.flags['v'],
+	}
+	var status uint32
+	for _, source := range sources {
+		dst := target
+		if targetIsDir {
+			dst = path.Join(target, path.Base(source))
+		}
+		ok, err := copier.copy(source, dst)
+		if err != nil {
+			return 1, err
+		}
+		if !ok {
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+// 复制文件和目录 srcName和dstName是用于输出的路径
+type fileCopier struct {
+	context   commandContext
+	recursive bool
+	preserve  bool
+	noClobber bool
+	verbose   bool
+}
+
+func (copier fileCopier) copy(srcName string, dstName string) (bool, error) {
+	context := copier.context
+	fs := context.session.fs
+	src, dst := context.absPath(srcName), context.absPath(dstName)
+	info, err := fs.Stat(src)
+	if err != nil {
+		return false, context.errorf("cannot stat '%v': %v", srcName, err)
+	}
+	dstInfo, dstErr := fs.Stat(dst)
+	if dstErr == nil && copier.noClobber {
+		return true, nil
+	}
+	if info.IsDir() {
+		if !copier.recursive {
+			return false, context.errorf("-r not specified; omitting directory '%v'", srcName)
+		}
+		srcReal, _ := fs.Realpath(src)
+		dstReal := dst
+		if parent, err := fs.Realpath(path.Dir(dst)); err == nil {
+			dstReal = path.Join(parent, path.Base(dst))
+		}
+		if strings.HasPrefix(dstReal+"/", srcReal+"/") {
+			return false, context.errorf("cannot copy a directory, '%v', into itself, '%v'", srcName, dstName)
+		}
+		if dstErr == nil && !dstInfo.IsDir() {
+			return false, context.errorf("cannot overwrite non-directory '%v' with directory '%v'", dstName, srcName)
+		}
+		if dstErr != nil {
+			if err := fs.Mkdir(dst, info.mode.Perm()); err != nil {
+				return false, context.errorf("cannot create directory '%v': %v", dstName, err)
+			}
+		}
+		if err := copier.report(srcName, dstName); err != nil {
+			return false, err
+		}
+		children, err := fs.ReadDir(src)
+		if err != nil {
+			return false, context.errorf("cannot access '%v': %v", srcName, err)
+		}
+		ok := true
+		for _, child := range children {
+			childSrc, childDst := path.Join(srcName, child.name), path.Join(dstName, child.name)
+			if child.mode&os.ModeSymlink != 0 {
+				// 递归复制时符号链接本身被复制
+				target, err := fs.Readlink(path.Join(src, child.name))
+				if err == nil {
+					err = fs.Symlink(target, path.Join(dst, child.name))
+				}
+				if err != nil {
+					ok = false
+					if err := context.errorf("cannot create symbolic link '%v': %v", childDst, err); err != nil {
+						return false, err
+					}
+				}
+				continue
+			}
+			childOK, err := copier.copy(childSrc, childDst)
+			if err != nil {
+				return false, err
+			}
+			ok = ok && childOK
+		}
+		copier.preserveAttributes(dst, info)
+		return ok, nil
+	}
+	if dstErr == nil {
+		srcReal, _ := fs.Realpath(src)
+		if dstReal, _ := fs.Realpath(dst); srcReal == dstReal {
+			return false, context.errorf("'%v' and '%v' are the same file", srcName, dstName)
+		}
+	}
+	if err := fs.CopyFile(src, dst); err != nil {
+		if err == errIsDir {
+			return false, context.errorf("cannot overwrite directory '%v' with non-directory", dstName)
+		}
+		return false, context.errorf("cannot create regular file '%v': %v", dstName, err)
+	}
+	if err := copier.report(srcName, dstName); err != nil {
+		return false, err
+	}
+	copier.preserveAttributes(dst, info)
+	return true, nil
+}
+
+func (copier fileCopier) report(srcName string, dstName string) error {
+	if !copier.verbose {
+		return nil
+	}
+	_, err := fmt.Fprintf(copier.context.stdout, "'%v' -> '%v'\n", srcName, dstName)
+	return err
+}
+
+// -p时保留权限 所有者和修改时间
+func (copier fileCopier) preserveAttributes(dst string, info vfsFileInfo) {
+	if !copier.preserve {
+		return
+	}
+	fs := copier.context.session.fs
+	if fs.Chmod(dst, info.mode) == nil && fs.Chown(dst, info.user, info.group) == nil {
+		fs.Chtimes(dst, info.mtime)
+	}
+}
+
+type cmdMv struct{}
+
+func (cmdMv) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "finvt:", map[string]byte{
+		"force":            'f',
+		"interactive":      'i',
+		"no-clobber":       'n',
+		"verbose":          'v',
+		"target-directory": 't',
+	})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	sources, target, targetIsDir, ok, err := context.copyTargets(opts)
+	if err != nil || !ok {
+		return 1, err
+	}
+	fs := context.session.fs
+	var status uint32
+	for _, source := range sources {
+		dstName := target
+		if targetIsDir {
+			dstName = path.Join(target, path.Base(source))
+		}
+		src, dst := context.absPath(source), context.absPath(dstName)
+		info, err := fs.Lstat(src)
+		if err != nil {
+			status = 1
+			if err := context.errorf("cannot stat '%v': %v", source, err); err != nil {
+				return status, err
+			}
+			continue
+		}
+		if _, err := fs.Lstat(dst); err == nil && opts.flags['n'] {
+			continue
+		}
+		if err := fs.Rename(src, dst); err != nil {
+			status = 1
+			switch {
+			case err == errInvalidPath && info.IsDir():
+				err = context.errorf("cannot move '%v' to a subdirectory of itself, '%v'", source, dstName)
+			case err == errIsDir:
+				err = context.errorf("cannot overwrite directory '%v' with non-directory", dstName)
+			case err == errNotDir:
+				err = context.errorf("cannot overwrite non-directory '%v' with directory '%v'", dstName, source)
+			default:
+				err = context.errorf("cannot move '%v' to '%v': %v", source, dstName, err)
+			}
+			if err != nil {
+				return status, err
+			}
+			continue
+		}
+		if opts.flags['v'] {
+			if _, err := fmt.Fprintf(context.stdout, "renamed '%v' -> '%v'\n", source, dstName); err != nil {
+				return status, err
+			}
+		}
+	}
+	return status, nil
+}
+
+type cmdTouch struct{}
+
+func (cmdTouch) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "acfmd:t:r:", map[string]byte{
+		"no-create": 'c',
+		"date":      'd',
+		"reference": 'r',
+	})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	if len(opts.operands) == 0 {
+		return context.usageError(errors.New("missing file operand"), 1)
+	}
+	fs := context.session.fs
+	mtime := time.Now()
+	if ref, ok := opts.values['r']; ok {
+		info, err := fs.Stat(context.absPath(ref))
+		if err != nil {
+			return 1, context.errorf("failed to get attributes of '%v': %v", ref, err)
+		}
+		mtime = info.mtime
+	}
+	if date, ok := opts.values['d']; ok {
+		if mtime, ok = parseDate(date); !ok {
+			return 1, context.errorf("invalid date format '%v'", date)
+		}
+	}
+	if stamp, ok := opts.values['t']; ok {
+		if mtime, ok = parseTouchStamp(stamp); !ok {
+			return 1, context.errorf("invalid date format '%v'", stamp)
+		}
+	}
+	var status uint32
+	for _, operand := range opts.operands {
+		p := context.absPath(operand)
+		_, err := fs.Stat(p)
+		if err == errNoSuchFile {
+			if opts.flags['c'] {
+				continue
+			}
+			err = fs.WriteFile(p, nil, 0644, true)
+		}
+		if err == nil {
+			err = fs.Chtimes(p, mtime)
+		}
+		if err != nil {
+			status = 1
+			if err := context.errorf("cannot touch '%v': %v", operand, err); err != nil {
+				return status, err
+			}
+		}
+	}
+	return status, nil
+}
+
+// 解析touch -d的时间 只支持常见的格式
+func parseDate(date string) (time.Time, bool) {
+	if strings.HasPrefix(date, "@") {
+		seconds, err := strconv.ParseInt(date[1:], 10, 64)
+		return time.Unix(seconds, 0), err == nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02", time.UnixDate, time.RFC1123} {
+		if t, err := time.ParseInLocation(layout, date, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// 解析touch -t的时间 格式为[[CC]YY]MMDDhhmm[.ss]
+func parseTouchStamp(stamp string) (time.Time, bool) {
+	seconds := "00"
+	if i := strings.IndexByte(stamp, '.'); i >= 0 {
+		stamp, seconds = stamp[:i], stamp[i+1:]
+	}
+	layouts := map[int]string{8: "0102150405", 10: "0601021504", 12: "200601021504"}
+	layout, ok := layouts[len(stamp)]
+	if !ok || len(seconds) != 2 {
+		return time.Time{}, false
+	}
+	if len(stamp) == 8 {
+		// 没有年份时使用当前年份
+		stamp = stamp + seconds
+	} else {
+		stamp, layout = stamp+seconds, layout+"05"
+	}
+	t, err := time.ParseInLocation(layout, stamp, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if t.Year() == 0 {
+		t = t.AddDate(time.Now().Year(), 0, 0)
+	}
+	return t, true
+}
+
+type cmdChmod struct{}
+
+// chmod中可以作为模式的参数的字符 例如-x和-w
+const chmodModeChars = "rwxXstugoa,+-=01234567"
+
+func (cmdChmod) execute(context commandContext) (uint32, error) {
+	var flags []string
+	var operands []string
+	args := context.args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			operands = append(operands, args[i+1:]...)
+			i = len(args)
+		case len(arg) > 1 && arg[0] == '-' && strings.Trim(arg[1:], chmodModeChars) == "" && len(operands) == 0:
+			// -x这样的参数是模式而不是选项
+			operands = append(operands, arg)
+		case len(arg) > 1 && arg[0] == '-':
+			flags = append(flags, arg)
+		default:
+			operands = append(operands, arg)
+		}
+	}
+	opts, err := parseOptions(flags, "Rcfv", map[string]byte{
+		"recursive": 'R',
+		"changes":   'c',
+		"silent":    'f',
+		"quiet":     'f',
+		"verbose":   'v',
+	})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	if len(operands) == 0 {
+		return context.usageError(errors.New("missing operand"), 1)
+	}
+	spec := operands[0]
+	if len(operands) == 1 {
+		return context.usageError(fmt.Errorf("missing operand after '%v'", spec), 1)
+	}
+	if _, ok := parseFileMode(spec, 0, false); !ok {
+		return context.usageError(fmt.Errorf("invalid mode: '%v'", spec), 1)
+	}
+	var status uint32
+	for _, operand := range operands[1:] {
+		ok, err := context.chmod(operand, spec, opts)
+		if err != nil {
+			return 1, err
+		}
+		if !ok {
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+func (context commandContext) chmod(name string, spec string, opts options) (bool, error) {
+	fs := context.session.fs
+	p := context.absPath(name)
+	info, err := fs.Stat(p)
+	if err != nil {
+		if opts.flags['f'] {
+			return false, nil
+		}
+		return false, context.errorf("cannot access '%v': %v", name, err)
+	}
+	mode, _ := parseFileMode(spec, info.mode, info.IsDir())
+	if err := fs.Chmod(p, mode); err != nil {
+		return false, context.errorf("changing permissions of '%v': %v", name, err)
+	}
+	changed := unixMode(mode) != unixMode(info.mode)
+	if opts.flags['v'] || (opts.flags['c'] && changed) {
+		format := "mode of '%v' retained as %04o (%v)\n"
+		if changed {
+			format = "mode of '%v' changed from %04o (%v) to %04o (%v)\n"
+		}
+		args := []interface{}{name, unixMode(info.mode), formatMode(info.mode)[1:]}
+		if changed {
+			args = append(args, unixMode(mode), formatMode(mode)[1:])
+		}
+		if _, err := fmt.Fprintf(context.stdout, format, args...); err != nil {
+			return false, err
+		}
+	}
+	ok := true
+	if opts.flags['R'] && info.IsDir() {
+		children, err := fs.ReadDir(p)
+		if err != nil {
+			return false, context.errorf("cannot read directory '%v': %v", name, err)
+		}
+		for _, child := range children {
+			if child.mode&os.ModeSymlink != 0 {
+				continue
+			}
+			childOK, err := context.chmod(path.Join(name, child.name), spec, opts)
+			if err != nil {
+				return false, err
+			}
+			ok = ok && childOK
+		}
+	}
+	return ok, nil
+}
+
+// 转换为Unix的权限位 例如04755
+func unixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+func fileModeFromUnix(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// 解析chmod的模式 支持八进制(755)和符号形式(u+x,go-w,a=r)
+func parseFileMode(spec string, mode os.FileMode, isDir bool) (os.FileMode, bool) {
+	if spec == "" {
+		return mode, false
+	}
+	if strings.Trim(spec, "01234567") == "" {
+		if len(spec) > 4 {
+			return mode, false
+		}
+		bits, _ := strconv.ParseUint(spec, 8, 32)
+		return mode&os.ModeType | fileModeFromUnix(uint32(bits)), true
+	}
+	bits := unixMode(mode)
+	for _, clause := range strings.Split(spec, ",") {
+		var who uint32
+		i := 0
+		for ; i < len(clause) && strings.IndexByte("ugoa", clause[i]) >= 0; i++ {
+			switch clause[i] {
+			case 'u':
+				who |= 04700
+			case 'g':
+				who |= 02070
+			case 'o':
+				who |= 01007
+			case 'a':
+				who |= 07777
+			}
+		}
+		if who == 0 {
+			who = 07777
+		}
+		if i == len(clause) {
+			return mode, false
+		}
+		for i < len(clause) {
+			op := clause[i]
+			if strings.IndexByte("+-=", op) < 0 {
+				return mode, false
+			}
+			i++
+			var perm uint32
+			for ; i < len(clause) && strings.IndexByte("+-=", clause[i]) < 0; i++ {
+				switch clause[i] {
+				case 'r':
+					perm |= 0444
+				case 'w':
+					perm |= 0222
+				case 'x':
+					perm |= 0111
+				case 'X':
+					if isDir || bits&0111 != 0 {
+						perm |= 0111
+					}
+				case 's':
+					perm |= 06000
+				case 't':
+					perm |= 01000
+				default:
+					return mode, false
+				}
+			}
+			perm &= who
+			switch op {
+			case '+':
+				bits |= perm
+			case '-':
+				bits &^= perm
+			case '=':
+				bits = bits&^(who&0777) | perm
+			}
+		}
+	}
+	return mode&os.ModeType | fileModeFromUnix(bits), true
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxHandshakeSniffSize = 64 * 1024 // 最多缓存的未解析数据 超过时停止解析
+	maxFirstBytes         = 256       // 握手失败时记录的客户端最初发送的字节数
+)
+
+const (
+	msgKexInit = 20
+	msgNewKeys = 21
+)
+
+// 握手失败的阶段
+const (
+	stageProxyProtocol   = "proxy_protocol"
+	stageVersionExchange = "version_exchange"
+	stageKex             = "kex"
+	stageAuth            = "auth"
+)
+
+// 被动解析客户端在密钥交换完成前发送的明文数据 不修改数据
+// x/crypto/ssh在单独的goroutine中读取 所以需要加锁
+type handshakeSniffer struct {
+	net.Conn
+	mutex         sync.Mutex
+	start         time.Time
+	firstBytes    []byte
+	buffer        []byte // 尚未解析的数据
+	clientVersion string
+	versionSeen   bool
+	newKeys       bool // 客户端已经发送NEWKEYS 之后的数据是加密的
+	done          bool
+	kexInit       *kexInitMsg
+}
+
+func newHandshakeSniffer(conn net.Conn) *handshakeSniffer {
+	return &handshakeSniffer{Conn: conn, start: time.Now()}
+}
+
+func (conn *handshakeSniffer) Read(data []byte) (int, error) {
+	n, err := conn.Conn.Read(data)
+	if n > 0 {
+		conn.mutex.Lock()
+		if len(conn.firstBytes) < maxFirstBytes {
+			end := n
+			if end > maxFirstBytes-len(conn.firstBytes) {
+				end = maxFirstBytes - len(conn.firstBytes)
+			}
+			conn.firstBytes = append(conn.firstBytes, data[:end]...)
+		}
+		if !conn.done {
+			conn.buffer = append(conn.buffer, data[:n]...)
+			conn.parse()
+		}
+		conn.mutex.Unlock()
+	}
+	return n, err
+}
+
+func (conn *handshakeSniffer) parse() {
+	for !conn.done {
+		if len(conn.buffer) > maxHandshakeSniffSize {
+			conn.stop()
+			return
+		}
+		// 版本行之前可能有其他行
+		if !conn.versionSeen {
+			end := bytes.IndexByte(conn.buffer, '\n')
+			if end < 0 {
+				return
+			}
+			if bytes.HasPrefix(conn.buffer, []byte("SSH-")) {
+				conn.clientVersion = strings.TrimRight(string(conn.buffer[:end]), "\r")
+				conn.versionSeen = true
+			}
+			conn.buffer = conn.buffer[end+1:]
+			continue
+		}
+		// 未加密的二进制包 uint32长度 byte填充长度 载荷 填充
+		if len(conn.buffer) < 5 {
+			return
+		}
+		length := binary.BigEndian.Uint32(conn.buffer)
+		if length < 5 || length > maxHandshakeSniffSize {
+			conn.stop()
+			return
+		}
+		if uint32(len(conn.buffer)) < 4+length {
+			return
+		}
+		padding := uint32(conn.buffer[4])
+		if padding+1 < length {
+			payload := conn.buffer[5 : 4+length-padding]
+			switch payload[0] {
+			case msgKexInit:
+				msg := &kexInitMsg{}
+				if conn.kexInit == nil && ssh.Unmarshal(payload, msg) == nil {
+					conn.kexInit = msg
+				}
+			case msgNewKeys:
+				conn.newKeys = true
+				conn.stop()
+				return
+			}
+		}
+		conn.buffer = conn.buffer[4+length:]
+	}
+}
+
+func (conn *handshakeSniffer) stop() {
+	conn.done = true
+	conn.buffer = nil
+}
+
+// 解析出的KEXINIT 没有收到或者无法解析时返回nil
+func (conn *handshakeSniffer) clientKexInit() *kexInitMsg {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.kexInit
+}
+
+// 握手失败的日志 authAttempts为已经记录的认证尝试次数
+func (conn *handshakeSniffer) failureLog(authAttempts int, err error) handshakeFailureLog {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	stage := stageVersionExchange
+	switch {
+	case conn.newKeys || authAttempts > 0:
+		stage = stageAuth
+	case conn.versionSeen:
+		stage = stageKex
+	}
+	return handshakeFailureLog{
+		LocalAddress:  conn.LocalAddr().String(),
+		Stage:         stage,
+		ClientVersion: conn.clientVersion,
+		FirstBytes:    conn.firstBytes,
+		Duration:      time.Since(conn.start).Seconds(),
+		Error:         errorString(err),
+	}
+}
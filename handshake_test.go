@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// 二进制的前几个字节原样记录 JSON中为base64
+func TestHandshakeFailureKeepsBinaryFirstBytes(t *testing.T) {
+	tlsHello := []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01, 0xfc, 0x03, 0x03, 0xff, 0xfe, 0x80}
+	proxyV2 := append(append([]byte(nil), proxyV2Signature...), 0x31, 0x11, 0x00, 0x0c, 0xc0, 0xff)
+	tests := []struct {
+		name   string
+		config string
+		data   []byte
+		stage  string
+	}{
+		{"tls", "", tlsHello, "version_exchange"},
+		{"proxy v2", "server:\n  proxy_protocol: required\n", proxyV2, stageProxyProtocol},
+	}
+	for _, test := range tests {
+		cfg := newTestConfig(t, "recording:\n  enabled: false\n"+test.config)
+		stop := captureEvents(t)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				return
+			}
+			client.Write(test.data)
+			client.(*net.TCPConn).CloseWrite()
+			ioutil.ReadAll(client)
+			client.Close()
+		}()
+		server, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		handleListenerConnection(server, cfg)
+		var failure *handshakeFailureLog
+		for _, entry := range stop() {
+			if entry, ok := entry.(handshakeFailureLog); ok {
+				failure = &entry
+			}
+		}
+		if failure == nil {
+			t.Errorf("%v: no handshake failure logged", test.name)
+			continue
+		}
+		if failure.Stage != test.stage || !bytes.Equal(failure.FirstBytes, test.data) {
+			t.Errorf("%v: stage %v first bytes %q, want %v %q", test.name, failure.Stage, failure.FirstBytes, test.stage, test.data)
+		}
+		encoded, err := json.Marshal(failure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded handshakeFailureLog
+		if err := json.Unmarshal(encoded, &decoded); err != nil || !bytes.Equal(decoded.FirstBytes, test.data) {
+			t.Errorf("%v: JSON round trip gave %q, %v", test.name, decoded.FirstBytes, err)
+		}
+	}
+}
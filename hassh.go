@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+)
+
+// SSH_MSG_KEXINIT 与x/crypto/ssh中的定义相同
+type kexInitMsg struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// HASSH指纹 由客户端的kex 加密 MAC和压缩算法组成
+func (msg kexInitMsg) hassh() (string, string) {
+	algorithms := strings.Join([]string{
+		strings.Join(msg.KexAlgos, ","),
+		strings.Join(msg.CiphersClientServer, ","),
+		strings.Join(msg.MACsClientServer, ","),
+		strings.Join(msg.CompressionClientServer, ","),
+	}, ";")
+	sum := md5.Sum([]byte(algorithms))
+	return hex.EncodeToString(sum[:]), algorithms
+}
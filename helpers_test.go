@@ -0,0 +1,127 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+)
+
+// 所有测试共享的数据目录 主机密钥只生成一次
+var testDataDir string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "gossh-honey-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	testDataDir = dir
+	log.SetOutput(ioutil.Discard)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// 解析测试用的配置文件
+func newTestConfig(t *testing.T, configString string) *config {
+	t.Helper()
+	cfg, err := getConfig(configString, testDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// 记录事件的输出
+type captureSink struct {
+	mutex  sync.Mutex
+	events []event
+}
+
+func (sink *captureSink) write(e event) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.events = append(sink.events, e)
+	return nil
+}
+
+func (sink *captureSink) close() error { return nil }
+
+// 替换事件输出 返回的函数恢复原来的输出并返回记录的事件
+func captureEvents(t *testing.T) func() []logEntry {
+	t.Helper()
+	sink := &captureSink{}
+	dispatcher := &eventDispatcher{outputs: []*queuedSink{newQueuedSink("test", sink, true, 1024)}}
+	events.Lock()
+	oldDispatcher := events.dispatcher
+	events.dispatcher = dispatcher
+	events.Unlock()
+	return func() []logEntry {
+		events.Lock()
+		events.dispatcher = oldDispatcher
+		events.Unlock()
+		dispatcher.close()
+		var entries []logEntry
+		for _, e := range sink.events {
+			entries = append(entries, e.entry)
+		}
+		return entries
+	}
+}
+
+// 在本地端口上处理一个ssh连接 返回已经认证的客户端和等待服务端处理完成的函数
+func dialTestServer(t *testing.T, cfg *config, clientConfig *ssh.ClientConfig) (*ssh.Client, func()) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		handleConnection(conn, cfg)
+	}()
+	if clientConfig.HostKeyCallback == nil {
+		clientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	client, err := ssh.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		<-done
+	}
+}
+
+// 测试用的ssh连接信息
+type testConnMetadata struct {
+	user string
+}
+
+func (meta testConnMetadata) User() string     { return meta.user }
+func (testConnMetadata) SessionID() []byte     { return nil }
+func (testConnMetadata) ClientVersion() []byte { return []byte("SSH-2.0-test") }
+func (testConnMetadata) ServerVersion() []byte { return []byte("SSH-2.0-gossh-honey") }
+func (testConnMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+}
+func (testConnMetadata) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+}
+
+// root用户的会话
+func newTestChannelContext(cfg *config) channelContext {
+	context := newChannelContext(connContext{ConnMetadata: testConnMetadata{"root"}, cfg: cfg, connID: "test"}, 0)
+	context.fs = newSessionFilesystem(cfg, "root")
+	return context
+}
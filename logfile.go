@@ -0,0 +1,294 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 日志文件 按大小和时间进行轮转
+type rotatingFile struct {
+	path   string
+	config logRotationConfig
+
+	refs int // 引用计数 由logFiles管理
+
+	cleanupMutex sync.Mutex // 同一时间只运行一个清理 避免重复删除和压缩
+
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, config logRotationConfig) (*rotatingFile, error) {
+	file := &rotatingFile{path: path, config: config}
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (file *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(file.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	file.file = f
+	file.size = info.Size()
+	file.openedAt = time.Now()
+	return nil
+}
+
+func (file *rotatingFile) Write(p []byte) (int, error) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if file.file == nil {
+		return 0, os.ErrClosed
+	}
+	if file.shouldRotate(int64(len(p))) {
+		if err := file.rotate(); err != nil {
+			// 轮转失败时继续写入当前文件 不丢失日志
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file %q: %v\n", file.path, err)
+		}
+	}
+	n, err := file.file.Write(p)
+	file.size += int64(n)
+	return n, err
+}
+
+func (file *rotatingFile) shouldRotate(size int64) bool {
+	if file.size == 0 {
+		return false
+	}
+	if file.config.MaxSize > 0 && file.size+size > file.config.MaxSize*1024*1024 {
+		return true
+	}
+	return file.config.MaxAge > 0 && time.Since(file.openedAt) >= file.config.MaxAge
+}
+
+// 轮转日志文件 当前文件重命名为 文件名.时间戳 并重新打开
+// 新文件打开成功后才关闭旧文件 失败时继续写入轮转后的文件
+func (file *rotatingFile) rotate() error {
+	rotatedPath := fmt.Sprintf("%v.%v", file.path, time.Now().Format("20060102-150405"))
+	for i := 1; fileExists(rotatedPath) || fileExists(rotatedPath+".gz"); i++ {
+		rotatedPath = fmt.Sprintf("%v.%v.%v", file.path, time.Now().Format("20060102-150405"), i)
+	}
+	if err := os.Rename(file.path, rotatedPath); err != nil {
+		return err
+	}
+	oldFile := file.file
+	if err := file.open(); err != nil {
+		return err
+	}
+	if err := oldFile.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to close rotated log file %q: %v\n", rotatedPath, err)
+	}
+	go file.cleanup(rotatedPath, file.config)
+	return nil
+}
+
+// 轮转后的文件名 文件名.时间戳[.序号][.gz]
+func rotatedFilePattern(path string) *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(filepath.Base(path)) + `\.\d{8}-\d{6}(\.\d+)?(\.gz)?$`)
+}
+
+// 压缩刚轮转的文件并删除多余的旧文件
+func (file *rotatingFile) cleanup(rotatedPath string, config logRotationConfig) {
+	file.cleanupMutex.Lock()
+	defer file.cleanupMutex.Unlock()
+	if config.Compress {
+		if err := compressFile(rotatedPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to compress log file %q: %v\n", rotatedPath, err)
+		}
+	}
+	if config.MaxBackups <= 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(file.path))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list rotated log files: %v\n", err)
+		return
+	}
+	pattern := rotatedFilePattern(file.path)
+	var backups []string
+	for _, entry := range entries {
+		if !entry.IsDir() && pattern.MatchString(entry.Name()) {
+			backups = append(backups, filepath.Join(filepath.Dir(file.path), entry.Name()))
+		}
+	}
+	// 时间戳格式保证按名称排序即按时间排序
+	sort.Strings(backups)
+	for len(backups) > config.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove rotated log file %q: %v\n", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// 重新打开日志文件 用于配合logrotate等外部工具
+// 新文件打开失败时继续使用旧文件
+func (file *rotatingFile) Reopen() error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	oldFile := file.file
+	if err := file.open(); err != nil {
+		return err
+	}
+	if oldFile != nil {
+		return oldFile.Close()
+	}
+	return nil
+}
+
+func (file *rotatingFile) Close() error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if file.file == nil {
+		return nil
+	}
+	err := file.file.Close()
+	file.file = nil
+	return err
+}
+
+func compressFile(path string) error {
+	if strings.HasSuffix(path, ".gz") {
+		return nil
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(dst)
+	if _, err := io.Copy(writer, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// 所有打开的日志文件 按路径共享 同一文件可同时作为程序日志和事件输出
+var logFiles = struct {
+	sync.Mutex
+	files map[string]*rotatingFile
+}{files: map[string]*rotatingFile{}}
+
+// 获取指定路径的日志文件 已经打开时增加引用计数
+func acquireLogFile(path string, config logRotationConfig) (*rotatingFile, error) {
+	logFiles.Lock()
+	defer logFiles.Unlock()
+	if file, ok := logFiles.files[path]; ok {
+		file.mutex.Lock()
+		file.config = config
+		file.mutex.Unlock()
+		file.refs++
+		return file, nil
+	}
+	file, err := openRotatingFile(path, config)
+	if err != nil {
+		return nil, err
+	}
+	file.refs = 1
+	logFiles.files[path] = file
+	return file, nil
+}
+
+// 释放日志文件 没有引用时关闭
+func releaseLogFile(file *rotatingFile) error {
+	logFiles.Lock()
+	defer logFiles.Unlock()
+	file.refs--
+	if file.refs > 0 {
+		return nil
+	}
+	delete(logFiles.files, file.path)
+	return file.Close()
+}
+
+// 重新打开所有日志文件 用于配合logrotate等外部工具
+func reopenLogFiles() {
+	logFiles.Lock()
+	defer logFiles.Unlock()
+	for path, file := range logFiles.files {
+		if err := file.Reopen(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to reopen log file %q: %v\n", path, err)
+			continue
+		}
+		log.Printf("Log file %q reopened", path)
+	}
+}
+
+// 当前程序日志使用的日志文件
+var logOutput *rotatingFile
+
+// 根据配置设置程序日志的输出 未配置文件时输出到stderr
+func setupLogging(cfg loggingConfig) error {
+	file, err := openLogOutput(cfg)
+	if err != nil {
+		return err
+	}
+	useLogOutput(file)
+	return nil
+}
+
+// 打开程序日志文件 未配置文件时返回nil 之后由useLogOutput生效或者releaseLogFile释放
+func openLogOutput(cfg loggingConfig) (*rotatingFile, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	return acquireLogFile(cfg.File, cfg.Rotation)
+}
+
+// 切换程序日志的输出 释放之前的日志文件
+func useLogOutput(file *rotatingFile) {
+	if file != nil {
+		log.SetOutput(file)
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+	if logOutput != nil {
+		if err := releaseLogFile(logOutput); err != nil {
+			log.Printf("Failed to close old log file: %v", err)
+		}
+	}
+	logOutput = file
+}
@@ -0,0 +1,7 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+// 该平台没有SIGUSR1 不支持通过信号重新打开日志文件
+func handleReopenSignals() {}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestRotatedFilePattern(t *testing.T) {
+	pattern := rotatedFilePattern("/var/log/events.json")
+	tests := []struct {
+		name  string
+		match bool
+	}{
+		{"events.json.20261017-063007", true},
+		{"events.json.20261017-063007.2", true},
+		{"events.json.20261017-063007.gz", true},
+		{"events.json.20261017-063007.2.gz", true},
+		{"events.json", false},
+		{"events.json.bak", false},
+		{"events.json.lock", false},
+		{"events.json.20261017", false},
+		{"eventsXjson.20261017-063007", false},
+		{"other.json.20261017-063007", false},
+	}
+	for _, test := range tests {
+		if got := pattern.MatchString(test.name); got != test.match {
+			t.Errorf("match %q = %v, want %v", test.name, got, test.match)
+		}
+	}
+}
+
+func TestCleanupKeepsUnrelatedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.json")
+	for _, name := range []string{
+		"events.json",
+		"events.json.bak",
+		"events.json.lock",
+		"events.json.20261015-000000",
+		"events.json.20261016-000000.gz",
+		"events.json.20261017-000000",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := &rotatingFile{path: path}
+	file.cleanup(filepath.Join(dir, "events.json.20261017-000000"), logRotationConfig{MaxBackups: 1})
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	want := []string{"events.json", "events.json.20261017-000000", "events.json.bak", "events.json.lock"}
+	if len(names) != len(want) {
+		t.Fatalf("files = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("files = %v, want %v", names, want)
+		}
+	}
+}
+
+func TestRotateKeepsWriting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, err := openRotatingFile(filepath.Join(dir, "app.log"), logRotationConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	file.mutex.Lock()
+	err = file.rotate()
+	file.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("second\n")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "app.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "second\n" {
+		t.Errorf("current log = %q, want %q", data, "second\n")
+	}
+}
@@ -14,10 +14,26 @@ type logEntry interface {
 }
 
 type connectionLog struct {
+	Protocol      string `json:"protocol"`      // ssh或telnet
+	LocalAddress  string `json:"local_address"` // 连接到的本地地址 有多个监听地址时用于区分
 	ClientVersion string `json:"client_version"`
+	// 客户端KEXINIT中的HASSH指纹和算法列表
+	HASSH             string   `json:"hassh,omitempty"`
+	HASSHAlgorithms   string   `json:"hassh_algorithms,omitempty"`
+	KexAlgorithms     []string `json:"kex_algorithms,omitempty"`
+	HostKeyAlgorithms []string `json:"host_key_algorithms,omitempty"`
+	Ciphers           []string `json:"ciphers,omitempty"`
+	MACs              []string `json:"macs,omitempty"`
+	Compression       []string `json:"compression,omitempty"`
 }
 
 func (entry connectionLog) String() string {
+	if entry.Protocol == "telnet" {
+		return "telnet connection established"
+	}
+	if entry.HASSH != "" {
+		return fmt.Sprintf("connection with client version %q and HASSH %v established", entry.ClientVersion, entry.HASSH)
+	}
 	return fmt.Sprintf("connection with client version %q established", entry.ClientVersion)
 }
 func (entry connectionLog) eventType() string {
@@ -34,6 +50,93 @@ func (entry connectionCloseLog) eventType() string {
 	return "connection_close"
 }
 
+// 握手失败 包括扫描器 发到SSH端口的其他协议和中断的握手
+type handshakeFailureLog struct {
+	LocalAddress  string  `json:"local_address"`
+	Stage         string  `json:"stage"` // version_exchange kex或auth
+	ClientVersion string  `json:"client_version,omitempty"`
+	FirstBytes    []byte  `json:"first_bytes"` // 可能是TLS等二进制协议 JSON中为base64
+	Duration      float64 `json:"duration"`    // 秒
+	Error         string  `json:"error,omitempty"`
+}
+
+func (entry handshakeFailureLog) String() string {
+	if entry.ClientVersion != "" {
+		return fmt.Sprintf("handshake with client version %q failed during %v after %.3fs: %v", entry.ClientVersion, entry.Stage, entry.Duration, entry.Error)
+	}
+	return fmt.Sprintf("handshake failed during %v after %.3fs, first bytes %q: %v", entry.Stage, entry.Duration, entry.FirstBytes, entry.Error)
+}
+func (entry handshakeFailureLog) eventType() string {
+	return "handshake_failure"
+}
+
+type authLog struct {
+	Method   string `json:"method"`
+	User     string `json:"user"`
+	Attempt  int    `json:"attempt"`
+	Accepted bool   `json:"accepted"`
+}
+
+func (entry authLog) outcome() string {
+	if entry.Accepted {
+		return "accepted"
+	}
+	return "rejected"
+}
+func (entry authLog) String() string {
+	return fmt.Sprintf("authentication attempt %v for user %q using method %q %v", entry.Attempt, entry.User, entry.Method, entry.outcome())
+}
+func (entry authLog) eventType() string {
+	return "auth"
+}
+
+type passwordAuthLog struct {
+	authLog
+	Password string `json:"password"`
+}
+
+func (entry passwordAuthLog) String() string {
+	return fmt.Sprintf("authentication attempt %v with password %q for user %q %v", entry.Attempt, entry.Password, entry.User, entry.outcome())
+}
+func (entry passwordAuthLog) eventType() string {
+	return "password_auth"
+}
+
+type publicKeyAuthLog struct {
+	authLog
+	KeyType         string `json:"key_type"`
+	PublicKey       string `json:"public_key"`
+	PublicKeySHA256 string `json:"public_key_sha256"`
+}
+
+func (entry publicKeyAuthLog) String() string {
+	return fmt.Sprintf("authentication attempt %v with %v public key %v for user %q %v", entry.Attempt, entry.KeyType, entry.PublicKeySHA256, entry.User, entry.outcome())
+}
+func (entry publicKeyAuthLog) eventType() string {
+	return "public_key_auth"
+}
+
+type keyboardInteractiveAnswer struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+}
+
+type keyboardInteractiveAuthLog struct {
+	authLog
+	Answers []keyboardInteractiveAnswer `json:"answers"`
+}
+
+func (entry keyboardInteractiveAuthLog) String() string {
+	answers := make([]string, len(entry.Answers))
+	for i, answer := range entry.Answers {
+		answers[i] = fmt.Sprintf("%q: %q", answer.Question, answer.Answer)
+	}
+	return fmt.Sprintf("authentication attempt %v with keyboard-interactive answers {%v} for user %q %v", entry.Attempt, strings.Join(answers, ", "), entry.User, entry.outcome())
+}
+func (entry keyboardInteractiveAuthLog) eventType() string {
+	return "keyboard_interactive_auth"
+}
+
 type tcpipForwardLog struct {
 	Address string `json:"address"`
 }
@@ -84,9 +187,13 @@ func (entry sessionLog) eventType() string {
 
 type sessionCloseLog struct {
 	channelLog
+	Recording string `json:"recording,omitempty"` // 会话录像文件
 }
 
 func (entry sessionCloseLog) String() string {
+	if entry.Recording != "" {
+		return fmt.Sprintf("[channel %v] closed, recorded to %q", entry.ChannelID, entry.Recording)
+	}
 	return fmt.Sprintf("[channel %v] closed", entry.ChannelID)
 }
 func (entry sessionCloseLog) eventType() string {
@@ -105,6 +212,98 @@ func (entry sessionInputLog) eventType() string {
 	return "session_input"
 }
 
+type commandLog struct {
+	channelLog
+	Args []string `json:"args"`
+}
+
+func (entry commandLog) String() string {
+	return fmt.Sprintf("[channel %v] command %q executed", entry.ChannelID, strings.Join(entry.Args, " "))
+}
+func (entry commandLog) eventType() string {
+	return "command"
+}
+
+type downloadLog struct {
+	channelLog
+	Tool        string `json:"tool"`
+	URL         string `json:"url"`
+	Destination string `json:"destination,omitempty"` // 虚拟文件系统中保存的位置
+	Fetched     bool   `json:"fetched"`
+	Size        int64  `json:"size,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+func (entry downloadLog) String() string {
+	message := fmt.Sprintf("[channel %v] download of %q requested by %v", entry.ChannelID, entry.URL, entry.Tool)
+	if entry.Fetched {
+		message += fmt.Sprintf(", saved %v bytes with SHA-256 %v", entry.Size, entry.SHA256)
+	}
+	if entry.Error != "" {
+		message += fmt.Sprintf(", error: %v", entry.Error)
+	}
+	return message
+}
+func (entry downloadLog) eventType() string {
+	return "download"
+}
+
+type sftpLog struct {
+	channelLog
+	Operation string `json:"operation"`
+	Path      string `json:"path"`
+	Target    string `json:"target,omitempty"` // rename的新路径和symlink的目标
+	Flags     string `json:"flags,omitempty"`  // open的标志
+	Size      int64  `json:"size,omitempty"`   // read和write的字节数
+	SHA256    string `json:"sha256,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (entry sftpLog) String() string {
+	message := fmt.Sprintf("[channel %v] SFTP %v of %q", entry.ChannelID, entry.Operation, entry.Path)
+	if entry.Target != "" {
+		message += fmt.Sprintf(" to %q", entry.Target)
+	}
+	if entry.Flags != "" {
+		message += fmt.Sprintf(" with flags %v", entry.Flags)
+	}
+	if entry.Size != 0 {
+		message += fmt.Sprintf(", %v bytes", entry.Size)
+	}
+	if entry.SHA256 != "" {
+		message += fmt.Sprintf(" with SHA-256 %v", entry.SHA256)
+	}
+	if entry.Error != "" {
+		message += fmt.Sprintf(", error: %v", entry.Error)
+	}
+	return message
+}
+func (entry sftpLog) eventType() string {
+	return "sftp"
+}
+
+type scpLog struct {
+	channelLog
+	Direction string `json:"direction"` // upload或download
+	Path      string `json:"path"`
+	Mode      string `json:"mode"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (entry scpLog) String() string {
+	message := fmt.Sprintf("[channel %v] scp %v of %q with mode %v, %v bytes with SHA-256 %v", entry.ChannelID, entry.Direction, entry.Path, entry.Mode, entry.Size, entry.SHA256)
+	if entry.Error != "" {
+		message += fmt.Sprintf(", error: %v", entry.Error)
+	}
+	return message
+}
+func (entry scpLog) eventType() string {
+	return "scp"
+}
+
 type directTCPIPLog struct {
 	channelLog
 	From string `json:"from"`
@@ -285,33 +484,12 @@ func (entry debugChannelRequestLog) eventType() string {
 	return "debug_channel_request"
 }
 
+// 记录事件 由所有配置的输出异步写出
 func (context connContext) logEvent(entry logEntry) {
-	if strings.HasPrefix(entry.eventType(), "debug_") && !context.cfg.Logging.Debug {
-		return
-	}
-	if context.cfg.Logging.JSON {
-		var jsonEntry interface{}
-		if context.cfg.Logging.Timestamps {
-			jsonEntry = struct {
-				Time      string   `json:"time"`
-				Source    string   `json:"source"`
-				EventType string   `json:"event_type"`
-				Event     logEntry `json:"event"`
-			}{time.Now().Format(time.RFC3339), context.RemoteAddr().String(), entry.eventType(), entry}
-		} else {
-			jsonEntry = struct {
-				Source    string   `json:"source"`
-				EventType string   `json:"event_type"`
-				Event     logEntry `json:"event"`
-			}{context.RemoteAddr().String(), entry.eventType(), entry}
-		}
-		logBytes, err := json.Marshal(jsonEntry)
-		if err != nil {
-			log.Printf("Failed to log event: %v", err)
-			return
-		}
-		log.Print(string(logBytes))
-	} else {
-		log.Printf("[%v] %v", context.RemoteAddr().String(), entry)
-	}
+	publishEvent(event{time.Now(), context.RemoteAddr().String(), context.connID, "", entry})
+}
+
+// 记录会话内的事件 带上会话ID
+func (context channelContext) logEvent(entry logEntry) {
+	publishEvent(event{time.Now(), context.RemoteAddr().String(), context.connID, context.sessionID, entry})
 }
@@ -4,66 +4,232 @@ import (
 	"github.com/adrg/xdg"
 	"gopkg.in/yaml.v2"
 
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 )
 
 func main() {
+	// 子命令
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
+	// 配置文件路径 为空时尝试xdg配置目录下的默认位置
+	configFile := flag.String("config", "", "config file (default: "+defaultConfigFile()+" if it exists)")
 	// hostkey文件所在路径
 	dataDir := flag.String("data_dir", path.Join(xdg.DataHome, "hostkeys"), "data directory")
 	flag.Parse()
-	configString := ""
 
 	// 获取ssh连接的配置文件
-	cfg, err := getConfig(configString, *dataDir)
+	loader, err := newConfigLoader(*configFile, *dataDir)
 	if err != nil {
 		log.Fatalf("Failed to get config: %v", err)
 	}
+	cfg := loader.get()
+	if err := setupLogging(cfg.Logging); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	if err := setupEventSinks(cfg.Logging); err != nil {
+		log.Fatalf("Failed to set up event outputs: %v", err)
+	}
+	go loader.handleSignals()
+	go handleReopenSignals()
 
-	// 监听端口
-	listener, err := net.Listen("tcp", cfg.Server.ListenAddress)
-	if err != nil {
-		log.Fatalf("Failed to listen for connections: %v", err)
+	// 监听端口 全部成功后才开始接收连接
+	var listeners []net.Listener
+	for _, listenerCfg := range cfg.listeners {
+		listener, err := net.Listen("tcp", listenerCfg.Server.ListenAddress)
+		if err != nil {
+			log.Fatalf("Failed to listen for connections: %v", err)
+		}
+		defer listener.Close()
+		log.Printf("Listening for %v connections on %v", listenerCfg.Server.Protocol, listener.Addr())
+		listeners = append(listeners, listener)
 	}
-	defer listener.Close()
 
-	log.Printf("Listening on %v", listener.Addr())
+	var wg sync.WaitGroup
+	for i, listener := range listeners {
+		wg.Add(1)
+		go func(listener net.Listener, initialCfg *config) {
+			defer wg.Done()
+			serve(listener, loader, initialCfg)
+		}(listener, cfg.listeners[i])
+	}
+	wg.Wait()
+}
 
-	// 接收所有请求
+// 接收所有请求 每个连接使用建立时生效的配置
+// 重新加载后的配置中没有该监听地址时继续使用启动时的配置
+// 与net/http相同 临时错误(例如文件描述符用尽)时逐渐延长等待时间 监听关闭时返回
+func serve(listener net.Listener, loader *configLoader, initialCfg *config) {
+	address := initialCfg.Server.ListenAddress
+	var delay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
-			continue
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Printf("Failed to accept connection on %v: %v, retrying in %v", address, err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			log.Printf("Failed to accept connection on %v: %v", address, err)
+			return
+		}
+		delay = 0
+		cfg := loader.get().listenerConfig(address)
+		if cfg == nil {
+			cfg = initialCfg
+		}
+		go handleListenerConnection(conn, cfg)
+	}
+}
+
+// 设置连接操作 需要时先读取PROXY协议头
+func handleListenerConnection(conn net.Conn, cfg *config) {
+	if cfg.Server.ProxyProtocol != proxyProtocolOff {
+		var ok bool
+		if conn, ok = acceptProxyProtocol(conn, cfg); !ok {
+			return
+		}
+	}
+	if cfg.Server.Protocol == "telnet" {
+		handleTelnetConnection(conn, cfg)
+	} else {
+		handleConnection(conn, cfg)
+	}
+}
+
+// 默认的配置文件位置
+func defaultConfigFile() string {
+	return path.Join(xdg.ConfigHome, "gossh-honey", "config.yaml")
+}
+
+// 读取配置文件内容 未指定配置文件且默认位置不存在时返回空配置
+func readConfigFile(configFile string) (string, error) {
+	if configFile == "" {
+		configFile = defaultConfigFile()
+		if _, err := os.Stat(configFile); os.IsNotExist(err) {
+			log.Printf("No config file given and %q not found, using default config", configFile)
+			return "", nil
+		}
+	}
+	log.Printf("Using config file %q", configFile)
+	configBytes, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return "", err
+	}
+	return string(configBytes), nil
+}
+
+// 解析并校验配置文件 未设置的字段使用默认配置
+// 配置了server.listeners时为每个监听地址生成一份完整的配置
+func parseConfig(configString string) (*config, error) {
+	cfg, err := decodeConfig(configString, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if len(cfg.Server.Listeners) == 0 {
+		cfg.listeners = []*config{cfg}
+		return cfg, nil
+	}
+	for i := range cfg.Server.Listeners {
+		listenerCfg, err := decodeConfig(configString, &cfg.Server.Listeners[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: server.listeners[%v].%w", i, err)
 		}
-		// 设置连接操作
-		go handleConnection(conn, cfg)
+		cfg.listeners = append(cfg.listeners, listenerCfg)
 	}
+	return cfg, nil
+}
+
+// 解析配置文件 listener不为nil时用它覆盖全局配置中的对应字段
+// 优先级从低到高为 默认配置 全局的服务器配置 全局配置 监听地址的服务器配置 监听地址的配置
+func decodeConfig(configString string, listener *listenerConfig) (*config, error) {
+	cfg := getDefaultConfig()
+	if err := yaml.UnmarshalStrict([]byte(configString), cfg); err != nil {
+		return nil, err
+	}
+	// 服务器配置改变其他字段的默认值 应用后重新解析 配置文件中明确设置的字段优先
+	if cfg.SSHProto.Profile != "" {
+		profile, ok := serverProfiles[cfg.SSHProto.Profile]
+		if !ok {
+			return nil, fmt.Errorf("ssh_proto.profile: unknown profile %q, available: %v", cfg.SSHProto.Profile, profileNames())
+		}
+		cfg = getDefaultConfig()
+		profile.apply(cfg)
+		if err := yaml.UnmarshalStrict([]byte(configString), cfg); err != nil {
+			return nil, err
+		}
+		if fields := profileOverrides(configString); listener == nil && len(fields) != 0 {
+			log.Printf("ssh_proto.profile: %v set explicitly, overriding profile %q", strings.Join(fields, ", "), cfg.SSHProto.Profile)
+		}
+	}
+	if listener != nil {
+		if err := listener.apply(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
 // 获取配置文件
 func getConfig(configString string, dataDir string) (*config, error) {
 	// 1.获取默认配置文件
-	cfg := getDefaultConfig()
-
-	if err := yaml.UnmarshalStrict([]byte(configString), cfg); err != nil {
+	cfg, err := parseConfig(configString)
+	if err != nil {
 		return nil, err
 	}
+	for i, listenerCfg := range cfg.listeners {
+		// 多个监听地址时各自生成主机密钥 看起来是不同的机器
+		keyDir := dataDir
+		if len(cfg.Server.Listeners) != 0 {
+			keyDir = path.Join(dataDir, listenerKeyDir(listenerCfg.Server.ListenAddress))
+		}
+		if err := listenerCfg.setup(keyDir); err != nil {
+			if len(cfg.Server.Listeners) != 0 {
+				return nil, fmt.Errorf("server.listeners[%v]: %w", i, err)
+			}
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
 
-	// 2.判断主机密钥是否为空  如果为空这设置默认主机密钥
-	if len(cfg.Server.HostKeys) == 0 {
-		log.Printf("No host keys configured, using keys at %q", dataDir)
+// 为单个监听地址准备主机密钥 ssh配置和文件系统
+func (cfg *config) setup(dataDir string) error {
+	// 2.判断主机密钥是否为空  如果为空这设置默认主机密钥 telnet不需要主机密钥
+	if len(cfg.Server.HostKeys) == 0 && cfg.Server.Protocol == "ssh" {
+		log.Printf("No host keys configured for %v, using keys at %q", cfg.Server.ListenAddress, dataDir)
 		if err := cfg.setDefaultHostKeys(dataDir); err != nil {
-			return nil, err
+			return err
 		}
 	}
 
 	// 3.设置ssh配置文件
 	if err := cfg.setupSSHConfig(); err != nil {
-		return nil, err
+		return err
 	}
 
-	return cfg, nil
+	// 4.构建虚拟文件系统模板
+	return cfg.setupFilesystem()
 }
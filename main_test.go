@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// 先返回几次临时错误 之后返回监听已关闭
+type failingListener struct {
+	net.Listener
+	failures int
+	accepts  []time.Time
+}
+
+func (listener *failingListener) Accept() (net.Conn, error) {
+	listener.accepts = append(listener.accepts, time.Now())
+	if len(listener.accepts) <= listener.failures {
+		return nil, temporaryError{}
+	}
+	return nil, &net.OpError{Op: "accept", Net: "tcp", Err: net.ErrClosed}
+}
+
+func TestServeBacksOffAndStops(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	listener := &failingListener{failures: 3}
+	done := make(chan struct{})
+	go func() {
+		serve(listener, &configLoader{cfg: cfg}, cfg)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the listener was closed")
+	}
+	if len(listener.accepts) != 4 {
+		t.Fatalf("Accept called %v times, want 4", len(listener.accepts))
+	}
+	// 等待5ms 10ms 20ms
+	if elapsed := listener.accepts[3].Sub(listener.accepts[0]); elapsed < 35*time.Millisecond {
+		t.Errorf("retried after %v, want backoff of at least 35ms", elapsed)
+	}
+}
+
+func TestServeStopsWhenListenerClosed(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		serve(listener, &configLoader{cfg: cfg}, cfg)
+		close(done)
+	}()
+	listener.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the listener was closed")
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	wgetUserAgent = "Wget/1.21.2"
+	curlUserAgent = "curl/7.81.0"
+)
+
+// 没有下载时的下载事件 例如主机名解析失败
+func (context commandContext) newDownloadLog(tool string, rawURL string) downloadLog {
+	return downloadLog{
+		channelLog: channelLog{
+			ChannelID: context.session.channelID,
+		},
+		Tool: tool,
+		URL:  rawURL,
+	}
+}
+
+// 下载URL fetch开启时下载并保存到隔离目录 否则返回伪造的内容
+// 返回的下载事件需要在确定保存位置后由调用者记录
+func (context commandContext) fetchURL(tool string, rawURL string, userAgent string) (*download, downloadLog, error) {
+	entry := context.newDownloadLog(tool, rawURL)
+	downloads := context.session.cfg.Downloads
+	if !downloads.Fetch {
+		return &download{data: fakeDownload(rawURL), status: 200, statusText: "200 OK", contentType: "application/octet-stream"}, entry, nil
+	}
+	result, err := downloads.fetch(rawURL, userAgent)
+	if err != nil {
+		entry.Error = err.Error()
+		return nil, entry, err
+	}
+	entry.Fetched = true
+	entry.Size = int64(len(result.data))
+	// HTTP错误页面不保存
+	if result.status >= 400 {
+		entry.Error = result.statusText
+		return result, entry, nil
+	}
+	sha, err := downloads.quarantine(result.data)
+	entry.SHA256 = sha
+	if err != nil {
+		// 隔离失败不影响攻击者看到的结果
+		entry.Error = err.Error()
+	}
+	return result, entry, nil
+}
+
+// 下载的文件写入虚拟文件系统 并记录下载事件
+func (context commandContext) saveDownload(entry downloadLog, name string, data []byte) error {
+	var err error
+	if name != "" {
+		entry.Destination = context.absPath(name)
+		err = context.session.fs.WriteFile(entry.Destination, data, 0644, false)
+	}
+	context.session.logEvent(entry)
+	return err
+}
+
+// 没有协议的URL使用http
+func normalizeURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("missing host")
+	}
+	return u, nil
+}
+
+func defaultPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch u.Scheme {
+	case "https":
+		return "443"
+	case "ftp":
+		return "21"
+	case "tftp":
+		return "69"
+	}
+	return "80"
+}
+
+// 解析主机地址 不下载时使用伪造的地址
+func (context commandContext) resolveHost(host string) (string, error) {
+	downloads := context.session.cfg.Downloads
+	if !downloads.Fetch || net.ParseIP(host) != nil {
+		return fakeAddress(host), nil
+	}
+	ip, err := downloads.lookup(host)
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+func isResolveError(err error) bool {
+	var dnsError *net.DNSError
+	return errors.As(err, &dnsError)
+}
+
+// 下载文件名 URL路径的最后一部分 为空时使用index.html
+func remoteFileName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "/" || name == "." || name == "" {
+		return "index.html"
+	}
+	return name
+}
+
+type cmdWget struct{}
+
+func (cmdWget) execute(context commandContext) (uint32, error) {
+	args := make([]string, len(context.args)-1)
+	for i, arg := range context.args[1:] {
+		// -nv是--no-verbose的缩写 不是-n和-v
+		if arg == "-nv" {
+			arg = "--no-verbose"
+		}
+		args[i] = arg
+	}
+	opts, err := parseOptions(args, "O:qP:cbt:T:U:o:Nvk", map[string]byte{
+		"output-document":      'O',
+		"quiet":                'q',
+		"directory-prefix":     'P',
+		"continue":             'c',
+		"background":           'b',
+		"tries":                't',
+		"timeout":              'T',
+		"user-agent":           'U',
+		"output-file":          'o',
+		"timestamping":         'N',
+		"verbose":              'v',
+		"no-verbose":           'n',
+		"no-check-certificate": 'k',
+	})
+	if err != nil {
+		return context.usageError(err, 2)
+	}
+	if len(opts.operands) == 0 {
+		_, err := fmt.Fprintf(context.stderr, "%v: missing URL\nUsage: %v [OPTION]... [URL]...\n\nTry `%v --help' for more options.\n",
+			context.args[0], context.args[0], context.args[0])
+		return 1, err
+	}
+	userAgent := wgetUserAgent
+	if ua, ok := opts.values['U']; ok {
+		userAgent = ua
+	}
+	quiet := opts.flags['q'] || opts.flags['n']
+	var status uint32
+	for _, operand := range opts.operands {
+		code, err := context.wget(operand, opts, userAgent, quiet)
+		if err != nil {
+			return code, err
+		}
+		if code != 0 {
+			status = code
+		}
+	}
+	return status, nil
+}
+
+func (context commandContext) wget(operand string, opts options, userAgent string, quiet bool) (uint32, error) {
+	out := context.stderr
+	printf := func(format string, args ...interface{}) error {
+		if quiet {
+			return nil
+		}
+		_, err := fmt.Fprintf(out, format, args...)
+		return err
+	}
+	u, err := normalizeURL(operand)
+	if err != nil {
+		return 1, context.errorf("%v: Invalid URL %v: %v", operand, operand, err)
+	}
+	rawURL := u.String()
+	timestamp := func() string { return time.Now().Format("2006-01-02 15:04:05") }
+	if err := printf("--%v--  %v\n", timestamp(), rawURL); err != nil {
+		return 0, err
+	}
+	host, port := u.Hostname(), defaultPort(u)
+	address := host
+	if net.ParseIP(host) == nil {
+		if err := printf("Resolving %v (%v)... ", host, host); err != nil {
+			return 0, err
+		}
+		address, err = context.resolveHost(host)
+		if err != nil {
+			entry := context.newDownloadLog("wget", rawURL)
+			entry.Error = err.Error()
+			context.session.logEvent(entry)
+			if err := printf("failed: Name or service not known.\n"); err != nil {
+				return 0, err
+			}
+			return 4, context.errorf("unable to resolve host address ‘%v’", host)
+		}
+		if err := printf("%v\nConnecting to %v (%v)|%v|:%v... ", address, host, host, address, port); err != nil {
+			return 0, err
+		}
+	} else if err := printf("Connecting to %v:%v... ", host, port); err != nil {
+		return 0, err
+	}
+	result, entry, err := context.fetchURL("wget", rawURL, userAgent)
+	if err != nil {
+		context.session.logEvent(entry)
+		return 4, printf("failed: Connection refused.\n")
+	}
+	if err := printf("connected.\n"); err != nil {
+		return 0, err
+	}
+	if result.status != 0 {
+		if err := printf("HTTP request sent, awaiting response... %v\n", result.statusText); err != nil {
+			return 0, err
+		}
+		if result.status >= 400 {
+			context.session.logEvent(entry)
+			return 8, printf("%v ERROR %v.\n\n", timestamp(), result.statusText)
+		}
+	}
+	size := int64(len(result.data))
+	contentType := result.contentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	length := strconv.FormatInt(size, 10)
+	if size >= 1024 {
+		length += fmt.Sprintf(" (%v)", humanSize(size))
+	}
+	if err := printf("Length: %v [%v]\n", length, contentType); err != nil {
+		return 0, err
+	}
+	// 输出文件 已存在时与wget一样加上.1 .2等后缀
+	name, toStdout := opts.values['O'], opts.values['O'] == "-"
+	if name == "" {
+		name = path.Join(opts.values['P'], remoteFileName(u))
+		for i := 1; ; i++ {
+			if _, err := context.session.fs.Stat(context.absPath(name)); err != nil {
+				break
+			}
+			name = fmt.Sprintf("%v.%v", path.Join(opts.values['P'], remoteFileName(u)), i)
+		}
+	}
+	if toStdout {
+		context.saveDownload(entry, "", nil)
+		_, err := context.stdout.Write(result.data)
+		return 0, err
+	}
+	if err := printf("Saving to: ‘%v’\n\n", name); err != nil {
+		return 0, err
+	}
+	if err := context.saveDownload(entry, name, result.data); err != nil {
+		if err := printf("\n"); err != nil {
+			return 0, err
+		}
+		return 3, context.errorf("%v: %v", name, err)
+	}
+	label := path.Base(name)
+	if len(label) > 19 {
+		label = label[:19]
+	}
+	if err := printf("%-20v100%%[===================>] %7v  --.-KB/s    in 0s      \n\n", label, humanSize(size)); err != nil {
+		return 0, err
+	}
+	return 0, printf("%v (%.1f MB/s) - ‘%v’ saved [%v/%v]\n\n", timestamp(), 8+float64(size%97)/10, name, size, size)
+}
+
+type cmdCurl struct{}
+
+func (cmdCurl) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "o:OsSLkfA:X:d:H:m:u:e:x:IvqC:Y:#", map[string]byte{
+		"output":          'o',
+		"remote-name":     'O',
+		"silent":          's',
+		"show-error":      'S',
+		"location":        'L',
+		"insecure":        'k',
+		"fail":            'f',
+		"user-agent":      'A',
+		"request":         'X',
+		"data":            'd',
+		"header":          'H',
+		"max-time":        'm',
+		"user":            'u',
+		"referer":         'e',
+		"proxy":           'x',
+		"head":            'I',
+		"verbose":         'v',
+		"continue-at":     'C',
+		"connect-timeout": 'Y',
+		"progress-bar":    '#',
+	})
+	if err != nil {
+		_, err := fmt.Fprintf(context.stderr, "curl: %v\ncurl: try 'curl --help' or 'curl --manual' for more information\n", err)
+		return 2, err
+	}
+	if len(opts.operands) == 0 {
+		_, err := fmt.Fprintln(context.stderr, "curl: try 'curl --help' or 'curl --manual' for more information")
+		return 2, err
+	}
+	userAgent := curlUserAgent
+	if ua, ok := opts.values['A']; ok {
+		userAgent = ua
+	}
+	showError := !opts.flags['s'] || opts.flags['S']
+	fail := func(code uint32, format string, args ...interface{}) (uint32, error) {
+		if !showError {
+			return code, nil
+		}
+		_, err := fmt.Fprintf(context.stderr, "curl: (%v) %v\n", code, fmt.Sprintf(format, args...))
+		return code, err
+	}
+	var status uint32
+	for _, operand := range opts.operands {
+		u, err := normalizeURL(operand)
+		if err != nil {
+			status, err = fail(3, "URL using bad/illegal format or missing URL")
+			if err != nil {
+				return status, err
+			}
+			continue
+		}
+		rawURL := u.String()
+		result, entry, err := context.fetchURL("curl", rawURL, userAgent)
+		if err != nil {
+			context.session.logEvent(entry)
+			if isResolveError(err) {
+				status, err = fail(6, "Could not resolve host: %v", u.Hostname())
+			} else {
+				status, err = fail(7, "Failed to connect to %v port %v after 0 ms: Connection refused", u.Hostname(), defaultPort(u))
+			}
+			if err != nil {
+				return status, err
+			}
+			continue
+		}
+		if opts.flags['f'] && result.status >= 400 {
+			context.session.logEvent(entry)
+			status, err = fail(22, "The requested URL returned error: %v", result.status)
+			if err != nil {
+				return status, err
+			}
+			continue
+		}
+		name := opts.values['o']
+		if opts.flags['O'] {
+			name = remoteFileName(u)
+		}
+		// 输出到文件或者标准输出不是终端时显示进度
+		if !opts.flags['s'] && (name != "" || !context.isTerminal()) {
+			size := len(result.data)
+			_, err := fmt.Fprintf(context.stderr, "  %% Total    %% Received %% Xferd  Average Speed   Time    Time     Time  Current\n"+
+				"                                 Dload  Upload   Total   Spent    Left  Speed\n"+
+				"100 %5v  100 %5v    0     0  %5v      0 --:--:-- --:--:-- --:--:-- %5v\n",
+				curlSize(size), curlSize(size), curlSize(size*7), curlSize(size*7))
+			if err != nil {
+				return status, err
+			}
+		}
+		if opts.flags['I'] {
+			context.saveDownload(entry, "", nil)
+			_, err := fmt.Fprintf(context.stdout, "HTTP/1.1 %v\r\nContent-Type: %v\r\nContent-Length: %v\r\n\r\n", result.statusText, result.contentType, len(result.data))
+			if err != nil {
+				return status, err
+			}
+			continue
+		}
+		if name == "" {
+			context.saveDownload(entry, "", nil)
+			if _, err := context.stdout.Write(result.data); err != nil {
+				return status, err
+			}
+			continue
+		}
+		if err := context.saveDownload(entry, name, result.data); err != nil {
+			status, err = fail(23, "Failure writing output to destination")
+			if err != nil {
+				return status, err
+			}
+		}
+	}
+	return status, nil
+}
+
+// curl进度中的大小 例如1234 12k 1.2M
+func curlSize(size int) string {
+	switch {
+	case size < 100000:
+		return strconv.Itoa(size)
+	case size < 10*1024*1024:
+		return fmt.Sprintf("%vk", size/1024)
+	default:
+		return fmt.Sprintf("%.1fM", float64(size)/1024/1024)
+	}
+}
+
+// busybox的tftp -g -r REMOTE -l LOCAL HOST [PORT] 和tftp-hpa的tftp HOST -c get REMOTE [LOCAL]
+type cmdTftp struct{}
+
+func (cmdTftp) execute(context commandContext) (uint32, error) {
+	var get bool
+	var remote, local string
+	var positional []string
+	args := context.args[1:]
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; arg {
+		case "-g":
+			get = true
+		case "-p":
+			get = false
+		case "-l", "-r", "-b", "-m":
+			if i+1 >= len(args) {
+				return context.usageError(fmt.Errorf("option requires an argument -- '%v'", arg[1:]), 1)
+			}
+			i++
+			if arg == "-l" {
+				local = args[i]
+			} else if arg == "-r" {
+				remote = args[i]
+			}
+		case "-c":
+			// -c之后是tftp的交互命令
+			command := args[i+1:]
+			i = len(args)
+			if len(command) >= 2 && command[0] == "get" {
+				get = true
+				remote = command[1]
+				if len(command) >= 3 {
+					local = command[2]
+				}
+			}
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if !get || remote == "" || len(positional) == 0 {
+		_, err := fmt.Fprintf(context.stderr, "usage: %v [-g|-p] [-l LOCAL] [-r REMOTE] HOST [PORT]\n", context.args[0])
+		return 1, err
+	}
+	if local == "" {
+		local = path.Base(remote)
+	}
+	host := positional[0]
+	if len(positional) > 1 {
+		host = net.JoinHostPort(host, positional[1])
+	}
+	rawURL := (&url.URL{Scheme: "tftp", Host: host, Path: "/" + strings.TrimPrefix(remote, "/")}).String()
+	result, entry, err := context.fetchURL("tftp", rawURL, "")
+	if err != nil {
+		context.session.logEvent(entry)
+		return 1, context.errorf("timeout")
+	}
+	if err := context.saveDownload(entry, local, result.data); err != nil {
+		return 1, context.errorf("can't open '%v': %v", local, err)
+	}
+	return 0, nil
+}
+
+// busybox的ftpget [-c] [-v] [-u USER] [-p PASS] [-P PORT] HOST LOCAL_FILE REMOTE_FILE
+type cmdFtpget struct{}
+
+func (cmdFtpget) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "cvu:p:P:", map[string]byte{
+		"continue": 'c',
+		"verbose":  'v',
+		"username": 'u',
+		"password": 'p',
+		"port":     'P',
+	})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	if len(opts.operands) < 2 {
+		_, err := fmt.Fprintf(context.stderr, "Usage: %v [OPTIONS] HOST [LOCAL_FILE] REMOTE_FILE\n", context.args[0])
+		return 1, err
+	}
+	host, local := opts.operands[0], opts.operands[1]
+	remote := local
+	if len(opts.operands) > 2 {
+		remote = opts.operands[2]
+	}
+	u := &url.URL{Scheme: "ftp", Host: host, Path: "/" + strings.TrimPrefix(remote, "/")}
+	if port, ok := opts.values['P']; ok {
+		u.Host = net.JoinHostPort(host, port)
+	}
+	if user, ok := opts.values['u']; ok {
+		u.User = url.UserPassword(user, opts.values['p'])
+	}
+	result, entry, err := context.fetchURL("ftpget", u.String(), "")
+	if err != nil {
+		context.session.logEvent(entry)
+		return 1, context.errorf("can't connect to remote host (%v): Connection refused", fakeAddress(host))
+	}
+	if err := context.saveDownload(entry, local, result.data); err != nil {
+		return 1, context.errorf("can't open '%v': %v", local, err)
+	}
+	return 0, nil
+}
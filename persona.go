@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// 模拟的主机信息 对应yaml文件中的persona
+// 所有侦察命令和/proc中的文件都由它生成 保证结果互相一致
+type personaConfig struct {
+	Hostname string              `yaml:"hostname"`
+	Kernel   personaKernelConfig `yaml:"kernel"`
+	OS       personaOSConfig     `yaml:"os"`
+	CPU      personaCPUConfig    `yaml:"cpu"`
+	MemoryMB int64               `yaml:"memory_mb"`
+	SwapMB   int64               `yaml:"swap_mb"`
+	Disk     personaDiskConfig   `yaml:"disk"`
+	Uptime   time.Duration       `yaml:"uptime"` // 程序启动时的运行时间 之后随时间增加
+	Load     float64             `yaml:"load"`   // 平均负载
+}
+
+type personaKernelConfig struct {
+	Release string `yaml:"release"` // uname -r
+	Version string `yaml:"version"` // uname -v
+	Arch    string `yaml:"arch"`    // uname -m
+}
+
+type personaOSConfig struct {
+	Name     string `yaml:"name"` // 例如Ubuntu 22.04.3 LTS
+	ID       string `yaml:"id"`
+	Version  string `yaml:"version"`
+	Codename string `yaml:"codename"`
+}
+
+type personaCPUConfig struct {
+	Model string  `yaml:"model"`
+	Count int     `yaml:"count"`
+	MHz   float64 `yaml:"mhz"`
+}
+
+type personaDiskConfig struct {
+	Device string `yaml:"device"`
+	SizeGB int64  `yaml:"size_gb"`
+	UsedGB int64  `yaml:"used_gb"`
+}
+
+func defaultPersona() personaConfig {
+	return personaConfig{
+		Hostname: "srv01",
+		Kernel: personaKernelConfig{
+			Release: "5.15.0-91-generic",
+			Version: "#101-Ubuntu SMP Tue Nov 14 13:30:08 UTC 2023",
+			Arch:    "x86_64",
+		},
+		OS: personaOSConfig{
+			Name:     "Ubuntu 22.04.3 LTS",
+			ID:       "ubuntu",
+			Version:  "22.04",
+			Codename: "jammy",
+		},
+		CPU: personaCPUConfig{
+			Model: "Intel(R) Xeon(R) CPU E5-2680 v4 @ 2.40GHz",
+			Count: 4,
+			MHz:   2399.998,
+		},
+		MemoryMB: 7963,
+		SwapMB:   2047,
+		Disk: personaDiskConfig{
+			Device: "/dev/sda1",
+			SizeGB: 80,
+			UsedGB: 23,
+		},
+		Uptime: 47*24*time.Hour + 2*time.Hour + 13*time.Minute,
+		Load:   0.08,
+	}
+}
+
+func (persona personaConfig) validate() error {
+	if persona.Hostname == "" || strings.ContainsAny(persona.Hostname, " \t\r\n/") {
+		return fmt.Errorf("hostname: invalid hostname %q", persona.Hostname)
+	}
+	if persona.Kernel.Release == "" || persona.Kernel.Arch == "" {
+		return errors.New("kernel: release and arch are required")
+	}
+	if persona.CPU.Count <= 0 {
+		return fmt.Errorf("cpu.count: must be positive, got %v", persona.CPU.Count)
+	}
+	if persona.CPU.MHz <= 0 {
+		return fmt.Errorf("cpu.mhz: must be positive, got %v", persona.CPU.MHz)
+	}
+	if persona.MemoryMB <= 0 {
+		return fmt.Errorf("memory_mb: must be positive, got %v", persona.MemoryMB)
+	}
+	if persona.SwapMB < 0 {
+		return fmt.Errorf("swap_mb: must not be negative, got %v", persona.SwapMB)
+	}
+	if persona.Disk.SizeGB <= 0 {
+		return fmt.Errorf("disk.size_gb: must be positive, got %v", persona.Disk.SizeGB)
+	}
+	if persona.Disk.UsedGB < 0 || persona.Disk.UsedGB > persona.Disk.SizeGB {
+		return fmt.Errorf("disk.used_gb: must be between 0 and disk.size_gb, got %v", persona.Disk.UsedGB)
+	}
+	if persona.Uptime < 0 {
+		return fmt.Errorf("uptime: must not be negative, got %v", persona.Uptime)
+	}
+	if persona.Load < 0 {
+		return fmt.Errorf("load: must not be negative, got %v", persona.Load)
+	}
+	return nil
+}
+
+// 程序启动的时间 模拟的运行时间从这时开始增加
+var startTime = time.Now()
+
+func (persona personaConfig) uptime() time.Duration {
+	return persona.Uptime + time.Since(startTime)
+}
+
+func (persona personaConfig) bootTime() time.Time {
+	return time.Now().Add(-persona.uptime()).Truncate(time.Second)
+}
+
+// 1分钟 5分钟 15分钟的平均负载 围绕配置的负载缓慢变化
+func (persona personaConfig) loadAverages() [3]float64 {
+	minutes := float64(time.Now().Unix()) / 60
+	var loads [3]float64
+	for i, period := range []float64{1, 5, 15} {
+		variation := 1 + 0.4*math.Sin(minutes/(3*period)+float64(i))
+		loads[i] = math.Round(persona.Load*variation*100) / 100
+	}
+	return loads
+}
+
+// 内存使用情况 单位KiB free和/proc/meminfo使用相同的值
+type memoryUsage struct {
+	total, used, free, shared, buffers, cached, available, swapTotal, swapFree int64
+}
+
+func (persona personaConfig) memory() memoryUsage {
+	total := persona.MemoryMB * 1024
+	usage := memoryUsage{
+		total:     total,
+		used:      total * 16 / 100,
+		shared:    total * 13 / 10000,
+		buffers:   total * 3 / 100,
+		cached:    total * 18 / 100,
+		swapTotal: persona.SwapMB * 1024,
+		swapFree:  persona.SwapMB * 1024,
+	}
+	usage.free = total - usage.used - usage.buffers - usage.cached
+	usage.available = usage.free + (usage.buffers+usage.cached)*85/100
+	return usage
+}
+
+func (persona personaConfig) cpuVendor() string {
+	if strings.Contains(persona.CPU.Model, "AMD") {
+		return "AuthenticAMD"
+	}
+	return "GenuineIntel"
+}
+
+func (persona personaConfig) cpuFlags() string {
+	if persona.cpuVendor() == "AuthenticAMD" {
+		return "fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 clflush mmx fxsr sse sse2 syscall nx mmxext fxsr_opt pdpe1gb rdtscp lm constant_tsc rep_good nopl nonstop_tsc cpuid extd_apicid tsc_known_freq pni pclmulqdq ssse3 fma cx16 sse4_1 sse4_2 x2apic movbe popcnt aes xsave avx f16c rdrand hypervisor lahf_lm cmp_legacy cr8_legacy abm sse4a misalignsse 3dnowprefetch osvw topoext ssbd ibpb vmmcall fsgsbase bmi1 avx2 smep bmi2 rdseed adx smap clflushopt clwb sha_ni xsaveopt xsavec xgetbv1 clzero xsaveerptr arat npt nrip_save umip rdpid"
+	}
+	return "fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 clflush mmx fxsr sse sse2 ss syscall nx pdpe1gb rdtscp lm constant_tsc rep_good nopl xtopology cpuid tsc_known_freq pni pclmulqdq ssse3 fma cx16 pcid sse4_1 sse4_2 x2apic movbe popcnt tsc_deadline_timer aes xsave avx f16c rdrand hypervisor lahf_lm abm 3dnowprefetch invpcid_single pti ssbd ibrs ibpb stibp fsgsbase tsc_adjust bmi1 hle avx2 smep bmi2 erms invpcid rtm rdseed adx smap xsaveopt arat md_clear arch_capabilities"
+}
+
+// 持久化的系统文件 加入文件系统模板
+func (persona personaConfig) files() map[string]string {
+	return map[string]string{
+		"/etc/hostname": persona.Hostname + "\n",
+		"/etc/hosts": fmt.Sprintf("127.0.0.1\tlocalhost\n127.0.1.1\t%v\n\n"+
+			"# The following lines are desirable for IPv6 capable hosts\n"+
+			"::1\tip6-localhost ip6-loopback\nfe00::0\tip6-localnet\nff00::0\tip6-mcastprefix\nff02::1\tip6-allnodes\nff02::2\tip6-allrouters\n", persona.Hostname),
+		"/etc/os-release": fmt.Sprintf("PRETTY_NAME=%q\nNAME=%q\nVERSION_ID=%q\nVERSION=\"%v (%v)\"\nVERSION_CODENAME=%v\nID=%v\n",
+			persona.OS.Name, osBaseName(persona.OS.Name), persona.OS.Version, persona.OS.Version, persona.OS.Codename, persona.OS.Codename, persona.OS.ID),
+		"/etc/lsb-release": fmt.Sprintf("DISTRIB_ID=%v\nDISTRIB_RELEASE=%v\nDISTRIB_CODENAME=%v\nDISTRIB_DESCRIPTION=%q\n",
+			osBaseName(persona.OS.Name), persona.OS.Version, persona.OS.Codename, persona.OS.Name),
+		"/etc/issue": persona.OS.Name + " \\n \\l\n\n",
+	}
+}
+
+// 发行版名称的第一个单词 例如Ubuntu
+func osBaseName(name string) string {
+	if fields := strings.Fields(name); len(fields) > 0 {
+		return fields[0]
+	}
+	return name
+}
+
+// /proc中每次读取时生成的文件
+func (persona personaConfig) procFiles() map[string]func() []byte {
+	return map[string]func() []byte{
+		"/proc/cpuinfo": persona.cpuinfo,
+		"/proc/meminfo": persona.meminfo,
+		"/proc/version": func() []byte {
+			return []byte(fmt.Sprintf("Linux version %v (buildd@lcy02-amd64-045) (gcc (Ubuntu 11.4.0-1ubuntu1~22.04) 11.4.0, GNU ld (GNU Binutils for Ubuntu) 2.38) %v\n",
+				persona.Kernel.Release, persona.Kernel.Version))
+		},
+		"/proc/uptime": func() []byte {
+			uptime := persona.uptime().Seconds()
+			idle := uptime * float64(persona.CPU.Count) * 0.97
+			return []byte(fmt.Sprintf("%.2f %.2f\n", uptime, idle))
+		},
+		"/proc/loadavg": func() []byte {
+			loads := persona.loadAverages()
+			return []byte(fmt.Sprintf("%.2f %.2f %.2f 1/%v %v\n", loads[0], loads[1], loads[2], 120+persona.CPU.Count*8, 4000+int(persona.uptime().Minutes())%30000))
+		},
+	}
+}
+
+func (persona personaConfig) cpuinfo() []byte {
+	var b strings.Builder
+	for i := 0; i < persona.CPU.Count; i++ {
+		fmt.Fprintf(&b, "processor\t: %v\nvendor_id\t: %v\ncpu family\t: 6\nmodel\t\t: 79\nmodel name\t: %v\nstepping\t: 1\nmicrocode\t: 0x1\n",
+			i, persona.cpuVendor(), persona.CPU.Model)
+		fmt.Fprintf(&b, "cpu MHz\t\t: %.3f\ncache size\t: 35840 KB\nphysical id\t: 0\nsiblings\t: %v\ncore id\t\t: %v\ncpu cores\t: %v\napicid\t\t: %v\ninitial apicid\t: %v\n",
+			persona.CPU.MHz, persona.CPU.Count, i, persona.CPU.Count, i, i)
+		fmt.Fprintf(&b, "fpu\t\t: yes\nfpu_exception\t: yes\ncpuid level\t: 13\nwp\t\t: yes\nflags\t\t: %v\n", persona.cpuFlags())
+		fmt.Fprintf(&b, "bugs\t\t: cpu_meltdown spectre_v1 spectre_v2 spec_store_bypass l1tf mds swapgs taa itlb_multihit mmio_stale_data\nbogomips\t: %.2f\n", persona.CPU.MHz*2)
+		b.WriteString("clflush size\t: 64\ncache_alignment\t: 64\naddress sizes\t: 46 bits physical, 48 bits virtual\npower management:\n\n")
+	}
+	return []byte(b.String())
+}
+
+func (persona personaConfig) meminfo() []byte {
+	memory := persona.memory()
+	var b strings.Builder
+	line := func(name string, kb int64) {
+		fmt.Fprintf(&b, "%-16v%8v kB\n", name+":", kb)
+	}
+	line("MemTotal", memory.total)
+	line("MemFree", memory.free)
+	line("MemAvailable", memory.available)
+	line("Buffers", memory.buffers)
+	line("Cached", memory.cached)
+	line("SwapCached", 0)
+	line("Active", memory.used*6/10+memory.cached/2)
+	line("Inactive", memory.used*4/10+memory.cached/2)
+	line("SwapTotal", memory.swapTotal)
+	line("SwapFree", memory.swapFree)
+	line("Dirty", 124)
+	line("Writeback", 0)
+	line("AnonPages", memory.used*7/10)
+	line("Mapped", memory.used/5)
+	line("Shmem", memory.shared)
+	line("Slab", memory.total/50)
+	line("KernelStack", 4096+int64(persona.CPU.Count)*1024)
+	line("PageTables", memory.used/80)
+	line("CommitLimit", memory.total/2+memory.swapTotal)
+	line("Committed_AS", memory.used*2)
+	line("VmallocTotal", 34359738367)
+	line("Hugepagesize", 2048)
+	return []byte(b.String())
+}
+
+// uptime和w的第一行 例如 06:52:13 up 47 days,  2:21,  1 user,  load average: 0.00, 0.01, 0.05
+func (persona personaConfig) uptimeLine(users int) string {
+	loads := persona.loadAverages()
+	userWord := "users"
+	if users == 1 {
+		userWord = "user"
+	}
+	return fmt.Sprintf(" %v up %v,  %v %v,  load average: %.2f, %.2f, %.2f",
+		time.Now().Format("15:04:05"), formatUptime(persona.uptime()), users, userWord, loads[0], loads[1], loads[2])
+}
+
+func formatUptime(uptime time.Duration) string {
+	days := int(uptime.Hours()) / 24
+	hours := int(uptime.Hours()) % 24
+	minutes := int(uptime.Minutes()) % 60
+	var result string
+	if days > 0 {
+		result = fmt.Sprintf("%v day", days)
+		if days > 1 {
+			result += "s"
+		}
+		result += ", "
+	}
+	if hours > 0 {
+		return result + fmt.Sprintf("%2d:%02d", hours, minutes)
+	}
+	return result + fmt.Sprintf("%v min", minutes)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 凭据接受策略 对应yaml文件中的auth.password_auth.policy
+// 规则按顺序判断: 拒绝列表 允许列表 失败次数 第N个不同的密码 随机接受 都不满足时使用accepted
+type credentialPolicyConfig struct {
+	Allow               []string `yaml:"allow"`       // user:password
+	Deny                []string `yaml:"deny"`        // user:password
+	AllowRegex          []string `yaml:"allow_regex"` // 匹配user:password
+	DenyRegex           []string `yaml:"deny_regex"`  // 匹配user:password
+	AcceptAfterFailures int      `yaml:"accept_after_failures"`
+	AcceptNthPassword   int      `yaml:"accept_nth_password"`
+	AcceptProbability   float64  `yaml:"accept_probability"`
+}
+
+func (policy credentialPolicyConfig) validate() error {
+	for i, credential := range policy.Allow {
+		if !strings.Contains(credential, ":") {
+			return fmt.Errorf("allow[%v]: %q is not in user:password form", i, credential)
+		}
+	}
+	for i, credential := range policy.Deny {
+		if !strings.Contains(credential, ":") {
+			return fmt.Errorf("deny[%v]: %q is not in user:password form", i, credential)
+		}
+	}
+	if policy.AcceptAfterFailures < 0 {
+		return fmt.Errorf("accept_after_failures: must not be negative, got %v", policy.AcceptAfterFailures)
+	}
+	if policy.AcceptNthPassword < 0 {
+		return fmt.Errorf("accept_nth_password: must not be negative, got %v", policy.AcceptNthPassword)
+	}
+	if policy.AcceptProbability < 0 || policy.AcceptProbability > 1 {
+		return fmt.Errorf("accept_probability: must be between 0 and 1, got %v", policy.AcceptProbability)
+	}
+	return nil
+}
+
+// 解析后的凭据接受策略
+type credentialPolicy struct {
+	scope      string // 认证状态的范围 不同监听地址的状态互不影响
+	config     credentialPolicyConfig
+	accepted   bool // 没有规则命中时的结果
+	allow      map[string]bool
+	deny       map[string]bool
+	allowRegex []*regexp.Regexp
+	denyRegex  []*regexp.Regexp
+}
+
+func newCredentialPolicy(config credentialPolicyConfig, accepted bool) (*credentialPolicy, error) {
+	policy := &credentialPolicy{
+		config:   config,
+		accepted: accepted,
+		allow:    map[string]bool{},
+		deny:     map[string]bool{},
+	}
+	for _, credential := range config.Allow {
+		policy.allow[credential] = true
+	}
+	for _, credential := range config.Deny {
+		policy.deny[credential] = true
+	}
+	for i, expr := range config.AllowRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("allow_regex[%v]: %w", i, err)
+		}
+		policy.allowRegex = append(policy.allowRegex, re)
+	}
+	for i, expr := range config.DenyRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("deny_regex[%v]: %w", i, err)
+		}
+		policy.denyRegex = append(policy.denyRegex, re)
+	}
+	return policy, nil
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// 判断来自remoteAddr的凭据是否被接受 并更新该IP的状态
+func (policy *credentialPolicy) accept(remoteAddr net.Addr, user string, password string) bool {
+	credential := user + ":" + password
+	return credentialTracker.update(policy.scope, remoteAddr, credential, password, policy.config.AcceptNthPassword, func(state *ipAuthState) bool {
+		switch {
+		case policy.deny[credential] || matchAny(policy.denyRegex, credential):
+			return false
+		case policy.allow[credential] || matchAny(policy.allowRegex, credential):
+			return true
+		case state.wasAccepted(credential):
+			// 已经接受过的凭据继续有效
+			return true
+		case policy.config.AcceptAfterFailures > 0 && state.failures >= policy.config.AcceptAfterFailures:
+			return true
+		case policy.config.AcceptNthPassword > 0 && state.passwordCount == policy.config.AcceptNthPassword && state.lastPasswordIsNew:
+			return true
+		case policy.config.AcceptProbability > 0 && rand.Float64() < policy.config.AcceptProbability:
+			return true
+		default:
+			return policy.accepted
+		}
+	})
+}
+
+const (
+	// 最多记录的IP数 超过时清除最久没有认证尝试的IP
+	maxTrackedIPs = 65536
+	// 每个IP最多记住的已经接受的凭据 超过时忘记最早的
+	maxAcceptedCredentials = 16
+)
+
+// 超过该时间没有认证尝试的IP状态会被清除
+const ipAuthStateTTL = 24 * time.Hour
+
+// 只保存哈希 不保留攻击者发送的原始数据
+type credentialHash [sha256.Size]byte
+
+// 单个IP的认证状态
+type ipAuthState struct {
+	key               string
+	failures          int
+	passwordCount     int                     // 出现过的不同密码数
+	passwords         map[credentialHash]bool // 前accept_nth_password个不同的密码 之后的密码不会再使第N个密码的规则命中
+	lastPasswordIsNew bool
+	accepted          []credentialHash // 最近接受过的user:password
+	lastSeen          time.Time
+}
+
+func (state *ipAuthState) wasAccepted(credential string) bool {
+	hash := credentialHash(sha256.Sum256([]byte(credential)))
+	for _, accepted := range state.accepted {
+		if accepted == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// 按监听地址和IP记录认证状态 所有连接共享 配置重新加载后保留
+// 按最近一次认证尝试的时间排序 最久没有尝试的在最后
+type ipAuthTracker struct {
+	mutex  sync.Mutex
+	states map[string]*list.Element
+	order  *list.List
+}
+
+var credentialTracker = newIPAuthTracker()
+
+func newIPAuthTracker() *ipAuthTracker {
+	return &ipAuthTracker{states: map[string]*list.Element{}, order: list.New()}
+}
+
+// maxPasswords为需要记住的不同密码数
+func (tracker *ipAuthTracker) update(scope string, remoteAddr net.Addr, credential string, password string, maxPasswords int, decide func(state *ipAuthState) bool) bool {
+	ip := remoteAddr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	key := scope + " " + ip
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	now := time.Now()
+	tracker.prune(now)
+	var state *ipAuthState
+	if element := tracker.states[key]; element != nil {
+		tracker.order.MoveToFront(element)
+		state = element.Value.(*ipAuthState)
+	} else {
+		state = &ipAuthState{key: key, passwords: map[credentialHash]bool{}}
+		tracker.states[key] = tracker.order.PushFront(state)
+		if tracker.order.Len() > maxTrackedIPs {
+			tracker.remove(tracker.order.Back())
+		}
+	}
+	state.lastSeen = now
+	passwordHash := credentialHash(sha256.Sum256([]byte(password)))
+	state.lastPasswordIsNew = !state.passwords[passwordHash]
+	if state.lastPasswordIsNew {
+		state.passwordCount++
+		if len(state.passwords) < maxPasswords {
+			state.passwords[passwordHash] = true
+		}
+	}
+	accepted := decide(state)
+	if accepted {
+		if !state.wasAccepted(credential) {
+			state.accepted = append(state.accepted, sha256.Sum256([]byte(credential)))
+			if len(state.accepted) > maxAcceptedCredentials {
+				state.accepted = state.accepted[1:]
+			}
+		}
+		state.failures = 0
+	} else {
+		state.failures++
+	}
+	return accepted
+}
+
+// 清除超过ipAuthStateTTL没有认证尝试的IP
+func (tracker *ipAuthTracker) prune(now time.Time) {
+	for element := tracker.order.Back(); element != nil && now.Sub(element.Value.(*ipAuthState).lastSeen) > ipAuthStateTTL; element = tracker.order.Back() {
+		tracker.remove(element)
+	}
+}
+
+func (tracker *ipAuthTracker) remove(element *list.Element) {
+	tracker.order.Remove(element)
+	delete(tracker.states, element.Value.(*ipAuthState).key)
+}
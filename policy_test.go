@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAcceptNthPassword(t *testing.T) {
+	policy, err := newCredentialPolicy(credentialPolicyConfig{AcceptNthPassword: 3}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.scope = t.Name()
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	tests := []struct {
+		password string
+		accepted bool
+	}{
+		{"a", false},
+		{"b", false},
+		{"a", false}, // 重复的密码不计数
+		{"c", true},
+		{"d", false},
+		{"c", true}, // 已经接受过的凭据继续有效
+		{"e", false},
+	}
+	for i, test := range tests {
+		if got := policy.accept(addr, "root", test.password); got != test.accepted {
+			t.Errorf("attempt %v with %q: accepted = %v, want %v", i+1, test.password, got, test.accepted)
+		}
+	}
+	element := credentialTracker.states[policy.scope+" 192.0.2.1"]
+	if element == nil {
+		t.Fatal("no state tracked")
+	}
+	if n := len(element.Value.(*ipAuthState).passwords); n != 3 {
+		t.Errorf("remembered %v passwords, want 3", n)
+	}
+}
+
+func TestIPAuthTrackerLimits(t *testing.T) {
+	tracker := newIPAuthTracker()
+	accept := func(*ipAuthState) bool { return true }
+	for i := 0; i < maxTrackedIPs+10; i++ {
+		addr := &net.TCPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 22}
+		tracker.update("", addr, "root:root", "root", 0, accept)
+	}
+	if len(tracker.states) != maxTrackedIPs || tracker.order.Len() != maxTrackedIPs {
+		t.Errorf("tracked %v/%v IPs, want %v", len(tracker.states), tracker.order.Len(), maxTrackedIPs)
+	}
+	if tracker.states[" 10.0.0.0"] != nil {
+		t.Error("least recently seen IP was not evicted")
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 22}
+	for i := 0; i < maxAcceptedCredentials*2; i++ {
+		password := fmt.Sprint(i)
+		tracker.update("", addr, "root:"+password, password, 0, accept)
+	}
+	state := tracker.states[" 192.0.2.2"].Value.(*ipAuthState)
+	if len(state.accepted) != maxAcceptedCredentials || len(state.passwords) != 0 {
+		t.Errorf("remembered %v accepted credentials and %v passwords, want %v and 0", len(state.accepted), len(state.passwords), maxAcceptedCredentials)
+	}
+	if state.wasAccepted("root:0") || !state.wasAccepted(fmt.Sprint("root:", maxAcceptedCredentials*2-1)) {
+		t.Error("oldest accepted credential should be forgotten first")
+	}
+}
+
+func TestInvalidPolicyRegex(t *testing.T) {
+	_, err := getConfig("auth:\n  password_auth:\n    policy:\n      allow_regex: ['root:(']\n", testDataDir)
+	if err == nil || !strings.HasPrefix(err.Error(), "auth.password_auth.policy.allow_regex[0]: ") {
+		t.Errorf("err = %v, want an auth.password_auth.policy.allow_regex[0] error", err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 内置的服务器配置 模拟真实服务器的版本 算法列表和认证方法
+// 算法列表是真实服务器默认列表中x/crypto/ssh支持的部分 顺序与真实服务器相同
+// 压缩算法只能是none 认证方法的顺序固定为password publickey keyboard-interactive
+type serverProfile struct {
+	version             string
+	keyExchanges        []string
+	ciphers             []string
+	macs                []string
+	hostKeyAlgorithms   []string
+	password            bool
+	publicKey           bool
+	keyboardInteractive bool
+	announceHostKeys    bool // 认证后发送hostkeys-00@openssh.com Dropbear不发送
+	kernel              personaKernelConfig
+	os                  personaOSConfig
+}
+
+var (
+	ubuntu2204Kernel = personaKernelConfig{Release: "5.15.0-91-generic", Version: "#101-Ubuntu SMP Tue Nov 14 13:30:08 UTC 2023", Arch: "x86_64"}
+	ubuntu2204OS     = personaOSConfig{Name: "Ubuntu 22.04.3 LTS", ID: "ubuntu", Version: "22.04", Codename: "jammy"}
+	ubuntu2004Kernel = personaKernelConfig{Release: "5.4.0-169-generic", Version: "#187-Ubuntu SMP Thu Nov 23 14:52:28 UTC 2023", Arch: "x86_64"}
+	ubuntu2004OS     = personaOSConfig{Name: "Ubuntu 20.04.6 LTS", ID: "ubuntu", Version: "20.04", Codename: "focal"}
+	debian10Kernel   = personaKernelConfig{Release: "4.19.0-25-amd64", Version: "#1 SMP Debian 4.19.289-2 (2023-08-08)", Arch: "x86_64"}
+	debian10OS       = personaOSConfig{Name: "Debian GNU/Linux 10 (buster)", ID: "debian", Version: "10", Codename: "buster"}
+)
+
+var serverProfiles = map[string]serverProfile{
+	// OpenSSH 8.8之后不再接受ssh-rsa签名 所以不提供RSA主机密钥
+	"openssh-8.9p1-ubuntu": {
+		version:           "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.4",
+		keyExchanges:      []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521"},
+		ciphers:           []string{"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com"},
+		macs:              []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1"},
+		hostKeyAlgorithms: []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoED25519},
+		password:          true,
+		publicKey:         true,
+		announceHostKeys:  true,
+		kernel:            ubuntu2204Kernel,
+		os:                ubuntu2204OS,
+	},
+	"openssh-8.2p1-ubuntu": {
+		version:           "SSH-2.0-OpenSSH_8.2p1 Ubuntu-4ubuntu0.9",
+		keyExchanges:      []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521"},
+		ciphers:           []string{"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com"},
+		macs:              []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1"},
+		hostKeyAlgorithms: []string{ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256, ssh.KeyAlgoED25519},
+		password:          true,
+		publicKey:         true,
+		announceHostKeys:  true,
+		kernel:            ubuntu2004Kernel,
+		os:                ubuntu2004OS,
+	},
+	"openssh-7.9p1-debian": {
+		version:           "SSH-2.0-OpenSSH_7.9p1 Debian-10+deb10u3",
+		keyExchanges:      []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521", "diffie-hellman-group14-sha1"},
+		ciphers:           []string{"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com"},
+		macs:              []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1"},
+		hostKeyAlgorithms: []string{ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256, ssh.KeyAlgoED25519},
+		password:          true,
+		publicKey:         true,
+		announceHostKeys:  true,
+		kernel:            debian10Kernel,
+		os:                debian10OS,
+	},
+	// Ubuntu 20.04中的dropbear 不支持ed25519
+	"dropbear-2019.78": {
+		version:           "SSH-2.0-dropbear_2019.78",
+		keyExchanges:      []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp521", "ecdh-sha2-nistp384", "ecdh-sha2-nistp256", "diffie-hellman-group14-sha1"},
+		ciphers:           []string{"aes128-ctr", "aes256-ctr"},
+		macs:              []string{"hmac-sha1", "hmac-sha2-256"},
+		hostKeyAlgorithms: []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSA},
+		password:          true,
+		publicKey:         true,
+		kernel:            ubuntu2004Kernel,
+		os:                ubuntu2004OS,
+	},
+}
+
+// 作为默认值应用到配置 配置文件中明确设置的字段优先
+func (profile serverProfile) apply(cfg *config) {
+	cfg.SSHProto.Version = profile.version
+	cfg.SSHProto.Banner = ""
+	cfg.SSHProto.KeyExchanges = profile.keyExchanges
+	cfg.SSHProto.Ciphers = profile.ciphers
+	cfg.SSHProto.MACs = profile.macs
+	cfg.SSHProto.HostKeyAlgorithms = profile.hostKeyAlgorithms
+	cfg.SSHProto.AnnounceHostKeys = profile.announceHostKeys
+	cfg.Auth.PasswordAuth.Enabled = profile.password
+	cfg.Auth.PublicKeyAuth.Enabled = profile.publicKey
+	cfg.Auth.KeyboardInteractiveAuth.Enabled = profile.keyboardInteractive
+	cfg.Persona.Kernel = profile.kernel
+	cfg.Persona.OS = profile.os
+}
+
+func profileNames() string {
+	var names []string
+	for name := range serverProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// x/crypto/ssh服务端支持的算法
+var (
+	supportedKeyExchanges = []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521", "diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1"}
+	supportedCiphers      = []string{"aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com", "arcfour256", "arcfour128", "arcfour", "aes128-cbc", "3des-cbc"}
+	supportedMACs         = []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96"}
+	supportedHostKeyTypes = []string{ssh.KeyAlgoRSA, ssh.KeyAlgoDSA, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoED25519}
+)
+
+func validateAlgorithms(algorithms []string, supported []string) error {
+	for i, algorithm := range algorithms {
+		found := false
+		for _, s := range supported {
+			if algorithm == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("[%v]: unsupported algorithm %q, supported: %v", i, algorithm, strings.Join(supported, ", "))
+		}
+	}
+	return nil
+}
+
+// 与profile表示的服务器不一致时容易被识别的字段
+var profileIdentityFields = [][]string{
+	{"ssh_proto", "version"},
+	{"ssh_proto", "banner"},
+	{"persona", "kernel"},
+	{"persona", "os"},
+}
+
+// 配置文件中明确设置并覆盖profile的身份字段
+func profileOverrides(configString string) []string {
+	var root yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(configString), &root); err != nil {
+		return nil
+	}
+	var fields []string
+	for _, field := range profileIdentityFields {
+		section, _ := lookupYAML(root, field[0]).(yaml.MapSlice)
+		if lookupYAML(section, field[1]) != nil {
+			fields = append(fields, strings.Join(field, "."))
+		}
+	}
+	return fields
+}
+
+func lookupYAML(slice yaml.MapSlice, key string) interface{} {
+	for _, item := range slice {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 负载均衡器在连接开始时发送的PROXY协议头 v1为文本 v2为二进制
+// 见https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+const (
+	proxyProtocolOff      = "off"
+	proxyProtocolOptional = "optional" // 有协议头时使用 没有时按普通连接处理
+	proxyProtocolRequired = "required" // 没有有效的协议头时断开连接
+)
+
+const (
+	// 负载均衡器建立连接后立即发送协议头
+	proxyHeaderTimeout = 5 * time.Second
+	// optional时等待客户端第一个字节的时间 telnet等服务端先发送数据的协议中客户端不会先发送
+	proxyOptionalTimeout = time.Second
+	maxProxyV1Length     = 107
+	maxProxyV2Length     = 16 + 4096
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errNoProxyHeader = errors.New("no PROXY protocol header")
+
+func validateProxyProtocol(mode string) error {
+	switch mode {
+	case proxyProtocolOff, proxyProtocolOptional, proxyProtocolRequired:
+		return nil
+	default:
+		return fmt.Errorf("unsupported mode %q, must be off, optional or required", mode)
+	}
+}
+
+// 使用协议头中的地址代替负载均衡器的地址
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader // 可能已经缓存了协议头之后的数据
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (conn *proxyConn) Read(data []byte) (int, error) { return conn.reader.Read(data) }
+func (conn *proxyConn) RemoteAddr() net.Addr          { return conn.remoteAddr }
+func (conn *proxyConn) LocalAddr() net.Addr           { return conn.localAddr }
+
+// 读取PROXY协议头 返回使用真实地址的连接
+// 出错时返回已经读取的数据 用于记录
+func readProxyHeader(conn net.Conn, required bool) (net.Conn, []byte, error) {
+	reader := bufio.NewReaderSize(conn, maxProxyV2Length)
+	result := &proxyConn{Conn: conn, reader: reader, remoteAddr: conn.RemoteAddr(), localAddr: conn.LocalAddr()}
+	timeout := proxyHeaderTimeout
+	if !required {
+		timeout = proxyOptionalTimeout
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	peeked, err := reader.Peek(len(proxyV2Signature))
+	switch {
+	case bytes.Equal(peeked, proxyV2Signature):
+		err = result.readV2()
+	case bytes.HasPrefix(peeked, []byte("PROXY ")):
+		err = result.readV1()
+	case required:
+		if err == nil || err == io.EOF || isTimeout(err) {
+			err = errNoProxyHeader
+		}
+	default:
+		// 数据太短或者等待超时 按普通连接处理
+		err = nil
+	}
+	if err != nil {
+		buffered, _ := reader.Peek(reader.Buffered())
+		if len(buffered) > maxFirstBytes {
+			buffered = buffered[:maxFirstBytes]
+		}
+		// Peek返回的数据在之后读取时会被覆盖
+		return nil, append([]byte(nil), buffered...), err
+	}
+	return result, nil, nil
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n
+// 解析成功后才从缓冲区中丢弃协议头 失败时记录原始数据
+func (conn *proxyConn) readV1() error {
+	var peeked []byte
+	end := -1
+	for {
+		peeked, _ = conn.reader.Peek(conn.reader.Buffered())
+		if end = bytes.Index(peeked, []byte("\r\n")); end >= 0 {
+			break
+		}
+		if len(peeked) >= maxProxyV1Length {
+			return errors.New("PROXY v1 header too long")
+		}
+		if _, err := conn.reader.Peek(len(peeked) + 1); err != nil {
+			return err
+		}
+	}
+	if end+2 > maxProxyV1Length {
+		return errors.New("PROXY v1 header too long")
+	}
+	line := string(peeked[:end])
+	fields := strings.Split(line, " ")
+	switch {
+	case len(fields) >= 2 && fields[1] == "UNKNOWN":
+		// 负载均衡器自己的连接 例如健康检查 保留原来的地址
+	case len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6"):
+		return fmt.Errorf("invalid PROXY v1 header %q", line)
+	default:
+		source, err := parseProxyV1Address(fields[2], fields[4], fields[1] == "TCP4")
+		if err != nil {
+			return fmt.Errorf("invalid PROXY v1 source address: %w", err)
+		}
+		dest, err := parseProxyV1Address(fields[3], fields[5], fields[1] == "TCP4")
+		if err != nil {
+			return fmt.Errorf("invalid PROXY v1 destination address: %w", err)
+		}
+		conn.remoteAddr, conn.localAddr = source, dest
+	}
+	_, err := conn.reader.Discard(end + 2)
+	return err
+}
+
+func parseProxyV1Address(host string, port string, ipv4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != ipv4 {
+		return nil, fmt.Errorf("%q is not an IPv%v address", host, map[bool]int{true: 4, false: 6}[ipv4])
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(number)}, nil
+}
+
+// 签名 版本和命令 地址族和传输协议 地址长度 地址 TLV
+func (conn *proxyConn) readV2() error {
+	header, err := conn.reader.Peek(16)
+	if err != nil {
+		return err
+	}
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %v", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	if 16+length > maxProxyV2Length {
+		return fmt.Errorf("PROXY v2 header too long (%v bytes)", length)
+	}
+	peeked, err := conn.reader.Peek(16 + length)
+	if err != nil {
+		return err
+	}
+	payload := peeked[16:]
+	switch command {
+	case 0:
+		// LOCAL 负载均衡器自己的连接 保留原来的地址
+	case 1:
+		// 只使用TCP和UDP的地址 UNIX套接字等保留原来的地址
+		switch family >> 4 {
+		case 1:
+			if length < 12 {
+				return errors.New("PROXY v2 IPv4 address block too short")
+			}
+			conn.remoteAddr = &net.TCPAddr{IP: copyIP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}
+			conn.localAddr = &net.TCPAddr{IP: copyIP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:]))}
+		case 2:
+			if length < 36 {
+				return errors.New("PROXY v2 IPv6 address block too short")
+			}
+			conn.remoteAddr = &net.TCPAddr{IP: copyIP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}
+			conn.localAddr = &net.TCPAddr{IP: copyIP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:]))}
+		}
+	default:
+		return fmt.Errorf("unsupported PROXY v2 command %v", command)
+	}
+	_, err = conn.reader.Discard(16 + length)
+	return err
+}
+
+// Peek返回的数据在之后读取时会被覆盖
+func copyIP(data []byte) net.IP {
+	return append(net.IP(nil), data...)
+}
+
+// 按监听地址的设置处理PROXY协议头 失败时记录并关闭连接
+func acceptProxyProtocol(conn net.Conn, cfg *config) (net.Conn, bool) {
+	start := time.Now()
+	proxied, buffered, err := readProxyHeader(conn, cfg.Server.ProxyProtocol == proxyProtocolRequired)
+	if err != nil {
+		context := connContext{ConnMetadata: preAuthConnMetadata{conn}, cfg: cfg, connID: newConnID()}
+		context.logEvent(handshakeFailureLog{
+			LocalAddress: conn.LocalAddr().String(),
+			Stage:        stageProxyProtocol,
+			FirstBytes:   buffered,
+			Duration:     time.Since(start).Seconds(),
+			Error:        err.Error(),
+		})
+		conn.Close()
+		return nil, false
+	}
+	return proxied, true
+}
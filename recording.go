@@ -0,0 +1,181 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 会话录像配置 对应yaml文件中的recording
+// 每个会话的输入和输出以asciicast v2格式保存 文件名为会话ID.cast
+type recordingConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Directory string `yaml:"directory"`
+	MaxSize   int64  `yaml:"max_size"` // 单个录像文件的最大字节数 超过后停止录制 0表示不限制
+}
+
+func (recording recordingConfig) validate() error {
+	if recording.Enabled && recording.Directory == "" {
+		return errors.New("directory: required when recording is enabled")
+	}
+	if recording.MaxSize < 0 {
+		return fmt.Errorf("max_size: must not be negative, got %v", recording.MaxSize)
+	}
+	return nil
+}
+
+// asciicast v2文件的第一行
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+
+	// 以下字段不属于asciicast格式 播放器会忽略 用于列出录像时过滤
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	User       string `json:"user,omitempty"`
+}
+
+// 会话录像 输入和输出可能在不同的goroutine中写入
+type sessionRecorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	path    string
+	start   time.Time
+	size    int64
+	maxSize int64
+	pending map[string][]byte // 尚不完整的UTF-8字符 按事件类型保存
+}
+
+func newSessionRecorder(cfg recordingConfig, sessionID string, header asciicastHeader) (*sessionRecorder, error) {
+	if err := os.MkdirAll(cfg.Directory, 0700); err != nil {
+		return nil, err
+	}
+	name := path.Join(cfg.Directory, sessionID+".cast")
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	recorder := &sessionRecorder{file: file, path: name, start: time.Now(), maxSize: cfg.MaxSize, pending: map[string][]byte{}}
+	header.Version = 2
+	header.Timestamp = recorder.start.Unix()
+	data, err := json.Marshal(header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := recorder.writeLine(data); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recorder, nil
+}
+
+func (recorder *sessionRecorder) writeLine(data []byte) error {
+	if recorder.maxSize > 0 && recorder.size+int64(len(data))+1 > recorder.maxSize {
+		return nil
+	}
+	n, err := recorder.file.Write(append(data, '\n'))
+	recorder.size += int64(n)
+	return err
+}
+
+// 记录一个事件 eventType为o(输出) i(输入)或r(终端大小改变)
+func (recorder *sessionRecorder) record(eventType string, data []byte) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.file == nil {
+		return
+	}
+	// 数据可能在多字节字符的中间被分开 不完整的部分留到下一次
+	data = append(recorder.pending[eventType], data...)
+	complete := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				complete = i
+			}
+			break
+		}
+	}
+	recorder.pending[eventType] = append([]byte(nil), data[complete:]...)
+	if complete == 0 {
+		return
+	}
+	line, err := json.Marshal([]interface{}{
+		json.Number(strconv.FormatFloat(time.Since(recorder.start).Seconds(), 'f', 6, 64)),
+		eventType,
+		string(data[:complete]),
+	})
+	if err == nil {
+		err = recorder.writeLine(line)
+	}
+	if err != nil {
+		// 写入失败后停止录制
+		log.Printf("Failed to write session recording %q: %v", recorder.path, err)
+		recorder.file.Close()
+		recorder.file = nil
+	}
+}
+
+func (recorder *sessionRecorder) resize(width uint32, height uint32) {
+	recorder.record("r", []byte(fmt.Sprintf("%vx%v", width, height)))
+}
+
+func (recorder *sessionRecorder) Close() error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.file == nil {
+		return nil
+	}
+	err := recorder.file.Close()
+	recorder.file = nil
+	return err
+}
+
+// 录制输入和输出的通道
+type recordingChannel struct {
+	ssh.Channel
+	recorder *sessionRecorder
+}
+
+func (channel recordingChannel) Read(data []byte) (int, error) {
+	n, err := channel.Channel.Read(data)
+	channel.recorder.record("i", data[:n])
+	return n, err
+}
+
+func (channel recordingChannel) Write(data []byte) (int, error) {
+	n, err := channel.Channel.Write(data)
+	channel.recorder.record("o", data[:n])
+	return n, err
+}
+
+// 标准错误与终端中看到的一样记录为输出
+func (channel recordingChannel) Stderr() io.ReadWriter {
+	return recordingStderr{channel.Channel.Stderr(), channel.recorder}
+}
+
+type recordingStderr struct {
+	io.ReadWriter
+	recorder *sessionRecorder
+}
+
+func (stderr recordingStderr) Write(data []byte) (int, error) {
+	n, err := stderr.ReadWriter.Write(data)
+	stderr.recorder.record("o", data[:n])
+	return n, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// 配置加载器 保存当前生效的配置 收到SIGHUP时重新加载
+// 新配置只对之后建立的连接生效 已有连接继续使用建立时的配置
+type configLoader struct {
+	configFile string
+	dataDir    string
+
+	mutex sync.RWMutex
+	cfg   *config
+}
+
+func newConfigLoader(configFile string, dataDir string) (*configLoader, error) {
+	loader := &configLoader{configFile: configFile, dataDir: dataDir}
+	cfg, err := loader.load()
+	if err != nil {
+		return nil, err
+	}
+	loader.cfg = cfg
+	return loader, nil
+}
+
+// 读取并解析配置文件
+func (loader *configLoader) load() (*config, error) {
+	configString, err := readConfigFile(loader.configFile)
+	if err != nil {
+		return nil, err
+	}
+	return getConfig(configString, loader.dataDir)
+}
+
+// 获取当前生效的配置
+func (loader *configLoader) get() *config {
+	loader.mutex.RLock()
+	defer loader.mutex.RUnlock()
+	return loader.cfg
+}
+
+// 重新加载配置 失败时保留旧配置
+func (loader *configLoader) reload() {
+	log.Printf("Reloading config")
+	cfg, err := loader.load()
+	if err != nil {
+		log.Printf("Failed to reload config, keeping the old one: %v", err)
+		return
+	}
+	// 日志文件和事件输出都打开成功后才一起切换
+	logFile, err := openLogOutput(cfg.Logging)
+	if err != nil {
+		log.Printf("Failed to set up logging, keeping the old config: %v", err)
+		return
+	}
+	dispatcher, err := newEventDispatcher(cfg.Logging)
+	if err != nil {
+		if logFile != nil {
+			releaseLogFile(logFile)
+		}
+		log.Printf("Failed to set up event outputs, keeping the old config: %v", err)
+		return
+	}
+	useLogOutput(logFile)
+	useEventDispatcher(dispatcher)
+	loader.mutex.Lock()
+	oldCfg := loader.cfg
+	loader.cfg = cfg
+	loader.mutex.Unlock()
+	if oldAddresses, addresses := strings.Join(oldCfg.listenAddresses(), ", "), strings.Join(cfg.listenAddresses(), ", "); addresses != oldAddresses {
+		log.Printf("Listen addresses changed from %v to %v, a restart is required for it to take effect", oldAddresses, addresses)
+	}
+	log.Printf("Config reloaded, applying it to new connections")
+}
+
+// 监听SIGHUP信号
+func (loader *configLoader) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		loader.reload()
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 事件输出打开失败时日志输出也保持不变
+func TestReloadKeepsLoggingWhenEventSinksFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yaml")
+	newLog := filepath.Join(dir, "new.log")
+	// 目录不能作为输出文件打开
+	configString := "logging:\n  file: " + newLog + "\n  outputs:\n    - type: file\n      path: " + dir + "\n"
+	if err := ioutil.WriteFile(configFile, []byte(configString), 0600); err != nil {
+		t.Fatal(err)
+	}
+	oldCfg := newTestConfig(t, "")
+	loader := &configLoader{configFile: configFile, dataDir: testDataDir, cfg: oldCfg}
+	oldWriter, oldOutput := log.Writer(), logOutput
+	events.Lock()
+	oldDispatcher := events.dispatcher
+	events.Unlock()
+
+	loader.reload()
+
+	if log.Writer() != oldWriter || logOutput != oldOutput {
+		t.Error("log output switched although the reload failed")
+	}
+	events.Lock()
+	dispatcher := events.dispatcher
+	events.Unlock()
+	if dispatcher != oldDispatcher {
+		t.Error("event outputs switched although the reload failed")
+	}
+	if loader.get() != oldCfg {
+		t.Error("config replaced although the reload failed")
+	}
+	logFiles.Lock()
+	_, open := logFiles.files[newLog]
+	logFiles.Unlock()
+	if open {
+		t.Error("new log file left open")
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"golang.org/x/term"
+
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// replay子命令 播放或列出会话录像
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configFile := flags.String("config", "", "config file used to find the recordings directory (default: "+defaultConfigFile()+" if it exists)")
+	dir := flags.String("dir", "", "recordings directory (default: recording.directory from the config file)")
+	speed := flags.Float64("speed", 1, "playback speed, 2 plays twice as fast")
+	idleLimit := flags.Duration("idle_limit", 0, "maximum pause between events, 0 keeps the recorded timing")
+	inputOnly := flags.Bool("input", false, "print only the attacker's input instead of playing the session")
+	list := flags.Bool("list", false, "list recordings instead of playing one")
+	ip := flags.String("ip", "", "with -list, only show recordings from this source IP")
+	date := flags.String("date", "", "with -list, only show recordings started on this date (YYYY-MM-DD or a prefix such as YYYY-MM)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v replay [options] RECORDING|SESSION_ID\n       %v replay -list [-ip ADDRESS] [-date DATE]\n\n", os.Args[0], os.Args[0])
+		fmt.Fprintf(flags.Output(), "While playing in a terminal, press space to pause, . to skip ahead (one event at a time while paused) and q to quit.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *speed <= 0 {
+		fmt.Fprintf(os.Stderr, "replay: -speed must be positive, got %v\n", *speed)
+		return 2
+	}
+	if !*list && flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	// 录像目录 未指定时从配置文件中读取
+	recordingsDir := func() (string, error) {
+		if *dir != "" {
+			return *dir, nil
+		}
+		configString, err := readConfigFile(*configFile)
+		if err != nil {
+			return "", err
+		}
+		cfg, err := parseConfig(configString)
+		if err != nil {
+			return "", err
+		}
+		return cfg.Recording.Directory, nil
+	}
+
+	var err error
+	if *list {
+		var directory string
+		directory, err = recordingsDir()
+		if err == nil {
+			err = listRecordings(os.Stdout, directory, *ip, *date)
+		}
+	} else {
+		// 参数不是文件时作为会话ID在录像目录中查找
+		name := flags.Arg(0)
+		if _, statErr := os.Stat(name); statErr != nil && !strings.ContainsRune(name, '/') {
+			var directory string
+			if directory, err = recordingsDir(); err == nil {
+				name = path.Join(directory, strings.TrimSuffix(name, ".cast")+".cast")
+			}
+		}
+		if err == nil && *inputOnly {
+			err = dumpInput(os.Stdout, name)
+		} else if err == nil {
+			err = playRecording(name, *speed, *idleLimit)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// 录像中的一个事件
+type asciicastEvent struct {
+	time      float64
+	eventType string
+	data      string
+}
+
+// 按顺序读取录像的事件
+type asciicastReader struct {
+	reader *bufio.Reader
+}
+
+func openRecording(name string) (*os.File, asciicastHeader, *asciicastReader, error) {
+	var header asciicastHeader
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, header, nil, err
+	}
+	reader := &asciicastReader{bufio.NewReader(file)}
+	line, err := reader.reader.ReadBytes('\n')
+	if err == nil || (err == io.EOF && len(line) != 0) {
+		err = json.Unmarshal(line, &header)
+	}
+	if err == nil && header.Version != 2 {
+		err = fmt.Errorf("unsupported asciicast version %v", header.Version)
+	}
+	if err != nil {
+		file.Close()
+		return nil, header, nil, fmt.Errorf("%v: %w", name, err)
+	}
+	return file, header, reader, nil
+}
+
+// 读取下一个事件 没有更多事件时返回io.EOF
+func (r *asciicastReader) next() (asciicastEvent, error) {
+	line, err := r.reader.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return asciicastEvent{}, io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return asciicastEvent{}, err
+	}
+	var fields []interface{}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return asciicastEvent{}, err
+	}
+	var event asciicastEvent
+	var ok [3]bool
+	if len(fields) == 3 {
+		event.time, ok[0] = fields[0].(float64)
+		event.eventType, ok[1] = fields[1].(string)
+		event.data, ok[2] = fields[2].(string)
+	}
+	if !ok[0] || !ok[1] || !ok[2] {
+		return asciicastEvent{}, fmt.Errorf("invalid event %q", strings.TrimSpace(string(line)))
+	}
+	return event, nil
+}
+
+// 列出录像 按开始时间排序
+func listRecordings(w io.Writer, directory string, ip string, date string) error {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+	type recording struct {
+		session  string
+		header   asciicastHeader
+		duration time.Duration
+	}
+	var recordings []recording
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".cast") {
+			continue
+		}
+		f, header, reader, err := openRecording(path.Join(directory, file.Name()))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+			continue
+		}
+		var last float64
+		for {
+			event, err := reader.next()
+			if err != nil {
+				break
+			}
+			last = event.time
+		}
+		f.Close()
+		if ip != "" {
+			host, _, err := net.SplitHostPort(header.RemoteAddr)
+			if err != nil || host != ip {
+				continue
+			}
+		}
+		if !strings.HasPrefix(time.Unix(header.Timestamp, 0).Format("2006-01-02 15:04:05"), date) {
+			continue
+		}
+		duration := time.Duration(last * float64(time.Second)).Round(time.Second)
+		recordings = append(recordings, recording{strings.TrimSuffix(file.Name(), ".cast"), header, duration})
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].header.Timestamp < recordings[j].header.Timestamp
+	})
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "SESSION\tSTARTED\tSOURCE\tUSER\tDURATION\tCOMMAND")
+	for _, recording := range recordings {
+		command := recording.header.Command
+		if command == "" {
+			command = "(shell)"
+		}
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%q\n", recording.session, time.Unix(recording.header.Timestamp, 0).Format("2006-01-02 15:04:05"),
+			recording.header.RemoteAddr, recording.header.User, recording.duration, command)
+	}
+	return table.Flush()
+}
+
+// 只输出攻击者的输入 控制字符与cat -v一样显示
+func dumpInput(w io.Writer, name string) error {
+	file, _, reader, err := openRecording(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var output strings.Builder
+	for {
+		event, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if event.eventType == "i" {
+			output.WriteString(event.data)
+		}
+	}
+	input := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(output.String())
+	var b strings.Builder
+	for _, r := range input {
+		switch {
+		case r == '\n' || r == '\t':
+			b.WriteRune(r)
+		case r < 0x20:
+			b.WriteString("^" + string(rune(r+'@')))
+		case r == 0x7f:
+			b.WriteString("^?")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() != 0 && !strings.HasSuffix(b.String(), "\n") {
+		b.WriteByte('\n')
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+var errReplayQuit = errors.New("quit")
+
+// 播放录像 标准输入是终端时可以暂停和跳过
+type player struct {
+	speed     float64
+	idleLimit time.Duration
+	keys      chan byte
+	paused    bool
+	raw       bool // 终端处于raw模式 输出的\n需要转换为\r\n
+}
+
+func playRecording(name string, speed float64, idleLimit time.Duration) error {
+	file, header, reader, err := openRecording(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	player := &player{speed: speed, idleLimit: idleLimit}
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+		player.raw = true
+		player.keys = make(chan byte)
+		go func() {
+			buffer := make([]byte, 1)
+			for {
+				if _, err := os.Stdin.Read(buffer); err != nil {
+					close(player.keys)
+					return
+				}
+				player.keys <- buffer[0]
+			}
+		}()
+	}
+	if header.Width != 0 {
+		if width, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil && (width < int(header.Width) || height < int(header.Height)) {
+			player.write(fmt.Sprintf("Recorded on a %vx%v terminal, this terminal is %vx%v\n", header.Width, header.Height, width, height))
+		}
+	}
+	var last float64
+	for {
+		event, err := reader.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		delay := time.Duration((event.time - last) * float64(time.Second))
+		last = event.time
+		if player.idleLimit > 0 && delay > player.idleLimit {
+			delay = player.idleLimit
+		}
+		if err := player.wait(time.Duration(float64(delay) / player.speed)); err == errReplayQuit {
+			return nil
+		}
+		if event.eventType == "o" {
+			if err := player.write(event.data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (player *player) write(data string) error {
+	if player.raw {
+		data = strings.ReplaceAll(strings.ReplaceAll(data, "\r\n", "\n"), "\n", "\r\n")
+	}
+	_, err := io.WriteString(os.Stdout, data)
+	return err
+}
+
+// 等待到下一个事件 空格暂停或继续 .跳过等待 暂停时前进一个事件 q或Ctrl-C退出
+func (player *player) wait(delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	deadline := time.Now().Add(delay)
+	remaining := delay
+	if player.paused && !timer.Stop() {
+		<-timer.C
+	}
+	for {
+		select {
+		case <-timer.C:
+			return nil
+		case key, ok := <-player.keys:
+			if !ok {
+				player.keys = nil
+				continue
+			}
+			switch key {
+			case ' ':
+				if player.paused {
+					deadline = time.Now().Add(remaining)
+					timer.Reset(remaining)
+				} else {
+					if !timer.Stop() {
+						<-timer.C
+					}
+					remaining = time.Until(deadline)
+				}
+				player.paused = !player.paused
+			case '.':
+				return nil
+			case 'q', 3:
+				return errReplayQuit
+			}
+		}
+	}
+}
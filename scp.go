@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errSCPProtocol = errors.New("protocol error")
+
+// scp -t和-f 使用旧的SCP协议通过会话通道传输文件
+// 由客户端的scp执行 例如scp payload root@host:/tmp/会执行scp -t /tmp/
+type cmdScp struct{}
+
+func (cmdScp) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "tfrpdvqCT346BEc:F:i:J:l:o:P:S:", nil)
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	if !opts.flags['t'] && !opts.flags['f'] {
+		if len(opts.operands) < 2 {
+			_, err := fmt.Fprintln(context.stderr, "usage: scp [-346ABCOpqRrsTv] [-c cipher] [-D sftp_server_path] [-F ssh_config]\n"+
+				"           [-i identity_file] [-J destination] [-l limit] [-o ssh_option]\n"+
+				"           [-P port] [-S program] [-X sftp_option] source ... target")
+			return 1, err
+		}
+		// 不连接其他主机
+		host := strings.SplitN(opts.operands[len(opts.operands)-1], ":", 2)[0]
+		if i := strings.LastIndexByte(host, '@'); i >= 0 {
+			host = host[i+1:]
+		}
+		_, err := fmt.Fprintf(context.stderr, "ssh: connect to host %v port 22: Connection timed out\r\nlost connection\n", host)
+		return 1, err
+	}
+	reader, ok := context.stdin.(io.Reader)
+	if !ok {
+		return 1, context.errorf("%v", errSCPProtocol)
+	}
+	transfer := &scpTransfer{context: context, reader: bufio.NewReader(reader), opts: opts}
+	if opts.flags['t'] {
+		err = transfer.sink()
+	} else {
+		err = transfer.source()
+	}
+	if err == errSCPProtocol || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 1, nil
+	}
+	if err != nil {
+		return 1, err
+	}
+	return transfer.status, nil
+}
+
+type scpTransfer struct {
+	context commandContext
+	reader  *bufio.Reader
+	opts    options
+	status  uint32
+}
+
+// 发送错误信息 与OpenSSH的run_err一样
+func (transfer *scpTransfer) sendError(format string, args ...interface{}) error {
+	transfer.status = 1
+	_, err := fmt.Fprintf(transfer.context.stdout, "\x01scp: %v\n", fmt.Sprintf(format, args...))
+	return err
+}
+
+func (transfer *scpTransfer) ack() error {
+	_, err := transfer.context.stdout.Write([]byte{0})
+	return err
+}
+
+// 读取对方的确认 对方报告错误时返回errSCPProtocol
+func (transfer *scpTransfer) response() error {
+	code, err := transfer.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 0:
+		return nil
+	case 1, 2:
+		message, err := transfer.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(transfer.context.stderr, message)
+		if err != nil {
+			return err
+		}
+		if code == 2 {
+			return errSCPProtocol
+		}
+		transfer.status = 1
+		return nil
+	default:
+		return errSCPProtocol
+	}
+}
+
+func (transfer *scpTransfer) logTransfer(direction string, name string, mode uint32, data []byte, err error) {
+	sum := sha256.Sum256(data)
+	transfer.context.session.logEvent(scpLog{
+		channelLog: channelLog{
+			ChannelID: transfer.context.session.channelID,
+		},
+		Direction: direction,
+		Path:      name,
+		Mode:      fmt.Sprintf("%04o", mode),
+		Size:      int64(len(data)),
+		SHA256:    hex.EncodeToString(sum[:]),
+		Error:     errorString(err),
+	})
+}
+
+// 接收文件 保存到虚拟文件系统和隔离目录
+func (transfer *scpTransfer) sink() error {
+	context := transfer.context
+	fs := context.session.fs
+	if len(transfer.opts.operands) != 1 {
+		return transfer.sendError("ambiguous target")
+	}
+	target := context.absPath(transfer.opts.operands[0])
+	info, err := fs.Stat(target)
+	targetIsDir := err == nil && info.IsDir()
+	if transfer.opts.flags['d'] && !targetIsDir {
+		if err == nil {
+			err = errNotDir
+		}
+		return transfer.sendError("%v: %v", transfer.opts.operands[0], err)
+	}
+	if err := transfer.ack(); err != nil {
+		return err
+	}
+	var dirs []string // -r时正在接收的目录
+	var mtime time.Time
+	for {
+		line, err := transfer.reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return transfer.sendError("protocol error: expected control record")
+		}
+		switch line[0] {
+		case 1, 2:
+			// 对方的错误信息
+			if _, err := fmt.Fprintln(context.stderr, line[1:]); err != nil {
+				return err
+			}
+			if line[0] == 2 {
+				return errSCPProtocol
+			}
+			transfer.status = 1
+			continue
+		case 'T':
+			var seconds, atime int64
+			if _, err := fmt.Sscanf(line, "T%d 0 %d 0", &seconds, &atime); err != nil {
+				return transfer.sendError("protocol error: mtime.sec not delimited")
+			}
+			mtime = time.Unix(seconds, 0)
+			if err := transfer.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'E':
+			if len(dirs) == 0 {
+				return transfer.sendError("protocol error: unexpected <newline>")
+			}
+			dirs = dirs[:len(dirs)-1]
+			if err := transfer.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'C', 'D':
+		default:
+			return transfer.sendError("protocol error: expected control record")
+		}
+		fields := strings.SplitN(line[1:], " ", 3)
+		if len(fields) != 3 {
+			return transfer.sendError("protocol error: bad mode")
+		}
+		mode, err := strconv.ParseUint(fields[0], 8, 32)
+		if err != nil {
+			return transfer.sendError("protocol error: bad mode")
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 0 {
+			return transfer.sendError("protocol error: size not delimited")
+		}
+		name := fields[2]
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return transfer.sendError("error: unexpected filename: %v", name)
+		}
+		dest := target
+		if len(dirs) != 0 {
+			dest = path.Join(dirs[len(dirs)-1], name)
+		} else if targetIsDir {
+			dest = path.Join(target, name)
+		}
+		perm := fileModeFromUnix(uint32(mode))
+		if !transfer.opts.flags['p'] {
+			perm = fileModeFromUnix(uint32(mode) &^ defaultUmask)
+		}
+		if line[0] == 'D' {
+			if !transfer.opts.flags['r'] {
+				return transfer.sendError("received directory without -r")
+			}
+			if info, err := fs.Stat(dest); err != nil || !info.IsDir() {
+				if err := fs.Mkdir(dest, perm); err != nil {
+					return transfer.sendError("%v: %v", dest, err)
+				}
+			}
+			dirs = append(dirs, dest)
+			if err := transfer.ack(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := transfer.ack(); err != nil {
+			return err
+		}
+		// 超过大小限制或会话剩余的写入量时读取并丢弃内容 与OpenSSH一样在最后报告错误
+		var data []byte
+		var writeErr error
+		limit := context.session.cfg.Filesystem.maxUploadSize()
+		if maxSession := context.session.cfg.Filesystem.MaxSessionSize; maxSession > 0 && maxSession-fs.Written() < limit {
+			limit = maxSession - fs.Written()
+		}
+		if size > limit {
+			if _, err := io.CopyN(ioutil.Discard, transfer.reader, size); err != nil {
+				return err
+			}
+			writeErr = errNoSpace
+		} else {
+			data, err = ioutil.ReadAll(io.LimitReader(transfer.reader, size))
+			if err != nil {
+				return err
+			}
+			if int64(len(data)) != size {
+				return io.ErrUnexpectedEOF
+			}
+		}
+		if err := transfer.response(); err != nil {
+			return err
+		}
+		if writeErr == nil {
+			if _, err := context.session.cfg.Downloads.quarantine(data); err != nil {
+				log.Printf("Failed to quarantine uploaded file: %v", err)
+			}
+			writeErr = fs.WriteFile(dest, data, perm, false)
+		}
+		if writeErr == nil && transfer.opts.flags['p'] {
+			fs.Chmod(dest, perm)
+			if !mtime.IsZero() {
+				fs.Chtimes(dest, mtime)
+			}
+		}
+		mtime = time.Time{}
+		transfer.logTransfer("upload", dest, uint32(mode), data, writeErr)
+		if writeErr != nil {
+			if err := transfer.sendError("%v: %v", dest, writeErr); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := transfer.ack(); err != nil {
+			return err
+		}
+	}
+}
+
+// 发送文件 -r时包括目录
+func (transfer *scpTransfer) source() error {
+	if err := transfer.response(); err != nil {
+		return err
+	}
+	for _, operand := range transfer.opts.operands {
+		if err := transfer.send(operand, transfer.context.absPath(operand)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (transfer *scpTransfer) send(operand string, name string) error {
+	fs := transfer.context.session.fs
+	info, err := fs.Stat(name)
+	if err != nil {
+		return transfer.sendError("%v: %v", operand, err)
+	}
+	if transfer.opts.flags['p'] {
+		mtime := info.ModTime().Unix()
+		if _, err := fmt.Fprintf(transfer.context.stdout, "T%v 0 %v 0\n", mtime, mtime); err != nil {
+			return err
+		}
+		if err := transfer.response(); err != nil {
+			return err
+		}
+	}
+	mode := unixMode(info.Mode())
+	if info.IsDir() {
+		if !transfer.opts.flags['r'] {
+			return transfer.sendError("%v: not a regular file", operand)
+		}
+		entries, err := fs.ReadDir(name)
+		if err != nil {
+			return transfer.sendError("%v: %v", operand, err)
+		}
+		if _, err := fmt.Fprintf(transfer.context.stdout, "D%04o 0 %v\n", mode, path.Base(name)); err != nil {
+			return err
+		}
+		if err := transfer.response(); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := transfer.send(path.Join(operand, entry.Name()), path.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprint(transfer.context.stdout, "E\n"); err != nil {
+			return err
+		}
+		return transfer.response()
+	}
+	if info.Mode()&os.ModeType != 0 && info.Mode()&os.ModeDevice == 0 {
+		return transfer.sendError("%v: not a regular file", operand)
+	}
+	data, err := fs.ReadFile(name)
+	if err != nil {
+		return transfer.sendError("%v: %v", operand, err)
+	}
+	transfer.logTransfer("download", name, mode, data, nil)
+	if _, err := fmt.Fprintf(transfer.context.stdout, "C%04o %v %v\n", mode, len(data), path.Base(name)); err != nil {
+		return err
+	}
+	if err := transfer.response(); err != nil {
+		return err
+	}
+	if _, err := transfer.context.stdout.Write(data); err != nil {
+		return err
+	}
+	if err := transfer.ack(); err != nil {
+		return err
+	}
+	return transfer.response()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scp -t 接收客户端发送的文件 返回发给客户端的内容
+func runTestSCPSink(t *testing.T, session *shellSession, input string) (string, uint32) {
+	t.Helper()
+	var stdout, stderr strings.Builder
+	context := commandContext{stdin: newPipeReadLiner([]byte(input)), stdout: &stdout, stderr: &stderr, session: session}
+	status, err := context.runScript("scp -t /tmp/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), status
+}
+
+// 没有单个文件的大小限制时 按会话剩余的写入量限制上传的文件
+func TestSCPUploadLimits(t *testing.T) {
+	tests := []struct {
+		config string
+		size   int
+		ok     bool
+	}{
+		{"filesystem:\n  max_file_size: 100\n", 100, true},
+		{"filesystem:\n  max_file_size: 100\n", 101, false},
+		{"filesystem:\n  max_file_size: 0\n  max_session_size: 100\n", 100, true},
+		{"filesystem:\n  max_file_size: 0\n  max_session_size: 100\n", 101, false},
+		{"filesystem:\n  max_file_size: 0\n  max_session_size: 0\n", 1000, true},
+	}
+	for _, test := range tests {
+		cfg := newTestConfig(t, "recording:\n  enabled: false\ndownloads:\n  quarantine_dir: "+testDataDir+"/quarantine\n"+test.config)
+		session := newTestShellSession(cfg)
+		input := "C0644 " + strconv.Itoa(test.size) + " upload\n" + strings.Repeat("x", test.size) + "\x00"
+		stdout, status := runTestSCPSink(t, session, input)
+		data, err := session.fs.ReadFile("/tmp/upload")
+		if test.ok && (status != 0 || err != nil || len(data) != test.size) {
+			t.Errorf("%q size %v: status %v, %v bytes saved, %v (output %q)", test.config, test.size, status, len(data), err, stdout)
+		}
+		if !test.ok && (status != 1 || err == nil || !strings.Contains(stdout, "\x01scp: /tmp/upload: "+errNoSpace.Error())) {
+			t.Errorf("%q size %v: status %v, file %v, output %q, want no space error", test.config, test.size, status, err, stdout)
+		}
+	}
+
+	// 已经写入的数据计入会话的写入总量
+	cfg := newTestConfig(t, "recording:\n  enabled: false\ndownloads:\n  quarantine_dir: "+testDataDir+"/quarantine\nfilesystem:\n  max_file_size: 0\n  max_session_size: 100\n")
+	session := newTestShellSession(cfg)
+	runTestScript(t, session, "echo "+strings.Repeat("y", 59)+" > /tmp/other")
+	if stdout, status := runTestSCPSink(t, session, "C0644 41 upload\n"+strings.Repeat("x", 41)+"\x00"); status != 1 {
+		t.Errorf("upload over the remaining session quota: status %v, output %q", status, stdout)
+	}
+
+	// 声明的大小远大于实际发送的数据时不预先分配内存
+	cfg = newTestConfig(t, "recording:\n  enabled: false\nfilesystem:\n  max_file_size: 0\n  max_session_size: 0\n")
+	if _, status := runTestSCPSink(t, newTestShellSession(cfg), "C0644 1099511627776 upload\nxxxx"); status != 1 {
+		t.Errorf("truncated upload: status %v, want 1", status)
+	}
+}
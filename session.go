@@ -6,6 +6,7 @@ import (
 
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"strings"
@@ -181,27 +182,33 @@ var sessionRequestParsers = map[string]channelRequestPayloadParser{
 
 type sessionContext struct {
 	ssh.Channel
-	inputChan chan string
-	errorChan chan error
-	active    bool
-	pty       bool
+	context       channelContext
+	inputChan     chan string
+	errorChan     chan error
+	active        bool
+	pty           bool
+	term          string
+	width, height uint32
+	recorder      *sessionRecorder // 录像 未启用录像或者没有运行程序时为nil
 }
 
-type scannerReadLiner struct {
-	scanner   *bufio.Scanner
+// 没有终端时从通道按行读取 也可以直接读取原始数据 例如scp
+type channelReadLiner struct {
+	*bufio.Reader
 	inputChan chan<- string
 }
 
-func (r scannerReadLiner) ReadLine() (string, error) {
-	if !r.scanner.Scan() {
-		if err := r.scanner.Err(); err != nil {
-			return "", err
-		}
-		return "", io.EOF
+func (r channelReadLiner) ReadLine() (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", bufio.ErrTooLong
+	}
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", err
 	}
-	line := r.scanner.Text()
-	r.inputChan <- line
-	return line, nil
+	text := strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r")
+	r.inputChan <- text
+	return text, nil
 }
 
 type terminalReadLiner struct {
@@ -223,47 +230,110 @@ func (channel *sessionContext) handleProgram(program []string) bool {
 		return false
 	}
 	channel.active = true
+	stream := channel.startRecording(program)
 	var stdin readLiner
 	var stdout, stderr io.Writer
 	if channel.pty {
-		terminal := term.NewTerminal(channel, "")
+		terminal := term.NewTerminal(stream, "")
 		stdin = terminalReadLiner{terminal, channel.inputChan}
 		stdout = terminal
 		stderr = terminal
 	} else {
-		stdin = scannerReadLiner{bufio.NewScanner(channel), channel.inputChan}
-		stdout = channel
-		stderr = channel.Stderr()
+		stdin = channelReadLiner{bufio.NewReaderSize(stream, bufio.MaxScanTokenSize), channel.inputChan}
+		stdout = stream
+		stderr = stream.Stderr()
 	}
 	go func() {
 		defer close(channel.inputChan)
 		defer close(channel.errorChan)
-		result, err := executeProgram(commandContext{program, stdin, stdout, stderr, channel.pty})
+		result, err := executeProgram(commandContext{program, stdin, stdout, stderr, channel.pty, newShellSession(channel.context)})
 		if err == io.EOF {
 			err = nil
 		}
 		if err == nil && channel.pty {
-			_, err = channel.Write([]byte("\r\n"))
+			_, err = stream.Write([]byte("\r\n"))
 		}
 		if err == nil {
-			_, err = channel.SendRequest("exit-status", false, ssh.Marshal(struct {
-				ExitStatus uint32
-			}{result}))
-		}
-		if err == nil && channel.pty {
-			_, err = channel.SendRequest("eow@openssh.com", false, nil)
+			err = channel.exit(result)
 		}
-		if err == nil {
-			err = channel.CloseWrite()
+		channel.errorChan <- err
+	}()
+	return true
+}
+
+// 开始录制 返回程序使用的通道 未启用录像时为原来的通道
+func (channel *sessionContext) startRecording(program []string) ssh.Channel {
+	cfg := channel.context.cfg.Recording
+	if !cfg.Enabled {
+		return channel.Channel
+	}
+	header := asciicastHeader{
+		Width:  channel.width,
+		Height: channel.height,
+		Title:  fmt.Sprintf("%v@%v", channel.context.User(), channel.context.cfg.Persona.Hostname),
+		Env:    map[string]string{"SHELL": "/bin/bash"},
+
+		RemoteAddr: channel.context.RemoteAddr().String(),
+		User:       channel.context.User(),
+	}
+	if !channel.pty {
+		header.Width, header.Height = 80, 24
+	}
+	if channel.term != "" {
+		header.Env["TERM"] = channel.term
+	}
+	// exec请求的命令
+	if len(program) == 3 && program[1] == "-c" {
+		header.Command = program[2]
+	}
+	recorder, err := newSessionRecorder(cfg, channel.context.sessionID, header)
+	if err != nil {
+		log.Printf("Failed to start session recording: %v", err)
+		return channel.Channel
+	}
+	channel.recorder = recorder
+	return recordingChannel{channel.Channel, recorder}
+}
+
+// sftp子系统 直接处理通道中的数据 不经过终端
+func (channel *sessionContext) handleSFTP() bool {
+	if channel.active {
+		log.Printf("A program is already active")
+		return false
+	}
+	channel.active = true
+	go func() {
+		defer close(channel.inputChan)
+		defer close(channel.errorChan)
+		err := newSFTPServer(channel.context, channel).serve()
+		if err == io.EOF {
+			err = nil
 		}
 		if err == nil {
-			err = channel.Close()
+			err = channel.exit(0)
 		}
 		channel.errorChan <- err
 	}()
 	return true
 }
 
+// 发送退出状态并关闭通道
+func (channel *sessionContext) exit(status uint32) error {
+	_, err := channel.SendRequest("exit-status", false, ssh.Marshal(struct {
+		ExitStatus uint32
+	}{status}))
+	if err == nil && channel.pty {
+		_, err = channel.SendRequest("eow@openssh.com", false, nil)
+	}
+	if err == nil {
+		err = channel.CloseWrite()
+	}
+	if err == nil {
+		err = channel.Close()
+	}
+	return err
+}
+
 func (channel *sessionContext) handleRequest(request interface{}) (bool, error) {
 	switch payload := request.(type) {
 	case *ptyRequest:
@@ -271,16 +341,27 @@ func (channel *sessionContext) handleRequest(request interface{}) (bool, error)
 			return false, errors.New("a pty-req request was already sent")
 		}
 		channel.pty = true
+		channel.term = payload.Term
+		channel.width, channel.height = payload.Width, payload.Height
+	case *windowChangeRequestPayload:
+		channel.width, channel.height = payload.Width, payload.Height
+		if channel.recorder != nil {
+			channel.recorder.resize(payload.Width, payload.Height)
+		}
 	case *shellRequest:
 		if !channel.handleProgram(shellProgram) {
 			return false, nil
 		}
 	case *execRequestPayload:
-		if !channel.handleProgram(strings.Fields(payload.Command)) {
+		if !channel.handleProgram([]string{"sh", "-c", payload.Command}) {
 			return false, nil
 		}
 	case *subsystemRequestPayload:
-		if !channel.handleProgram(strings.Fields(payload.Subsystem)) {
+		if payload.Subsystem == "sftp" {
+			if !channel.handleSFTP() {
+				return false, nil
+			}
+		} else if !channel.handleProgram(strings.Fields(payload.Subsystem)) {
 			return false, nil
 		}
 	}
@@ -298,20 +379,30 @@ func handleSessionChannel(newChannel ssh.NewChannel, context channelContext) err
 	if err != nil {
 		return err
 	}
+	context.fs = newSessionFilesystem(context.cfg, context.User())
 	context.logEvent(sessionLog{
 		channelLog: channelLog{
 			ChannelID: context.channelID,
 		},
 	})
-	defer context.logEvent(sessionCloseLog{
-		channelLog: channelLog{
-			ChannelID: context.channelID,
-		},
-	})
 
 	inputChan := make(chan string)
 	errorChan := make(chan error)
-	session := sessionContext{channel, inputChan, errorChan, false, false}
+	session := sessionContext{Channel: channel, context: context, inputChan: inputChan, errorChan: errorChan}
+	defer func() {
+		entry := sessionCloseLog{
+			channelLog: channelLog{
+				ChannelID: context.channelID,
+			},
+		}
+		if session.recorder != nil {
+			if err := session.recorder.Close(); err != nil {
+				log.Printf("Failed to close session recording: %v", err)
+			}
+			entry.Recording = session.recorder.path
+		}
+		context.logEvent(entry)
+	}()
 
 	for inputChan != nil || errorChan != nil || requests != nil {
 		select {
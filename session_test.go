@@ -0,0 +1,30 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"strings"
+	"testing"
+)
+
+// 同一连接的不同会话使用各自的文件系统
+func TestSessionsHaveSeparateFilesystems(t *testing.T) {
+	cfg := newTestConfig(t, "recording:\n  enabled: false\n")
+	client, wait := dialTestServer(t, cfg, &ssh.ClientConfig{User: "root", Auth: []ssh.AuthMethod{ssh.Password("root")}})
+	defer wait()
+	run := func(command string) string {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.Close()
+		output, _ := session.CombinedOutput(command)
+		return string(output)
+	}
+	if output := run("echo secret > /tmp/a && cat /tmp/a"); output != "secret\n" {
+		t.Fatalf("first session output = %q", output)
+	}
+	if output := run("cat /tmp/a"); !strings.Contains(output, "No such file or directory") {
+		t.Errorf("second session output = %q, want No such file or directory", output)
+	}
+}
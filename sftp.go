@@ -0,0 +1,900 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SFTP第3版的消息类型
+const (
+	sftpInit          = 1
+	sftpVersion       = 2
+	sftpOpen          = 3
+	sftpClose         = 4
+	sftpRead          = 5
+	sftpWrite         = 6
+	sftpLstat         = 7
+	sftpFstat         = 8
+	sftpSetstat       = 9
+	sftpFsetstat      = 10
+	sftpOpendir       = 11
+	sftpReaddir       = 12
+	sftpRemove        = 13
+	sftpMkdir         = 14
+	sftpRmdir         = 15
+	sftpRealpath      = 16
+	sftpStat          = 17
+	sftpRename        = 18
+	sftpReadlink      = 19
+	sftpSymlink       = 20
+	sftpStatus        = 101
+	sftpHandle        = 102
+	sftpData          = 103
+	sftpName          = 104
+	sftpAttrs         = 105
+	sftpExtended      = 200
+	sftpExtendedReply = 201
+)
+
+// 状态码
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+// 打开文件的标志
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+)
+
+// 文件属性中包含的字段
+const (
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	sftpMaxPacket  = 256 * 1024
+	sftpMaxRead    = sftpMaxPacket - 1024
+	sftpReaddirMax = 100 // 每个READDIR回复的最大条目数
+	sftpMaxHandles = 512 // 与OpenSSH的sftp-server相同
+)
+
+// 新建文件和目录时去掉的权限 与sshd的默认umask相同
+const defaultUmask = 0022
+
+var sftpStatusMessages = map[uint32]string{
+	sftpOK:               "Success",
+	sftpEOF:              "End of file",
+	sftpNoSuchFile:       "No such file",
+	sftpPermissionDenied: "Permission denied",
+	sftpFailure:          "Failure",
+	sftpBadMessage:       "Bad message",
+	sftpOpUnsupported:    "Operation unsupported",
+}
+
+var (
+	errBadMessage     = errors.New("bad message")
+	errTooManyHandles = errors.New("Too many open files")
+)
+
+// 与OpenSSH的sftp-server一样声明的扩展
+var sftpExtensions = []struct{ name, version string }{
+	{"posix-rename@openssh.com", "1"},
+	{"statvfs@openssh.com", "2"},
+	{"fsync@openssh.com", "1"},
+}
+
+// 请求数据的解析 出错后所有读取返回零值
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.data) < 4 {
+		r.err = errBadMessage
+		return 0
+	}
+	value := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return value
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if len(r.data) < 8 {
+		r.err = errBadMessage
+		return 0
+	}
+	value := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return value
+}
+
+func (r *sftpReader) string() string {
+	length := r.uint32()
+	if uint32(len(r.data)) < length {
+		r.err = errBadMessage
+		return ""
+	}
+	value := string(r.data[:length])
+	r.data = r.data[length:]
+	return value
+}
+
+type sftpFileAttrs struct {
+	flags       uint32
+	size        uint64
+	permissions uint32
+	mtime       uint32
+}
+
+func (r *sftpReader) attrs() sftpFileAttrs {
+	attrs := sftpFileAttrs{flags: r.uint32()}
+	if attrs.flags&sftpAttrSize != 0 {
+		attrs.size = r.uint64()
+	}
+	if attrs.flags&sftpAttrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if attrs.flags&sftpAttrPermissions != 0 {
+		attrs.permissions = r.uint32()
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		r.uint32()
+		attrs.mtime = r.uint32()
+	}
+	if attrs.flags&sftpAttrExtended != 0 {
+		for count := r.uint32(); count > 0 && r.err == nil; count-- {
+			r.string()
+			r.string()
+		}
+	}
+	return attrs
+}
+
+// 回复数据的构造
+type sftpPacket []byte
+
+func (p sftpPacket) uint32(value uint32) sftpPacket {
+	return append(p, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func (p sftpPacket) uint64(value uint64) sftpPacket {
+	return p.uint32(uint32(value >> 32)).uint32(uint32(value))
+}
+
+func (p sftpPacket) string(value string) sftpPacket {
+	return append(p.uint32(uint32(len(value))), value...)
+}
+
+// 打开的文件或目录
+// 文件内容在打开时读入 写入的内容在关闭时保存到虚拟文件系统
+type sftpOpenFile struct {
+	path     string
+	flags    uint32
+	dir      bool
+	entries  []vfsFileInfo // 目录中尚未返回的条目
+	data     []byte
+	modified bool
+	read     int64 // 读取的字节数
+}
+
+// sftp子系统 实现SFTP第3版 所有操作都在会话的虚拟文件系统中进行
+type sftpServer struct {
+	context    channelContext
+	channel    io.ReadWriter
+	home       string
+	handles    map[string]*sftpOpenFile
+	nextHandle int
+	uids, gids map[string]uint32
+}
+
+func newSFTPServer(context channelContext, channel io.ReadWriter) *sftpServer {
+	server := &sftpServer{
+		context: context,
+		channel: channel,
+		home:    context.loginDir(),
+		handles: map[string]*sftpOpenFile{},
+		uids:    map[string]uint32{},
+		gids:    map[string]uint32{},
+	}
+	// 文件属性中的uid和gid从/etc/passwd和/etc/group中查找
+	for file, ids := range map[string]map[string]uint32{"/etc/passwd": server.uids, "/etc/group": server.gids} {
+		data, err := context.fs.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Split(line, ":")
+			if len(fields) < 3 {
+				continue
+			}
+			if id, err := strconv.ParseUint(fields[2], 10, 32); err == nil {
+				ids[fields[0]] = uint32(id)
+			}
+		}
+	}
+	return server
+}
+
+func (server *sftpServer) logEvent(entry sftpLog) {
+	entry.ChannelID = server.context.channelID
+	server.context.logEvent(entry)
+}
+
+func (server *sftpServer) serve() error {
+	// 未关闭的句柄在退出时同样保存
+	defer func() {
+		for id := range server.handles {
+			server.closeHandle(id)
+		}
+	}()
+	for {
+		packet, err := server.readPacket()
+		if err != nil {
+			return err
+		}
+		if err := server.handlePacket(packet); err != nil {
+			return err
+		}
+	}
+}
+
+func (server *sftpServer) readPacket() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(server.channel, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length == 0 || length > sftpMaxPacket {
+		return nil, fmt.Errorf("invalid SFTP packet length %v", length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(server.channel, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func (server *sftpServer) send(packet sftpPacket) error {
+	_, err := server.channel.Write(append(sftpPacket(nil).uint32(uint32(len(packet))), packet...))
+	return err
+}
+
+func (server *sftpServer) sendStatus(id uint32, code uint32, message string) error {
+	if message == "" {
+		message = sftpStatusMessages[code]
+	}
+	return server.send(sftpPacket{sftpStatus}.uint32(id).uint32(code).string(message).string(""))
+}
+
+// 把虚拟文件系统的错误转换为状态码
+func (server *sftpServer) sendError(id uint32, err error) error {
+	if err == errNoSuchFile {
+		return server.sendStatus(id, sftpNoSuchFile, "")
+	}
+	return server.sendStatus(id, sftpFailure, err.Error())
+}
+
+func (server *sftpServer) sendHandle(id uint32, handle string) error {
+	return server.send(sftpPacket{sftpHandle}.uint32(id).string(handle))
+}
+
+// 只有一个条目的NAME回复 用于REALPATH和READLINK
+func (server *sftpServer) sendName(id uint32, name string) error {
+	return server.send(sftpPacket{sftpName}.uint32(id).uint32(1).string(name).string(name).uint32(0))
+}
+
+func (server *sftpServer) attrs(packet sftpPacket, info vfsFileInfo) sftpPacket {
+	permissions := unixMode(info.mode)
+	switch {
+	case info.mode.IsDir():
+		permissions |= 0040000
+	case info.mode&os.ModeSymlink != 0:
+		permissions |= 0120000
+	case info.mode&os.ModeCharDevice != 0:
+		permissions |= 0020000
+	case info.mode&os.ModeDevice != 0:
+		permissions |= 0060000
+	case info.mode&os.ModeNamedPipe != 0:
+		permissions |= 0010000
+	default:
+		permissions |= 0100000
+	}
+	uid, ok := server.uids[info.user]
+	if !ok {
+		uid = 1000
+	}
+	gid, ok := server.gids[info.group]
+	if !ok {
+		gid = 1000
+	}
+	mtime := uint32(info.mtime.Unix())
+	return packet.uint32(sftpAttrSize | sftpAttrUIDGID | sftpAttrPermissions | sftpAttrACModTime).
+		uint64(uint64(info.size)).uint32(uid).uint32(gid).uint32(permissions).uint32(mtime).uint32(mtime)
+}
+
+// 相对路径相对于主目录
+func (server *sftpServer) absPath(name string) string {
+	if path.IsAbs(name) {
+		return path.Clean(name)
+	}
+	return path.Join(server.home, name)
+}
+
+func (server *sftpServer) handlePacket(packet []byte) error {
+	r := &sftpReader{data: packet[1:]}
+	if packet[0] == sftpInit {
+		// 客户端的版本高于3时使用3
+		r.uint32()
+		reply := sftpPacket{sftpVersion}.uint32(3)
+		for _, extension := range sftpExtensions {
+			reply = reply.string(extension.name).string(extension.version)
+		}
+		return server.send(reply)
+	}
+	id := r.uint32()
+	if r.err != nil {
+		return r.err
+	}
+	switch packet[0] {
+	case sftpOpen:
+		name, flags, attrs := server.absPath(r.string()), r.uint32(), r.attrs()
+		if r.err != nil {
+			break
+		}
+		return server.open(id, name, flags, attrs)
+	case sftpClose:
+		handle := r.string()
+		if r.err != nil {
+			break
+		}
+		if _, ok := server.handles[handle]; !ok {
+			return server.sendStatus(id, sftpFailure, "")
+		}
+		if err := server.closeHandle(handle); err != nil {
+			return server.sendError(id, err)
+		}
+		return server.sendStatus(id, sftpOK, "")
+	case sftpRead:
+		handle, offset, length := r.string(), r.uint64(), r.uint32()
+		if r.err != nil {
+			break
+		}
+		return server.read(id, handle, offset, length)
+	case sftpWrite:
+		handle, offset, data := r.string(), r.uint64(), r.string()
+		if r.err != nil {
+			break
+		}
+		return server.write(id, handle, offset, []byte(data))
+	case sftpStat, sftpLstat:
+		name := server.absPath(r.string())
+		if r.err != nil {
+			break
+		}
+		operation, stat := "stat", server.context.fs.Stat
+		if packet[0] == sftpLstat {
+			operation, stat = "lstat", server.context.fs.Lstat
+		}
+		info, err := stat(name)
+		server.logEvent(sftpLog{Operation: operation, Path: name, Error: errorString(err)})
+		if err != nil {
+			return server.sendError(id, err)
+		}
+		return server.send(server.attrs(sftpPacket{sftpAttrs}.uint32(id), info))
+	case sftpFstat:
+		handle := server.handles[r.string()]
+		if r.err != nil {
+			break
+		}
+		if handle == nil {
+			return server.sendStatus(id, sftpFailure, "")
+		}
+		info, err := server.context.fs.Stat(handle.path)
+		server.logEvent(sftpLog{Operation: "fstat", Path: handle.path, Error: errorString(err)})
+		if err != nil {
+			return server.sendError(id, err)
+		}
+		if !handle.dir {
+			info.size = int64(len(handle.data))
+		}
+		return server.send(server.attrs(sftpPacket{sftpAttrs}.uint32(id), info))
+	case sftpSetstat:
+		name, attrs := server.absPath(r.string()), r.attrs()
+		if r.err != nil {
+			break
+		}
+		return server.setstat(id, name, nil, attrs)
+	case sftpFsetstat:
+		handle, attrs := server.handles[r.string()], r.attrs()
+		if r.err != nil {
+			break
+		}
+		if handle == nil {
+			return server.sendStatus(id, sftpFailure, "")
+		}
+		return server.setstat(id, handle.path, handle, attrs)
+	case sftpOpendir:
+		name := server.absPath(r.string())
+		if r.err != nil {
+			break
+		}
+		return server.opendir(id, name)
+	case sftpReaddir:
+		handle := r.string()
+		if r.err != nil {
+			break
+		}
+		return server.readdir(id, handle)
+	case sftpRemove:
+		name := server.absPath(r.string())
+		if r.err != nil {
+			break
+		}
+		err := errIsDir
+		if info, statErr := server.context.fs.Lstat(name); statErr != nil {
+			err = statErr
+		} else if !info.IsDir() {
+			err = server.context.fs.Remove(name)
+		}
+		server.logEvent(sftpLog{Operation: "remove", Path: name, Error: errorString(err)})
+		if err != nil {
+			return server.sendError(id, err)
+		}
+		return server.sendStatus(id, sftpOK, "")
+	case sftpMkdir:
+		name, attrs := server.absPath(r.string()), r.attrs()
+		if r.err != nil {
+			break
+		}
+		perm := os.FileMode(0755)
+		if attrs.flags&sftpAttrPermissions != 0 {
+			perm = fileModeFromUnix(attrs.permissions &^ defaultUmask)
+		}
+		err := server.context.fs.Mkdir(name, perm)
+		server.logEvent(sftpLog{Operation: "mkdir", Path: name, Error: errorString(err)})
+		if err != nil {
+			return server.sendError(id, err)
+		}
+		return server.sendStatus(id, sftpOK, "")
+	case sftpRmdir:
+		name := server.absPath(r.string())
+		if r.err != nil {
+			break
+		}
+		err := errNotDir
+		if info, statErr := server.context.fs.Lstat(name); statErr != nil {
+			err = statErr
+		} else if info.IsDir() {
+			err = server.context.fs.Remove(name)
+		}
+		server.logEvent(sftpLog{Operation: "rmdir", Path: name, Error: errorString(err)})
+		if err != nil {
+			return server.sendError(id, err)
+		}
+		return server.sendStatus(id, sftpOK, "")
+	case sftpRealpath:
+		name := server.absPath(r.string())
+		if r.err != nil {
+			break
+		}
+		// 与新版的OpenSSH一样 最后一部分不存在时也返回结果
+		if resolved, err := server.context.fs.Realpath(name); err == nil {
+			name = resolved
+		} else if err != errNoSuchFile {
+			return server.sendError(id, err)
+		}
+		return server.sendName(id, name)
+	case sftpRename:
+		oldName, newName := server.absPath(r.string()), server.absPath(r.string())
+		if r.err != nil {
+			break
+		}
+		return server.rename(id, oldName, newName, false)
+	case sftpReadlink:
+		name := server.absPath(r.string())
+		if r.err != nil {
+			break
+		}
+		target, err := server.context.fs.Readlink(name)
+		server.logEvent(sftpLog{Operation: "readlink", Path: name, Error: errorString(err)})
+		if err != nil {
+			return server.sendError(id, err)
+		}
+		return server.sendName(id, target)
+	case sftpSymlink:
+		// OpenSSH的参数顺序与协议草案相反 先是链接的目标
+		target, name := r.string(), server.absPath(r.string())
+		if r.err != nil {
+			break
+		}
+		err := server.context.fs.Symlink(target, name)
+		server.logEvent(sftpLog{Operation: "symlink", Path: name, Target: target, Error: errorString(err)})
+		if err != nil {
+			return server.sendError(id, err)
+		}
+		return server.sendStatus(id, sftpOK, "")
+	case sftpExtended:
+		extension := r.string()
+		if r.err != nil {
+			break
+		}
+		return server.extended(id, extension, r)
+	default:
+		log.Printf("Unsupported SFTP packet type %v", packet[0])
+		return server.sendStatus(id, sftpOpUnsupported, "")
+	}
+	return server.sendStatus(id, sftpBadMessage, "")
+}
+
+func (server *sftpServer) addHandle(handle *sftpOpenFile) string {
+	id := strconv.Itoa(server.nextHandle)
+	server.nextHandle++
+	server.handles[id] = handle
+	return id
+}
+
+func (server *sftpServer) open(id uint32, name string, flags uint32, attrs sftpFileAttrs) error {
+	entry := sftpLog{Operation: "open", Path: name, Flags: sftpOpenFlags(flags)}
+	var handle *sftpOpenFile
+	err := errTooManyHandles
+	if len(server.handles) < sftpMaxHandles {
+		handle, err = server.openFile(name, flags, attrs)
+	}
+	entry.Error = errorString(err)
+	server.logEvent(entry)
+	if err != nil {
+		return server.sendError(id, err)
+	}
+	return server.sendHandle(id, server.addHandle(handle))
+}
+
+func (server *sftpServer) openFile(name string, flags uint32, attrs sftpFileAttrs) (*sftpOpenFile, error) {
+	fs := server.context.fs
+	info, err := fs.Stat(name)
+	exists := err == nil
+	if err != nil && err != errNoSuchFile {
+		return nil, err
+	}
+	if exists && info.IsDir() {
+		return nil, errIsDir
+	}
+	handle := &sftpOpenFile{path: name, flags: flags}
+	if flags&sftpFlagWrite == 0 {
+		if !exists {
+			return nil, errNoSuchFile
+		}
+		handle.data, err = fs.ReadFile(name)
+		return handle, err
+	}
+	if exists && flags&sftpFlagCreate != 0 && flags&sftpFlagExcl != 0 {
+		return nil, errFileExists
+	}
+	if !exists && flags&sftpFlagCreate == 0 {
+		return nil, errNoSuchFile
+	}
+	if exists && flags&sftpFlagTrunc == 0 {
+		data, err := fs.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := server.checkSize(handle, uint64(len(data))); err != nil {
+			return nil, err
+		}
+		handle.data = append([]byte(nil), data...)
+		return handle, nil
+	}
+	// 新建或截断的文件立即出现在文件系统中
+	perm := os.FileMode(0644)
+	if attrs.flags&sftpAttrPermissions != 0 {
+		perm = fileModeFromUnix(attrs.permissions &^ defaultUmask)
+	}
+	if err := fs.WriteFile(name, nil, perm, false); err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
+
+// 打开文件的标志 用于记录日志
+func sftpOpenFlags(flags uint32) string {
+	var names []string
+	for _, flag := range []struct {
+		bit  uint32
+		name string
+	}{{sftpFlagRead, "read"}, {sftpFlagWrite, "write"}, {sftpFlagAppend, "append"}, {sftpFlagCreate, "create"}, {sftpFlagTrunc, "truncate"}, {sftpFlagExcl, "exclusive"}} {
+		if flags&flag.bit != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (server *sftpServer) read(id uint32, handleID string, offset uint64, length uint32) error {
+	handle := server.handles[handleID]
+	if handle == nil || handle.dir {
+		return server.sendStatus(id, sftpFailure, "")
+	}
+	if offset >= uint64(len(handle.data)) {
+		return server.sendStatus(id, sftpEOF, "")
+	}
+	if length > sftpMaxRead {
+		length = sftpMaxRead
+	}
+	end := offset + uint64(length)
+	if end > uint64(len(handle.data)) {
+		end = uint64(len(handle.data))
+	}
+	handle.read += int64(end - offset)
+	return server.send(sftpPacket{sftpData}.uint32(id).string(string(handle.data[offset:end])))
+}
+
+func (server *sftpServer) write(id uint32, handleID string, offset uint64, data []byte) error {
+	handle := server.handles[handleID]
+	if handle == nil || handle.dir || handle.flags&sftpFlagWrite == 0 {
+		return server.sendStatus(id, sftpFailure, "")
+	}
+	if handle.flags&sftpFlagAppend != 0 {
+		offset = uint64(len(handle.data))
+	}
+	end := offset + uint64(len(data))
+	if end < offset {
+		return server.sendError(id, errNoSpace)
+	}
+	if err := server.checkSize(handle, end); err != nil {
+		return server.sendError(id, err)
+	}
+	if end > uint64(len(handle.data)) {
+		// 可写句柄的数据只属于该句柄 直接追加 顺序上传时不会每次复制整个文件
+		handle.data = append(handle.data, make([]byte, end-uint64(len(handle.data)))...)
+	}
+	copy(handle.data[offset:], data)
+	handle.modified = true
+	return server.sendStatus(id, sftpOK, "")
+}
+
+// 保存写入的内容 上传的文件同时保存到隔离目录
+func (server *sftpServer) flush(handle *sftpOpenFile) error {
+	if !handle.modified {
+		return nil
+	}
+	handle.modified = false
+	entry := sftpLog{Operation: "write", Path: handle.path, Size: int64(len(handle.data))}
+	sha, err := server.context.cfg.Downloads.quarantine(handle.data)
+	entry.SHA256 = sha
+	if err != nil {
+		log.Printf("Failed to quarantine uploaded file: %v", err)
+	}
+	err = server.context.fs.WriteFile(handle.path, handle.data, 0644, false)
+	entry.Error = errorString(err)
+	server.logEvent(entry)
+	return err
+}
+
+func (server *sftpServer) closeHandle(id string) error {
+	handle := server.handles[id]
+	delete(server.handles, id)
+	if handle.read > 0 {
+		server.logEvent(sftpLog{Operation: "read", Path: handle.path, Size: handle.read})
+	}
+	return server.flush(handle)
+}
+
+func (server *sftpServer) setstat(id uint32, name string, handle *sftpOpenFile, attrs sftpFileAttrs) error {
+	fs := server.context.fs
+	err := func() error {
+		if attrs.flags&sftpAttrSize != 0 {
+			if handle != nil && handle.dir {
+				handle = nil
+			}
+			if err := server.checkSize(handle, attrs.size); err != nil {
+				return err
+			}
+			if handle != nil {
+				handle.data = resizeData(handle.data, attrs.size)
+				handle.modified = true
+			} else {
+				data, err := fs.ReadFile(name)
+				if err != nil {
+					return err
+				}
+				if err := fs.WriteFile(name, resizeData(data, attrs.size), 0644, false); err != nil {
+					return err
+				}
+			}
+		}
+		if attrs.flags&sftpAttrPermissions != 0 {
+			if err := fs.Chmod(name, fileModeFromUnix(attrs.permissions)); err != nil {
+				return err
+			}
+		}
+		if attrs.flags&sftpAttrACModTime != 0 {
+			if err := fs.Chtimes(name, time.Unix(int64(attrs.mtime), 0)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	server.logEvent(sftpLog{Operation: "setstat", Path: name, Error: errorString(err)})
+	if err != nil {
+		return server.sendError(id, err)
+	}
+	return server.sendStatus(id, sftpOK, "")
+}
+
+func (server *sftpServer) opendir(id uint32, name string) error {
+	fs := server.context.fs
+	info, err := fs.Stat(name)
+	if err == nil && !info.IsDir() {
+		err = errNotDir
+	}
+	if err == nil && len(server.handles) >= sftpMaxHandles {
+		err = errTooManyHandles
+	}
+	var entries []vfsFileInfo
+	if err == nil {
+		entries, err = fs.ReadDir(name)
+	}
+	server.logEvent(sftpLog{Operation: "opendir", Path: name, Error: errorString(err)})
+	if err != nil {
+		return server.sendError(id, err)
+	}
+	// 与readdir(3)一样包含.和..
+	parent, _ := fs.Stat(path.Dir(name))
+	parent.name = ".."
+	info.name = "."
+	handle := &sftpOpenFile{path: name, dir: true, entries: append([]vfsFileInfo{info, parent}, entries...)}
+	return server.sendHandle(id, server.addHandle(handle))
+}
+
+func (server *sftpServer) readdir(id uint32, handleID string) error {
+	handle := server.handles[handleID]
+	if handle == nil || !handle.dir {
+		return server.sendStatus(id, sftpFailure, "")
+	}
+	if len(handle.entries) == 0 {
+		return server.sendStatus(id, sftpEOF, "")
+	}
+	count := len(handle.entries)
+	if count > sftpReaddirMax {
+		count = sftpReaddirMax
+	}
+	reply := sftpPacket{sftpName}.uint32(id).uint32(uint32(count))
+	for _, info := range handle.entries[:count] {
+		// 与OpenSSH一样longname使用ls -l的格式
+		longname := fmt.Sprintf("%v %3v %-8v %-8v %8v %v %v", formatMode(info.mode), info.nlink, info.user, info.group, info.size, formatTime(info.mtime), info.name)
+		reply = server.attrs(reply.string(info.name).string(longname), info)
+	}
+	handle.entries = handle.entries[count:]
+	return server.send(reply)
+}
+
+// posix为false时与SFTP协议一样 目标存在时失败
+func (server *sftpServer) rename(id uint32, oldName string, newName string, posix bool) error {
+	fs := server.context.fs
+	var err error
+	if _, statErr := fs.Lstat(newName); statErr == nil && !posix {
+		err = errFileExists
+	} else {
+		err = fs.Rename(oldName, newName)
+	}
+	server.logEvent(sftpLog{Operation: "rename", Path: oldName, Target: newName, Error: errorString(err)})
+	if err != nil {
+		return server.sendError(id, err)
+	}
+	return server.sendStatus(id, sftpOK, "")
+}
+
+func (server *sftpServer) extended(id uint32, extension string, r *sftpReader) error {
+	switch extension {
+	case "posix-rename@openssh.com":
+		oldName, newName := server.absPath(r.string()), server.absPath(r.string())
+		if r.err != nil {
+			break
+		}
+		return server.rename(id, oldName, newName, true)
+	case "statvfs@openssh.com":
+		r.string()
+		if r.err != nil {
+			break
+		}
+		// 与df一样由persona中的磁盘信息生成
+		disk := server.context.cfg.Persona.Disk
+		const blockSize = 4096
+		blocks := uint64(disk.SizeGB) * 1024 * 1024 * 1024 / blockSize
+		free := blocks - uint64(disk.UsedGB)*1024*1024*1024/blockSize
+		// 与ext4一样保留5%给root 磁盘快满时普通用户可用的空间为0
+		var available uint64
+		if reserved := blocks / 20; free > reserved {
+			available = free - reserved
+		}
+		files := blocks / 4
+		reply := sftpPacket{sftpExtendedReply}.uint32(id).uint64(blockSize).uint64(blockSize).
+			uint64(blocks).uint64(free).uint64(available).uint64(files).uint64(files * 9 / 10).uint64(files * 9 / 10).
+			uint64(0x8d6b1e2a5c3f4e71).uint64(0).uint64(255)
+		return server.send(reply)
+	case "fsync@openssh.com":
+		handle := server.handles[r.string()]
+		if r.err != nil {
+			break
+		}
+		if handle == nil {
+			return server.sendStatus(id, sftpFailure, "")
+		}
+		if err := server.flush(handle); err != nil {
+			return server.sendError(id, err)
+		}
+		return server.sendStatus(id, sftpOK, "")
+	default:
+		log.Printf("Unsupported SFTP extension %v", extension)
+		return server.sendStatus(id, sftpOpUnsupported, "")
+	}
+	return server.sendStatus(id, sftpBadMessage, "")
+}
+
+// 检查句柄中缓存的数据能否增长到size 为nil时只检查单个文件的大小
+// 句柄中缓存的数据在写入时就计入会话的写入总量 不等到保存到虚拟文件系统
+// 客户端指定的偏移和大小在分配内存前检查
+func (server *sftpServer) checkSize(handle *sftpOpenFile, size uint64) error {
+	if size > uint64(server.context.cfg.Filesystem.maxUploadSize()) {
+		return errNoSpace
+	}
+	if handle == nil || size <= uint64(len(handle.data)) {
+		return nil
+	}
+	used := int64(size) - int64(len(handle.data))
+	for _, other := range server.handles {
+		if !other.dir && other.flags&sftpFlagWrite != 0 {
+			used += int64(len(other.data))
+		}
+	}
+	limit := server.context.cfg.Filesystem.MaxSessionSize
+	if limit > 0 {
+		used += server.context.fs.Written()
+	} else {
+		limit = maxBufferedUpload
+	}
+	if used > limit {
+		return errNoSpace
+	}
+	return nil
+}
+
+// 截断或者用0填充到指定大小 返回新的切片
+func resizeData(data []byte, size uint64) []byte {
+	if size <= uint64(len(data)) {
+		return append([]byte(nil), data[:size]...)
+	}
+	return append(append(make([]byte, 0, size), data...), make([]byte, size-uint64(len(data)))...)
+}
+
+// 错误信息 没有错误时为空
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"testing"
+)
+
+// 直接向sftpServer发送数据包 回复写入缓冲区
+type sftpTestClient struct {
+	t      *testing.T
+	server *sftpServer
+	output bytes.Buffer
+	nextID uint32
+}
+
+func newSFTPTestClient(t *testing.T, configString string) *sftpTestClient {
+	t.Helper()
+	cfg := newTestConfig(t, fmt.Sprintf("recording:\n  enabled: false\ndownloads:\n  quarantine_dir: %v\n%v", path.Join(testDataDir, "quarantine"), configString))
+	client := &sftpTestClient{t: t}
+	client.server = newSFTPServer(newTestChannelContext(cfg), &client.output)
+	return client
+}
+
+// 发送请求 返回回复的类型和id之后的内容
+func (client *sftpTestClient) request(packetType byte, body sftpPacket) (byte, *sftpReader) {
+	client.t.Helper()
+	client.nextID++
+	packet := append(sftpPacket{packetType}.uint32(client.nextID), body...)
+	if err := client.server.handlePacket(packet); err != nil {
+		client.t.Fatalf("packet %v: %v", packetType, err)
+	}
+	reply := client.output.Bytes()
+	if len(reply) < 9 || binary.BigEndian.Uint32(reply) != uint32(len(reply)-4) {
+		client.t.Fatalf("packet %v: invalid reply %q", packetType, reply)
+	}
+	r := &sftpReader{data: append([]byte(nil), reply[5:]...)}
+	client.output.Reset()
+	if id := r.uint32(); id != client.nextID {
+		client.t.Fatalf("packet %v: reply id %v, want %v", packetType, id, client.nextID)
+	}
+	return reply[4], r
+}
+
+// 发送请求 回复必须是指定的状态码
+func (client *sftpTestClient) status(packetType byte, body sftpPacket, want uint32) {
+	client.t.Helper()
+	replyType, r := client.request(packetType, body)
+	if replyType != sftpStatus {
+		client.t.Fatalf("packet %v: reply type %v, want status %v", packetType, replyType, want)
+	}
+	if code := r.uint32(); code != want {
+		client.t.Fatalf("packet %v: status %v (%v), want %v", packetType, code, r.string(), want)
+	}
+}
+
+func (client *sftpTestClient) open(name string, flags uint32) string {
+	client.t.Helper()
+	replyType, r := client.request(sftpOpen, sftpPacket{}.string(name).uint32(flags).uint32(0))
+	if replyType != sftpHandle {
+		client.t.Fatalf("open %v: reply type %v", name, replyType)
+	}
+	return r.string()
+}
+
+func (client *sftpTestClient) write(handle string, offset uint64, data string, want uint32) {
+	client.t.Helper()
+	client.status(sftpWrite, sftpPacket{}.string(handle).uint64(offset).string(data), want)
+}
+
+func (client *sftpTestClient) fsetstatSize(handle string, size uint64, want uint32) {
+	client.t.Helper()
+	client.status(sftpFsetstat, sftpPacket{}.string(handle).uint32(sftpAttrSize).uint64(size), want)
+}
+
+const sftpCreateFlags = sftpFlagWrite | sftpFlagCreate | sftpFlagTrunc
+
+func TestSFTPOpenWriteReadSetstat(t *testing.T) {
+	client := newSFTPTestClient(t, "")
+	handle := client.open("/tmp/upload", sftpCreateFlags)
+	client.write(handle, 0, "hello", sftpOK)
+	// 跳过的部分用0填充
+	client.write(handle, 8, "!", sftpOK)
+	replyType, r := client.request(sftpFstat, sftpPacket{}.string(handle))
+	if attrs := r.attrs(); replyType != sftpAttrs || attrs.size != 9 {
+		t.Errorf("fstat: reply type %v, size %v, want attrs with size 9", replyType, attrs.size)
+	}
+	client.fsetstatSize(handle, 10, sftpOK)
+	client.status(sftpClose, sftpPacket{}.string(handle), sftpOK)
+	if data, err := client.server.context.fs.ReadFile("/tmp/upload"); err != nil || string(data) != "hello\x00\x00\x00!\x00" {
+		t.Errorf("uploaded file = %q, %v", data, err)
+	}
+
+	handle = client.open("/tmp/upload", sftpFlagRead)
+	replyType, r = client.request(sftpRead, sftpPacket{}.string(handle).uint64(1).uint32(4))
+	if data := r.string(); replyType != sftpData || data != "ello" {
+		t.Errorf("read: reply type %v, data %q, want data %q", replyType, data, "ello")
+	}
+	client.status(sftpRead, sftpPacket{}.string(handle).uint64(10).uint32(4), sftpEOF)
+	client.write(handle, 0, "x", sftpFailure)
+	client.status(sftpClose, sftpPacket{}.string(handle), sftpOK)
+	client.status(sftpClose, sftpPacket{}.string(handle), sftpFailure)
+
+	// 按路径截断
+	client.status(sftpSetstat, sftpPacket{}.string("/tmp/upload").uint32(sftpAttrSize).uint64(2), sftpOK)
+	if data, _ := client.server.context.fs.ReadFile("/tmp/upload"); string(data) != "he" {
+		t.Errorf("truncated file = %q, want %q", data, "he")
+	}
+
+	// 不截断打开时追加
+	handle = client.open("/tmp/upload", sftpFlagWrite|sftpFlagAppend)
+	client.write(handle, 0, "y", sftpOK)
+	client.status(sftpClose, sftpPacket{}.string(handle), sftpOK)
+	if data, _ := client.server.context.fs.ReadFile("/tmp/upload"); string(data) != "hey" {
+		t.Errorf("appended file = %q, want %q", data, "hey")
+	}
+
+	replyType, r = client.request(sftpOpen, sftpPacket{}.string("/nonexistent").uint32(sftpFlagRead).uint32(0))
+	if code := r.uint32(); replyType != sftpStatus || code != sftpNoSuchFile {
+		t.Errorf("open nonexistent: reply type %v, status %v", replyType, code)
+	}
+}
+
+// 客户端指定的偏移和大小不能导致分配过大的内存 不限制大小时同样如此
+func TestSFTPOversizedWrites(t *testing.T) {
+	for _, configString := range []string{
+		"",
+		"filesystem:\n  max_file_size: 0\n",
+		"filesystem:\n  max_file_size: 0\n  max_session_size: 0\n",
+	} {
+		client := newSFTPTestClient(t, configString)
+		handle := client.open("/tmp/big", sftpCreateFlags)
+		client.write(handle, 1<<62, "x", sftpFailure)
+		client.write(handle, 1<<63-1, "x", sftpFailure)
+		client.write(handle, ^uint64(0)-1, "xyz", sftpFailure)
+		client.fsetstatSize(handle, 1<<62, sftpFailure)
+		client.status(sftpSetstat, sftpPacket{}.string("/etc/passwd").uint32(sftpAttrSize).uint64(1<<62), sftpFailure)
+		client.write(handle, 0, "ok", sftpOK)
+		client.status(sftpClose, sftpPacket{}.string(handle), sftpOK)
+		if data, _ := client.server.context.fs.ReadFile("/tmp/big"); string(data) != "ok" {
+			t.Errorf("%q: file = %q, want %q", configString, data, "ok")
+		}
+	}
+}
+
+// 句柄中缓存的数据在写入时计入会话的写入总量
+func TestSFTPBufferedDataCountsAgainstQuota(t *testing.T) {
+	client := newSFTPTestClient(t, "filesystem:\n  max_file_size: 0\n  max_session_size: 1000\n")
+	a := client.open("/tmp/a", sftpCreateFlags)
+	b := client.open("/tmp/b", sftpCreateFlags)
+	client.write(a, 0, string(make([]byte, 600)), sftpOK)
+	client.write(b, 0, string(make([]byte, 600)), sftpFailure)
+	client.write(b, 0, string(make([]byte, 400)), sftpOK)
+	// 覆盖已经缓存的部分不增加用量
+	client.write(a, 0, string(make([]byte, 600)), sftpOK)
+	client.fsetstatSize(b, 401, sftpFailure)
+	client.status(sftpClose, sftpPacket{}.string(a), sftpOK)
+	client.status(sftpClose, sftpPacket{}.string(b), sftpOK)
+	c := client.open("/tmp/c", sftpCreateFlags)
+	client.write(c, 0, "x", sftpFailure)
+}
+
+func TestSFTPHandleLimit(t *testing.T) {
+	client := newSFTPTestClient(t, "")
+	var handles []string
+	for i := 0; i < sftpMaxHandles; i++ {
+		handles = append(handles, client.open("/etc/passwd", sftpFlagRead))
+	}
+	client.status(sftpOpen, sftpPacket{}.string("/etc/passwd").uint32(sftpFlagRead).uint32(0), sftpFailure)
+	client.status(sftpOpen, sftpPacket{}.string("/tmp/new").uint32(sftpCreateFlags).uint32(0), sftpFailure)
+	client.status(sftpOpendir, sftpPacket{}.string("/"), sftpFailure)
+	if _, err := client.server.context.fs.Stat("/tmp/new"); err != errNoSuchFile {
+		t.Errorf("file created although open failed: %v", err)
+	}
+	client.status(sftpClose, sftpPacket{}.string(handles[0]), sftpOK)
+	client.open("/etc/passwd", sftpFlagRead)
+}
+
+// 磁盘快满时可用的块数为0 不会溢出
+func TestSFTPStatvfsNearlyFullDisk(t *testing.T) {
+	client := newSFTPTestClient(t, "persona:\n  disk:\n    size_gb: 100\n    used_gb: 99\n")
+	replyType, r := client.request(sftpExtended, sftpPacket{}.string("statvfs@openssh.com").string("/"))
+	if replyType != sftpExtendedReply {
+		t.Fatalf("reply type %v", replyType)
+	}
+	r.uint64()
+	r.uint64()
+	blocks, free, available := r.uint64(), r.uint64(), r.uint64()
+	if free != blocks/100 || available != 0 {
+		t.Errorf("blocks %v free %v available %v, want free %v available 0", blocks, free, available, blocks/100)
+	}
+}
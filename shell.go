@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shell会话状态 同一个会话中执行的所有命令共享
+type shellSession struct {
+	channelContext
+	cwd     string // 当前工作目录
+	vars    map[string]string
+	status  uint32 // 上一个命令的退出状态 即$?
+	pid     int
+	started time.Time
+}
+
+// 用户的主目录
+func homeDir(user string) string {
+	if user == "root" || user == "" {
+		return "/root"
+	}
+	return path.Join("/home", user)
+}
+
+// 登录后的工作目录 主目录不存在时为根目录
+func (context channelContext) loginDir() string {
+	home := homeDir(context.User())
+	if info, err := context.fs.Stat(home); err != nil || !info.IsDir() {
+		return "/"
+	}
+	return home
+}
+
+func newShellSession(context channelContext) *shellSession {
+	user := context.User()
+	home := homeDir(user)
+	cwd := context.loginDir()
+	return &shellSession{
+		channelContext: context,
+		cwd:            cwd,
+		vars: map[string]string{
+			"HOME":     home,
+			"PWD":      cwd,
+			"HOSTNAME": context.cfg.Persona.Hostname,
+			"USER":     user,
+			"LOGNAME":  user,
+			"SHELL":    "/bin/bash",
+			"PATH":     "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		},
+		pid:     rand.Intn(30000) + 1000,
+		started: time.Now(),
+	}
+}
+
+// 子shell 变量的修改不影响父shell
+func (session *shellSession) subshell() *shellSession {
+	sub := *session
+	sub.vars = make(map[string]string, len(session.vars))
+	for name, value := range session.vars {
+		sub.vars[name] = value
+	}
+	return &sub
+}
+
+// exit命令 结束当前shell
+type shellExit struct {
+	status uint32
+}
+
+func (exit shellExit) Error() string {
+	return fmt.Sprintf("exit %v", exit.status)
+}
+
+// 管道 命令替换的输出和变量值的最大长度 超过时命令失败 避免耗尽内存
+const maxShellBuffer = 16 * 1024 * 1024
+
+var errShellBufferFull = errors.New("memory exhausted")
+
+// 有长度上限的输出缓冲区 超过上限的写入全部丢弃
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (buffer *limitedBuffer) Write(p []byte) (int, error) {
+	if buffer.Len()+len(p) > maxShellBuffer {
+		return 0, errShellBufferFull
+	}
+	return buffer.Buffer.Write(p)
+}
+
+// 从管道读取的readLiner 不记录输入
+type pipeReadLiner struct {
+	*bufio.Reader
+}
+
+func newPipeReadLiner(data []byte) pipeReadLiner {
+	return pipeReadLiner{bufio.NewReader(bytes.NewReader(data))}
+}
+
+func (r pipeReadLiner) ReadLine() (string, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		return line, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// 执行一段shell脚本
+func (context commandContext) runScript(script string) (uint32, error) {
+	list, err := parseShell(script)
+	if err == errIncompleteInput {
+		_, err := fmt.Fprintln(context.stderr, "sh: syntax error: unexpected end of file")
+		return 2, err
+	}
+	if err != nil {
+		_, err := fmt.Fprintf(context.stderr, "sh: %v\n", err)
+		return 2, err
+	}
+	return context.runList(list)
+}
+
+func (context commandContext) runList(list *shellList) (uint32, error) {
+	status := context.session.status
+	for _, item := range list.items {
+		if item.operator == "&&" && status != 0 {
+			continue
+		}
+		if item.operator == "||" && status == 0 {
+			continue
+		}
+		var err error
+		status, err = context.runPipeline(item.pipeline)
+		context.session.status = status
+		if err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+// 管道中的命令按顺序执行 前一个命令的输出作为后一个命令的输入
+func (context commandContext) runPipeline(pipeline *shellPipeline) (uint32, error) {
+	var status uint32
+	stdin := context.stdin
+	for i, command := range pipeline.commands {
+		newContext := context
+		newContext.stdin = stdin
+		var output *limitedBuffer
+		if i < len(pipeline.commands)-1 {
+			output = &limitedBuffer{}
+			newContext.stdout = output
+		}
+		var err error
+		status, err = newContext.runCommand(command)
+		if _, ok := err.(shellExit); ok && len(pipeline.commands) > 1 {
+			// 管道中的命令在子shell中执行 exit只结束该命令
+			err = nil
+		}
+		if errors.Is(err, errShellBufferFull) {
+			// 只结束当前管道 之后的命令继续执行
+			_, err := fmt.Fprintf(context.stderr, "sh: %v\n", errShellBufferFull)
+			return 1, err
+		}
+		if err != nil {
+			return status, err
+		}
+		if output != nil {
+			stdin = newPipeReadLiner(output.Bytes())
+		}
+	}
+	if pipeline.negate {
+		if status == 0 {
+			status = 1
+		} else {
+			status = 0
+		}
+	}
+	return status, nil
+}
+
+func (context commandContext) runCommand(command shellCommand) (uint32, error) {
+	newContext, ok, err := context.applyRedirects(command.redirections())
+	if err != nil || !ok {
+		return 1, err
+	}
+	switch command := command.(type) {
+	case *subshellCommand:
+		newContext.session = context.session.subshell()
+		status, err := newContext.runList(command.list)
+		if exit, ok := err.(shellExit); ok {
+			return exit.status, nil
+		}
+		return status, err
+	case *simpleCommand:
+		return newContext.runSimpleCommand(command)
+	default:
+		return 1, fmt.Errorf("unknown command type %T", command)
+	}
+}
+
+func (context commandContext) runSimpleCommand(command *simpleCommand) (uint32, error) {
+	var args []string
+	size := 0
+	for _, word := range command.words {
+		fields, err := context.expandWord(word, true)
+		if err != nil {
+			return 1, err
+		}
+		for _, field := range fields {
+			if size += len(field); size > maxShellBuffer {
+				return 1, errShellBufferFull
+			}
+		}
+		args = append(args, fields...)
+	}
+	values := make([]string, len(command.assignments))
+	for i, assignment := range command.assignments {
+		fields, err := context.expandWord(assignment.value, false)
+		if err != nil {
+			return 1, err
+		}
+		values[i] = strings.Join(fields, "")
+	}
+	if len(args) == 0 {
+		for i, assignment := range command.assignments {
+			if err := context.session.setVariable(assignment.name, values[i]); err != nil {
+				return 1, err
+			}
+		}
+		return 0, nil
+	}
+	context.session.logEvent(commandLog{
+		channelLog: channelLog{
+			ChannelID: context.session.channelID,
+		},
+		Args: args,
+	})
+	if args[0] == "exit" {
+		status := context.session.status
+		if len(args) > 1 {
+			parsed, err := strconv.ParseUint(args[1], 10, 32)
+			if err != nil {
+				parsed = 255
+			}
+			status = uint32(parsed)
+		}
+		return status, shellExit{status}
+	}
+	newContext := context
+	newContext.args = args
+	status, err := executeProgram(newContext)
+	if err == io.EOF {
+		// 输入结束只结束当前命令
+		err = nil
+	}
+	return status, err
+}
+
+// 按顺序应用重定向 失败时输出错误信息并返回false
+func (context commandContext) applyRedirects(redirects []shellRedirect) (commandContext, bool, error) {
+	for _, redirect := range redirects {
+		fields, err := context.expandWord(redirect.target, true)
+		if err != nil {
+			return context, false, err
+		}
+		if len(fields) != 1 {
+			_, err := fmt.Fprintf(context.stderr, "sh: %v: ambiguous redirect\n", joinWord(redirect.target))
+			return context, false, err
+		}
+		target := fields[0]
+		switch redirect.op {
+		case "<":
+			stdin, err := context.openInput(target)
+			if err != nil {
+				_, err := fmt.Fprintf(context.stderr, "sh: %v: %v\n", target, err)
+				return context, false, err
+			}
+			if redirect.fd == 0 {
+				context.stdin = stdin
+			}
+		case ">", ">>":
+			output, err := context.openOutput(target, redirect.op == ">>")
+			if err != nil {
+				_, err := fmt.Fprintf(context.stderr, "sh: %v: %v\n", target, err)
+				return context, false, err
+			}
+			context.setOutput(redirect.fd, output)
+		case ">&":
+			switch target {
+			case "1":
+				context.setOutput(redirect.fd, context.stdout)
+			case "2":
+				context.setOutput(redirect.fd, context.stderr)
+			case "-":
+				context.setOutput(redirect.fd, ioutil.Discard)
+			default:
+				if _, err := strconv.Atoi(target); err == nil {
+					_, err := fmt.Fprintf(context.stderr, "sh: %v: Bad file descriptor\n", target)
+					return context, false, err
+				}
+				// >&file 等同于 &>file
+				output, err := context.openOutput(target, false)
+				if err != nil {
+					_, err := fmt.Fprintf(context.stderr, "sh: %v: %v\n", target, err)
+					return context, false, err
+				}
+				context.setOutput(-1, output)
+			}
+		case "<&":
+			// 只有标准输入可用 忽略
+		}
+	}
+	return context, true, nil
+}
+
+func (context *commandContext) setOutput(fd int, output io.Writer) {
+	switch fd {
+	case 1:
+		context.stdout = output
+	case 2:
+		context.stderr = output
+	case -1:
+		context.stdout = output
+		context.stderr = output
+	}
+}
+
+// 写入虚拟文件系统中的文件 每次写入追加到文件末尾
+type vfsFileWriter struct {
+	fs   *vfs
+	name string
+}
+
+func (writer vfsFileWriter) Write(p []byte) (int, error) {
+	if err := writer.fs.WriteFile(writer.name, p, 0644, true); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 打开重定向输出的文件
+func (context commandContext) openOutput(name string, appendMode bool) (io.Writer, error) {
+	name = context.absPath(name)
+	if err := context.session.fs.WriteFile(name, nil, 0644, appendMode); err != nil {
+		return nil, err
+	}
+	return vfsFileWriter{context.session.fs, name}, nil
+}
+
+// 打开重定向输入的文件
+func (context commandContext) openInput(name string) (readLiner, error) {
+	data, err := context.session.fs.ReadFile(context.absPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return newPipeReadLiner(data), nil
+}
+
+// 相对于当前工作目录的路径转换为绝对路径
+func (context commandContext) absPath(name string) string {
+	if path.IsAbs(name) {
+		return path.Clean(name)
+	}
+	return path.Join(context.session.cwd, name)
+}
+
+// 展开单词 split为true时对未加引号的展开结果进行分词
+func (context commandContext) expandWord(word shellWord, split bool) ([]string, error) {
+	var fields []string
+	var current strings.Builder
+	hasCurrent := false
+	// 展开结果的总长度
+	size := 0
+	// 开头未加引号的~展开为主目录
+	if len(word) > 0 && word[0].kind == literalPart && !word[0].quoted {
+		if text := word[0].text; text == "~" || strings.HasPrefix(text, "~/") {
+			current.WriteString(context.session.vars["HOME"] + text[1:])
+			hasCurrent = true
+			word = word[1:]
+		}
+	}
+	for _, part := range word {
+		var value string
+		switch part.kind {
+		case literalPart:
+			current.WriteString(part.text)
+			hasCurrent = true
+			continue
+		case variablePart:
+			value = context.session.variable(part.text)
+		case substitutionPart:
+			var err error
+			value, err = context.substitute(part.list)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if size += len(value); size > maxShellBuffer {
+			return nil, errShellBufferFull
+		}
+		if part.quoted || !split {
+			current.WriteString(value)
+			hasCurrent = true
+			continue
+		}
+		// 未加引号的展开结果按空白分词
+		words := strings.Fields(value)
+		if len(words) == 0 {
+			continue
+		}
+		if value[0] == ' ' || value[0] == '\t' || value[0] == '\n' {
+			if hasCurrent {
+				fields = append(fields, current.String())
+				current.Reset()
+				hasCurrent = false
+			}
+		}
+		for i, w := range words {
+			if i > 0 {
+				fields = append(fields, current.String())
+				current.Reset()
+			}
+			current.WriteString(w)
+			hasCurrent = true
+		}
+		if last := value[len(value)-1]; last == ' ' || last == '\t' || last == '\n' {
+			fields = append(fields, current.String())
+			current.Reset()
+			hasCurrent = false
+		}
+	}
+	if hasCurrent {
+		fields = append(fields, current.String())
+	}
+	return fields, nil
+}
+
+// 命令替换 在子shell中执行并返回去掉结尾换行的输出
+func (context commandContext) substitute(list *shellList) (string, error) {
+	var output limitedBuffer
+	newContext := context
+	newContext.stdin = newPipeReadLiner(nil)
+	newContext.stdout = &output
+	newContext.session = context.session.subshell()
+	status, err := newContext.runList(list)
+	if exit, ok := err.(shellExit); ok {
+		status, err = exit.status, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	context.session.status = status
+	return strings.TrimRight(output.String(), "\n"), nil
+}
+
+// 所有变量的总长度不超过maxShellBuffer
+func (session *shellSession) setVariable(name string, value string) error {
+	size := len(value)
+	for other, otherValue := range session.vars {
+		if other != name {
+			size += len(otherValue)
+		}
+	}
+	if size > maxShellBuffer {
+		return errShellBufferFull
+	}
+	session.vars[name] = value
+	return nil
+}
+
+func (session *shellSession) variable(name string) string {
+	switch name {
+	case "?":
+		return strconv.FormatUint(uint64(session.status), 10)
+	case "$":
+		return strconv.Itoa(session.pid)
+	case "#":
+		return "0"
+	case "0":
+		return "-bash"
+	case "-":
+		return "himBH"
+	}
+	return session.vars[name]
+}
+
+func joinWord(word shellWord) string {
+	var result strings.Builder
+	for _, part := range word {
+		switch part.kind {
+		case literalPart:
+			result.WriteString(part.text)
+		case variablePart:
+			result.WriteString("$" + part.text)
+		case substitutionPart:
+			result.WriteString("$(...)")
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 命令列表 由 ; & && || 和换行连接的管道
+type shellList struct {
+	items []shellListItem
+}
+
+type shellListItem struct {
+	operator string // 与前一项之间的运算符 第一项为空 ";" "&&" "||"
+	pipeline *shellPipeline
+}
+
+// 管道 由 | 连接的命令
+type shellPipeline struct {
+	negate   bool // 以!开头时取反退出状态
+	commands []shellCommand
+}
+
+// 管道中的单个命令 *simpleCommand或*subshellCommand
+type shellCommand interface {
+	redirections() []shellRedirect
+}
+
+// 简单命令 变量赋值 参数和重定向
+type simpleCommand struct {
+	assignments []shellAssignment
+	words       []shellWord
+	redirects   []shellRedirect
+}
+
+func (command *simpleCommand) redirections() []shellRedirect {
+	return command.redirects
+}
+
+// 子shell (list)
+type subshellCommand struct {
+	list      *shellList
+	redirects []shellRedirect
+}
+
+func (command *subshellCommand) redirections() []shellRedirect {
+	return command.redirects
+}
+
+type shellAssignment struct {
+	name  string
+	value shellWord
+}
+
+// 重定向 fd为被重定向的文件描述符 -1表示同时重定向stdout和stderr(&>)
+type shellRedirect struct {
+	fd     int
+	op     string // "<" ">" ">>" ">&" "<&"
+	target shellWord
+}
+
+// 单词 由多个部分拼接而成
+type shellWord []wordPart
+
+type wordPartKind int
+
+const (
+	literalPart      wordPartKind = iota
+	variablePart                  // $name ${name}
+	substitutionPart              // $(list) `list`
+)
+
+type wordPart struct {
+	kind   wordPartKind
+	text   string     // 字面值或变量名
+	list   *shellList // 命令替换的内容
+	quoted bool       // 引号中的部分不进行分词
+}
+
+// 输入不完整 例如引号未闭合或以运算符结尾 交互式shell会继续读取下一行
+var errIncompleteInput = errors.New("incomplete input")
+
+// 语法错误
+type shellSyntaxError struct {
+	token string
+}
+
+func (err shellSyntaxError) Error() string {
+	return fmt.Sprintf("syntax error near unexpected token `%v'", err.token)
+}
+
+// 嵌套的$(...) (...)和`...`的最大层数 避免恶意输入耗尽CPU和栈
+const maxShellDepth = 64
+
+type shellParser struct {
+	input []rune
+	pos   int
+	depth int // 嵌套的$(...)和(...)层数
+	outer int // 外层`...`中已经嵌套的层数
+}
+
+// 解析一段shell输入
+func parseShell(input string) (*shellList, error) {
+	return parseNestedShell(input, 0)
+}
+
+// outer为外层已经嵌套的层数
+func parseNestedShell(input string, outer int) (*shellList, error) {
+	parser := &shellParser{input: []rune(input), outer: outer}
+	list, err := parser.parseList()
+	if err != nil {
+		return nil, err
+	}
+	parser.skipBlanks()
+	if !parser.eof() {
+		return nil, shellSyntaxError{parser.peekOperator()}
+	}
+	return list, nil
+}
+
+func (parser *shellParser) tooDeep() bool {
+	return parser.outer+parser.depth >= maxShellDepth
+}
+
+func (parser *shellParser) eof() bool {
+	return parser.pos >= len(parser.input)
+}
+
+func (parser *shellParser) peek() rune {
+	if parser.eof() {
+		return 0
+	}
+	return parser.input[parser.pos]
+}
+
+// 逐个比较 不转换剩余的全部输入
+func (parser *shellParser) hasPrefix(prefix string) bool {
+	pos := parser.pos
+	for _, r := range prefix {
+		if pos >= len(parser.input) || parser.input[pos] != r {
+			return false
+		}
+		pos++
+	}
+	return true
+}
+
+// 跳过空格 制表符 续行和注释 不跳过换行
+func (parser *shellParser) skipBlanks() {
+	for !parser.eof() {
+		switch {
+		case parser.peek() == ' ' || parser.peek() == '\t':
+			parser.pos++
+		case parser.hasPrefix("\\\n"):
+			parser.pos += 2
+		case parser.peek() == '#':
+			for !parser.eof() && parser.peek() != '\n' {
+				parser.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// 跳过空白和换行
+func (parser *shellParser) skipBlanksAndNewlines() {
+	for {
+		parser.skipBlanks()
+		if parser.peek() != '\n' {
+			return
+		}
+		parser.pos++
+	}
+}
+
+var shellOperators = []string{"&&", "||", ";;", "&>", ">>", ">&", "<&", "|", "&", ";", "(", ")", "<", ">", "\n"}
+
+// 当前位置的运算符 用于错误信息
+func (parser *shellParser) peekOperator() string {
+	for _, operator := range shellOperators {
+		if parser.hasPrefix(operator) {
+			if operator == "\n" {
+				return "newline"
+			}
+			return operator
+		}
+	}
+	if parser.eof() {
+		return "newline"
+	}
+	return string(parser.peek())
+}
+
+func isShellMeta(r rune) bool {
+	return strings.ContainsRune(" \t\n|&;()<>", r)
+}
+
+// list: pipeline { (";" | "&" | "&&" | "||" | newline) pipeline }
+func (parser *shellParser) parseList() (*shellList, error) {
+	list := &shellList{}
+	operator := ""
+	for {
+		parser.skipBlanksAndNewlines()
+		if parser.eof() || (parser.peek() == ')' && parser.depth > 0) {
+			if operator == "&&" || operator == "||" {
+				return nil, errIncompleteInput
+			}
+			if parser.eof() && parser.depth > 0 {
+				return nil, errIncompleteInput
+			}
+			return list, nil
+		}
+		pipeline, err := parser.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		list.items = append(list.items, shellListItem{operator, pipeline})
+		parser.skipBlanks()
+		switch {
+		case parser.hasPrefix("&&"):
+			operator = "&&"
+			parser.pos += 2
+		case parser.hasPrefix("||"):
+			operator = "||"
+			parser.pos += 2
+		case parser.hasPrefix(";;"):
+			return nil, shellSyntaxError{";;"}
+		case parser.peek() == ';' || parser.peek() == '\n':
+			operator = ";"
+			parser.pos++
+		case parser.hasPrefix("&") && !parser.hasPrefix("&>"):
+			// 后台执行按顺序执行处理
+			operator = ";"
+			parser.pos++
+		case parser.eof() || (parser.peek() == ')' && parser.depth > 0):
+			operator = ""
+		default:
+			return nil, shellSyntaxError{parser.peekOperator()}
+		}
+	}
+}
+
+// pipeline: ["!"] command { "|" command }
+func (parser *shellParser) parsePipeline() (*shellPipeline, error) {
+	pipeline := &shellPipeline{}
+	parser.skipBlanks()
+	if parser.peek() == '!' && parser.pos+1 < len(parser.input) && isShellMeta(parser.input[parser.pos+1]) {
+		pipeline.negate = true
+		parser.pos++
+	}
+	for {
+		command, err := parser.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		pipeline.commands = append(pipeline.commands, command)
+		parser.skipBlanks()
+		if parser.peek() != '|' || parser.hasPrefix("||") {
+			return pipeline, nil
+		}
+		parser.pos++
+		parser.skipBlanksAndNewlines()
+		if parser.eof() {
+			return nil, errIncompleteInput
+		}
+	}
+}
+
+// command: "(" list ")" {redirect} | simple command
+func (parser *shellParser) parseCommand() (shellCommand, error) {
+	parser.skipBlanks()
+	if parser.peek() == '(' {
+		if parser.tooDeep() {
+			return nil, shellSyntaxError{"("}
+		}
+		parser.pos++
+		parser.depth++
+		list, err := parser.parseList()
+		parser.depth--
+		if err != nil {
+			return nil, err
+		}
+		if parser.peek() != ')' {
+			return nil, errIncompleteInput
+		}
+		parser.pos++
+		if len(list.items) == 0 {
+			return nil, shellSyntaxError{")"}
+		}
+		command := &subshellCommand{list: list}
+		for {
+			parser.skipBlanks()
+			redirect, ok, err := parser.parseRedirect()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return command, nil
+			}
+			command.redirects = append(command.redirects, redirect)
+		}
+	}
+	command := &simpleCommand{}
+	for {
+		parser.skipBlanks()
+		if parser.eof() {
+			break
+		}
+		redirect, ok, err := parser.parseRedirect()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			command.redirects = append(command.redirects, redirect)
+			continue
+		}
+		if isShellMeta(parser.peek()) {
+			if parser.peek() == '(' {
+				return nil, shellSyntaxError{"("}
+			}
+			break
+		}
+		word, err := parser.parseWord()
+		if err != nil {
+			return nil, err
+		}
+		if len(command.words) == 0 {
+			if assignment, ok := toAssignment(word); ok {
+				command.assignments = append(command.assignments, assignment)
+				continue
+			}
+		}
+		command.words = append(command.words, word)
+	}
+	if len(command.words) == 0 && len(command.assignments) == 0 && len(command.redirects) == 0 {
+		return nil, shellSyntaxError{parser.peekOperator()}
+	}
+	return command, nil
+}
+
+// 以name=开头的未加引号的单词为变量赋值
+func toAssignment(word shellWord) (shellAssignment, bool) {
+	if len(word) == 0 || word[0].kind != literalPart || word[0].quoted {
+		return shellAssignment{}, false
+	}
+	index := strings.IndexRune(word[0].text, '=')
+	if index <= 0 || !isShellName(word[0].text[:index]) {
+		return shellAssignment{}, false
+	}
+	value := shellWord{}
+	if rest := word[0].text[index+1:]; rest != "" {
+		value = append(value, wordPart{kind: literalPart, text: rest})
+	}
+	value = append(value, word[1:]...)
+	return shellAssignment{word[0].text[:index], value}, true
+}
+
+func isShellName(name string) bool {
+	for i, r := range name {
+		if !(r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// redirect: [n] ("<" | ">" | ">>" | ">&" | "<&") word | "&>" word
+func (parser *shellParser) parseRedirect() (shellRedirect, bool, error) {
+	start := parser.pos
+	fd := -2
+	digits := parser.pos
+	for digits < len(parser.input) && unicode.IsDigit(parser.input[digits]) {
+		digits++
+	}
+	if digits > parser.pos && digits < len(parser.input) && (parser.input[digits] == '<' || parser.input[digits] == '>') {
+		n, err := strconv.Atoi(string(parser.input[parser.pos:digits]))
+		if err != nil {
+			return shellRedirect{}, false, shellSyntaxError{string(parser.input[parser.pos:digits])}
+		}
+		fd = n
+		parser.pos = digits
+	}
+	var op string
+	switch {
+	case parser.hasPrefix("&>") && fd == -2:
+		op = ">"
+		fd = -1
+		parser.pos += 2
+		if parser.peek() == '>' {
+			op = ">>"
+			parser.pos++
+		}
+	case parser.hasPrefix(">>"):
+		op = ">>"
+		parser.pos += 2
+	case parser.hasPrefix(">&"):
+		op = ">&"
+		parser.pos += 2
+	case parser.hasPrefix("<&"):
+		op = "<&"
+		parser.pos += 2
+	case parser.hasPrefix(">|"):
+		op = ">"
+		parser.pos += 2
+	case parser.peek() == '>':
+		op = ">"
+		parser.pos++
+	case parser.peek() == '<':
+		op = "<"
+		parser.pos++
+	default:
+		parser.pos = start
+		return shellRedirect{}, false, nil
+	}
+	if fd == -2 {
+		fd = 1
+		if op[0] == '<' {
+			fd = 0
+		}
+	}
+	parser.skipBlanks()
+	if parser.eof() || parser.peek() == '\n' {
+		return shellRedirect{}, false, shellSyntaxError{"newline"}
+	}
+	if isShellMeta(parser.peek()) {
+		return shellRedirect{}, false, shellSyntaxError{parser.peekOperator()}
+	}
+	target, err := parser.parseWord()
+	if err != nil {
+		return shellRedirect{}, false, err
+	}
+	return shellRedirect{fd, op, target}, true, nil
+}
+
+// 解析一个单词 直到未加引号的元字符
+func (parser *shellParser) parseWord() (shellWord, error) {
+	word := shellWord{}
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			word = append(word, wordPart{kind: literalPart, text: literal.String()})
+			literal.Reset()
+		}
+	}
+	for !parser.eof() && !isShellMeta(parser.peek()) {
+		r := parser.peek()
+		switch r {
+		case '\\':
+			parser.pos++
+			if parser.eof() {
+				return nil, errIncompleteInput
+			}
+			if parser.peek() != '\n' {
+				flush()
+				word = append(word, wordPart{kind: literalPart, text: string(parser.peek()), quoted: true})
+			}
+			parser.pos++
+		case '\'':
+			flush()
+			parser.pos++
+			end := parser.pos
+			for end < len(parser.input) && parser.input[end] != '\'' {
+				end++
+			}
+			if end >= len(parser.input) {
+				return nil, errIncompleteInput
+			}
+			word = append(word, wordPart{kind: literalPart, text: string(parser.input[parser.pos:end]), quoted: true})
+			parser.pos = end + 1
+		case '"':
+			flush()
+			parser.pos++
+			parts, err := parser.parseDoubleQuoted()
+			if err != nil {
+				return nil, err
+			}
+			if len(parts) == 0 {
+				parts = append(parts, wordPart{kind: literalPart, quoted: true})
+			}
+			word = append(word, parts...)
+		case '$', '`':
+			part, ok, err := parser.parseExpansion(false)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				literal.WriteRune(r)
+				parser.pos++
+				continue
+			}
+			flush()
+			word = append(word, part)
+		default:
+			literal.WriteRune(r)
+			parser.pos++
+		}
+	}
+	flush()
+	return word, nil
+}
+
+// 解析双引号中的内容 起始引号已经读取
+func (parser *shellParser) parseDoubleQuoted() ([]wordPart, error) {
+	var parts []wordPart
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			parts = append(parts, wordPart{kind: literalPart, text: literal.String(), quoted: true})
+			literal.Reset()
+		}
+	}
+	for {
+		if parser.eof() {
+			return nil, errIncompleteInput
+		}
+		r := parser.peek()
+		switch r {
+		case '"':
+			parser.pos++
+			flush()
+			return parts, nil
+		case '\\':
+			parser.pos++
+			if parser.eof() {
+				return nil, errIncompleteInput
+			}
+			next := parser.peek()
+			switch next {
+			case '"', '\\', '$', '`':
+				literal.WriteRune(next)
+			case '\n':
+			default:
+				literal.WriteRune('\\')
+				literal.WriteRune(next)
+			}
+			parser.pos++
+		case '$', '`':
+			part, ok, err := parser.parseExpansion(true)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				literal.WriteRune(r)
+				parser.pos++
+				continue
+			}
+			flush()
+			parts = append(parts, part)
+		default:
+			literal.WriteRune(r)
+			parser.pos++
+		}
+	}
+}
+
+// 解析$name ${name} $(list)和`list` 不是展开时返回false
+func (parser *shellParser) parseExpansion(quoted bool) (wordPart, bool, error) {
+	if parser.peek() == '`' {
+		parser.pos++
+		var content strings.Builder
+		for {
+			if parser.eof() {
+				return wordPart{}, false, errIncompleteInput
+			}
+			r := parser.peek()
+			parser.pos++
+			if r == '`' {
+				break
+			}
+			if r == '\\' && !parser.eof() && strings.ContainsRune("$`\\", parser.peek()) {
+				r = parser.peek()
+				parser.pos++
+			}
+			content.WriteRune(r)
+		}
+		if parser.tooDeep() {
+			return wordPart{}, false, shellSyntaxError{"`"}
+		}
+		list, err := parseNestedShell(content.String(), parser.outer+parser.depth+1)
+		if err != nil {
+			return wordPart{}, false, err
+		}
+		return wordPart{kind: substitutionPart, list: list, quoted: quoted}, true, nil
+	}
+	// $
+	if parser.pos+1 >= len(parser.input) {
+		return wordPart{}, false, nil
+	}
+	next := parser.input[parser.pos+1]
+	switch {
+	case next == '(':
+		if parser.pos+2 < len(parser.input) && parser.input[parser.pos+2] == '(' {
+			// 不支持算术展开 按字面处理
+			return wordPart{}, false, nil
+		}
+		if parser.tooDeep() {
+			return wordPart{}, false, shellSyntaxError{"("}
+		}
+		parser.pos += 2
+		parser.depth++
+		list, err := parser.parseList()
+		parser.depth--
+		if err != nil {
+			return wordPart{}, false, err
+		}
+		if parser.peek() != ')' {
+			return wordPart{}, false, errIncompleteInput
+		}
+		parser.pos++
+		return wordPart{kind: substitutionPart, list: list, quoted: quoted}, true, nil
+	case next == '{':
+		end := parser.pos + 2
+		for end < len(parser.input) && parser.input[end] != '}' {
+			end++
+		}
+		if end >= len(parser.input) {
+			return wordPart{}, false, errIncompleteInput
+		}
+		name := string(parser.input[parser.pos+2 : end])
+		parser.pos = end + 1
+		return wordPart{kind: variablePart, text: name, quoted: quoted}, true, nil
+	case strings.ContainsRune("?$#!@*-", next) || unicode.IsDigit(next):
+		parser.pos += 2
+		return wordPart{kind: variablePart, text: string(next), quoted: quoted}, true, nil
+	case next == '_' || unicode.IsLetter(next):
+		end := parser.pos + 1
+		for end < len(parser.input) && (parser.input[end] == '_' || unicode.IsLetter(parser.input[end]) || unicode.IsDigit(parser.input[end])) {
+			end++
+		}
+		name := string(parser.input[parser.pos+1 : end])
+		parser.pos = end
+		return wordPart{kind: variablePart, text: name, quoted: quoted}, true, nil
+	default:
+		return wordPart{}, false, nil
+	}
+}
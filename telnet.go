@@ -0,0 +1,457 @@
+package main
+
+import (
+	"golang.org/x/term"
+
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// telnet配置 对应yaml文件中的telnet 用于protocol为telnet的监听地址
+type telnetConfig struct {
+	Banner         string `yaml:"banner"`       // 登录提示之前显示的内容
+	LoginPrompt    string `yaml:"login_prompt"` // 为空时与login一样使用"主机名 login: "
+	PasswordPrompt string `yaml:"password_prompt"`
+	MaxTries       int    `yaml:"max_tries"` // 登录失败多少次后断开连接
+}
+
+func (telnet telnetConfig) validate() error {
+	if telnet.MaxTries <= 0 {
+		return fmt.Errorf("max_tries: must be positive, got %v", telnet.MaxTries)
+	}
+	return nil
+}
+
+// telnet命令和选项 RFC 854 857 858 1073 1091
+const (
+	telnetSE   = 240
+	telnetIP   = 244
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptEcho  = 1
+	telnetOptSGA   = 3
+	telnetOptTType = 24
+	telnetOptNAWS  = 31
+
+	telnetTTypeIs   = 0
+	telnetTTypeSend = 1
+)
+
+// 处理telnet协议的连接 读取时去掉命令并回应选项协商 写入时转义IAC
+// 回车统一转换为\r 与终端中按下回车键一样
+type telnetConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+	sent       map[[2]byte]bool // 已经发送的选项协商 避免重复回应
+	afterCR    bool
+
+	mutex         sync.Mutex
+	terminal      string
+	width, height uint32
+	onResize      func(width uint32, height uint32)
+	recorder      *sessionRecorder // 登录后开始录像 不包括密码
+}
+
+func newTelnetConn(conn net.Conn) *telnetConn {
+	return &telnetConn{Conn: conn, reader: bufio.NewReader(conn), sent: map[[2]byte]bool{}, width: 80, height: 24}
+}
+
+// 与Linux的telnetd一样 服务端回显 不使用GA 请求终端类型和窗口大小
+func (conn *telnetConn) negotiate() error {
+	for _, option := range [][2]byte{{telnetWILL, telnetOptEcho}, {telnetWILL, telnetOptSGA}, {telnetDO, telnetOptTType}, {telnetDO, telnetOptNAWS}} {
+		if err := conn.command(option[0], option[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (conn *telnetConn) command(verb byte, option byte) error {
+	conn.sent[[2]byte{verb, option}] = true
+	return conn.writeRaw([]byte{telnetIAC, verb, option})
+}
+
+func (conn *telnetConn) writeRaw(data []byte) error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	_, err := conn.Conn.Write(data)
+	return err
+}
+
+func (conn *telnetConn) Write(data []byte) (int, error) {
+	escaped := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b == telnetIAC {
+			escaped = append(escaped, telnetIAC)
+		}
+		escaped = append(escaped, b)
+	}
+	if err := conn.writeRaw(escaped); err != nil {
+		return 0, err
+	}
+	if recorder := conn.currentRecorder(); recorder != nil {
+		recorder.record("o", data)
+	}
+	return len(data), nil
+}
+
+// 读取数据 已经读到数据并且没有更多缓存的数据时返回 不阻塞
+func (conn *telnetConn) Read(data []byte) (int, error) {
+	n := 0
+	for n < len(data) {
+		if n > 0 && conn.reader.Buffered() == 0 {
+			break
+		}
+		b, err := conn.reader.ReadByte()
+		if err != nil {
+			if n > 0 {
+				break
+			}
+			return 0, err
+		}
+		if b == telnetIAC {
+			b, err = conn.handleCommand()
+			if err != nil {
+				return n, err
+			}
+			if b == 0 {
+				continue
+			}
+			data[n] = b
+			n++
+			continue
+		}
+		afterCR := conn.afterCR
+		conn.afterCR = b == '\r'
+		switch {
+		case afterCR && (b == '\n' || b == 0):
+			continue
+		case b == '\n':
+			b = '\r'
+		}
+		data[n] = b
+		n++
+	}
+	if recorder := conn.currentRecorder(); recorder != nil {
+		recorder.record("i", data[:n])
+	}
+	return n, nil
+}
+
+// 处理IAC之后的命令 返回对应的数据 没有数据时返回0
+func (conn *telnetConn) handleCommand() (byte, error) {
+	verb, err := conn.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch verb {
+	case telnetIAC:
+		return telnetIAC, nil
+	case telnetIP:
+		// 中断进程 与Ctrl-C相同
+		return 3, nil
+	case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+		option, err := conn.reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		return 0, conn.handleOption(verb, option)
+	case telnetSB:
+		return 0, conn.handleSubnegotiation()
+	default:
+		// NOP GA AYT等 忽略
+		return 0, nil
+	}
+}
+
+func (conn *telnetConn) handleOption(verb byte, option byte) error {
+	switch verb {
+	case telnetDO:
+		if option == telnetOptEcho || option == telnetOptSGA {
+			if conn.sent[[2]byte{telnetWILL, option}] {
+				return nil
+			}
+			return conn.command(telnetWILL, option)
+		}
+		if conn.sent[[2]byte{telnetWONT, option}] {
+			return nil
+		}
+		return conn.command(telnetWONT, option)
+	case telnetWILL:
+		switch option {
+		case telnetOptTType:
+			if !conn.sent[[2]byte{telnetDO, option}] {
+				if err := conn.command(telnetDO, option); err != nil {
+					return err
+				}
+			}
+			return conn.writeRaw([]byte{telnetIAC, telnetSB, telnetOptTType, telnetTTypeSend, telnetIAC, telnetSE})
+		case telnetOptNAWS:
+			if conn.sent[[2]byte{telnetDO, option}] {
+				return nil
+			}
+			return conn.command(telnetDO, option)
+		}
+		if conn.sent[[2]byte{telnetDONT, option}] {
+			return nil
+		}
+		return conn.command(telnetDONT, option)
+	}
+	return nil
+}
+
+// 子协商 读取到IAC SE为止 只处理终端类型和窗口大小
+func (conn *telnetConn) handleSubnegotiation() error {
+	var payload []byte
+	for {
+		b, err := conn.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == telnetIAC {
+			b, err = conn.reader.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b == telnetSE {
+				break
+			}
+		}
+		// 防止不结束的子协商占用内存
+		if len(payload) < 256 {
+			payload = append(payload, b)
+		}
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	conn.mutex.Lock()
+	switch {
+	case payload[0] == telnetOptTType && len(payload) > 1 && payload[1] == telnetTTypeIs:
+		conn.terminal = string(payload[2:])
+	case payload[0] == telnetOptNAWS && len(payload) == 5:
+		conn.width = uint32(payload[1])<<8 | uint32(payload[2])
+		conn.height = uint32(payload[3])<<8 | uint32(payload[4])
+		width, height, onResize, recorder := conn.width, conn.height, conn.onResize, conn.recorder
+		conn.mutex.Unlock()
+		if onResize != nil {
+			onResize(width, height)
+		}
+		if recorder != nil {
+			recorder.resize(width, height)
+		}
+		return nil
+	}
+	conn.mutex.Unlock()
+	return nil
+}
+
+// 终端类型和窗口大小
+func (conn *telnetConn) terminalInfo() (string, uint32, uint32) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.terminal, conn.width, conn.height
+}
+
+func (conn *telnetConn) setResizeHandler(onResize func(width uint32, height uint32)) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.onResize = onResize
+}
+
+func (conn *telnetConn) setRecorder(recorder *sessionRecorder) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.recorder = recorder
+}
+
+func (conn *telnetConn) currentRecorder() *sessionRecorder {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.recorder
+}
+
+// telnet连接的信息 登录后才有用户名
+type telnetConnMetadata struct {
+	preAuthConnMetadata
+	user string
+}
+
+func (metadata telnetConnMetadata) User() string { return metadata.user }
+
+var errTelnetLoginFailed = errors.New("too many failed login attempts")
+
+// telnet连接操作 登录成功后进入与ssh相同的shell
+func handleTelnetConnection(conn net.Conn, cfg *config) {
+	defer conn.Close()
+	telnet := newTelnetConn(conn)
+	auth := &authContext{connContext: connContext{ConnMetadata: telnetConnMetadata{preAuthConnMetadata{conn}, ""}, cfg: cfg, connID: newConnID()}}
+	auth.logEvent(connectionLog{
+		LocalAddress: conn.LocalAddr().String(),
+		Protocol:     "telnet",
+	})
+	defer auth.logEvent(connectionCloseLog{})
+
+	if err := telnet.negotiate(); err != nil {
+		log.Printf("Failed to negotiate telnet options: %v", err)
+		return
+	}
+	// 登录时不改变终端大小 否则会重画提示
+	terminal := term.NewTerminal(telnet, "")
+	user, err := telnetLogin(auth, conn, terminal)
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("Telnet login failed: %v", err)
+		}
+		return
+	}
+
+	context := auth.connContext
+	context.ConnMetadata = telnetConnMetadata{preAuthConnMetadata{conn}, user}
+	// telnet连接只有一个会话
+	session := newChannelContext(context, 0)
+	session.fs = newSessionFilesystem(cfg, user)
+	if err := handleTelnetSession(session, telnet, terminal); err != nil {
+		log.Printf("Error handling telnet session: %v", err)
+	}
+}
+
+// 与login一样提示用户名和密码 使用与ssh密码认证相同的策略
+func telnetLogin(auth *authContext, conn net.Conn, terminal *term.Terminal) (string, error) {
+	cfg := auth.cfg
+	if cfg.Telnet.Banner != "" {
+		if _, err := io.WriteString(terminal, cfg.Telnet.Banner); err != nil {
+			return "", err
+		}
+	}
+	loginPrompt := cfg.Telnet.LoginPrompt
+	if loginPrompt == "" {
+		loginPrompt = cfg.Persona.Hostname + " login: "
+	}
+	for tries := 0; tries < cfg.Telnet.MaxTries; {
+		terminal.SetPrompt(loginPrompt)
+		user, err := terminal.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if user == "" {
+			continue
+		}
+		password, err := terminal.ReadPassword(cfg.Telnet.PasswordPrompt)
+		if err != nil {
+			return "", err
+		}
+		tries++
+		accepted := cfg.Auth.PasswordAuth.Enabled && cfg.passwordPolicy.accept(conn.RemoteAddr(), user, password)
+		auth.logEvent(passwordAuthLog{
+			authLog:  auth.newAuthLog(telnetConnMetadata{preAuthConnMetadata{conn}, user}, "password", accepted),
+			Password: password,
+		})
+		if accepted {
+			terminal.SetPrompt("")
+			return user, nil
+		}
+		if _, err := io.WriteString(terminal, "\nLogin incorrect\n"); err != nil {
+			return "", err
+		}
+	}
+	return "", errTelnetLoginFailed
+}
+
+// 登录后的会话 与ssh中带终端的shell请求相同
+func handleTelnetSession(context channelContext, telnet *telnetConn, terminal *term.Terminal) error {
+	context.logEvent(sessionLog{
+		channelLog: channelLog{
+			ChannelID: context.channelID,
+		},
+	})
+	terminalType, width, height := telnet.terminalInfo()
+	terminal.SetSize(int(width), int(height))
+	telnet.setResizeHandler(func(width uint32, height uint32) {
+		terminal.SetSize(int(width), int(height))
+	})
+	context.logEvent(ptyLog{
+		channelLog: channelLog{
+			ChannelID: context.channelID,
+		},
+		Terminal: terminalType,
+		Width:    width,
+		Height:   height,
+	})
+	context.logEvent(shellLog{
+		channelLog: channelLog{
+			ChannelID: context.channelID,
+		},
+	})
+	entry := sessionCloseLog{
+		channelLog: channelLog{
+			ChannelID: context.channelID,
+		},
+	}
+	defer func() {
+		context.logEvent(entry)
+	}()
+
+	// 录像从登录之后开始 不包括密码
+	if context.cfg.Recording.Enabled {
+		header := asciicastHeader{
+			Width:  width,
+			Height: height,
+			Title:  fmt.Sprintf("%v@%v", context.User(), context.cfg.Persona.Hostname),
+			Env:    map[string]string{"SHELL": "/bin/bash"},
+
+			RemoteAddr: context.RemoteAddr().String(),
+			User:       context.User(),
+		}
+		if terminalType != "" {
+			header.Env["TERM"] = terminalType
+		}
+		recorder, err := newSessionRecorder(context.cfg.Recording, context.sessionID, header)
+		if err != nil {
+			log.Printf("Failed to start session recording: %v", err)
+		} else {
+			defer func() {
+				if err := recorder.Close(); err != nil {
+					log.Printf("Failed to close session recording: %v", err)
+				}
+				entry.Recording = recorder.path
+			}()
+			telnet.setRecorder(recorder)
+		}
+	}
+
+	inputChan := make(chan string)
+	inputDone := make(chan struct{})
+	go func() {
+		defer close(inputDone)
+		for input := range inputChan {
+			context.logEvent(sessionInputLog{
+				channelLog: channelLog{
+					ChannelID: context.channelID,
+				},
+				Input: input,
+			})
+		}
+	}()
+	_, err := executeProgram(commandContext{shellProgram, terminalReadLiner{terminal, inputChan}, terminal, terminal, true, newShellSession(context)})
+	close(inputChan)
+	<-inputDone
+	if err == io.EOF {
+		err = nil
+	}
+	if err == nil {
+		_, err = telnet.Write([]byte("\r\n"))
+	}
+	return err
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNoSuchFile   = errors.New("No such file or directory")
+	errNotDir       = errors.New("Not a directory")
+	errIsDir        = errors.New("Is a directory")
+	errNotEmpty     = errors.New("Directory not empty")
+	errFileExists   = errors.New("File exists")
+	errTooManyLinks = errors.New("Too many levels of symbolic links")
+	errInvalidPath  = errors.New("Invalid argument")
+	errNoSpace      = errors.New("No space left on device")
+)
+
+// 虚拟文件系统中的节点
+// 模板中的节点owner为nil 所有会话共享且不会被修改
+// 会话修改节点前先复制从根目录到该节点的路径 复制出的节点owner为该会话的文件系统
+type vfsNode struct {
+	owner    *vfs
+	mode     os.FileMode
+	user     string
+	group    string
+	mtime    time.Time
+	data     []byte
+	ownsData bool   // data的底层数组只属于该节点 可以直接追加
+	target   string // 符号链接指向的路径
+	children map[string]*vfsNode
+	generate func() []byte // 读取时生成内容的文件 例如/proc中的文件
+}
+
+func (node *vfsNode) clone(owner *vfs) *vfsNode {
+	clone := *node
+	clone.owner = owner
+	clone.ownsData = false
+	if node.children != nil {
+		clone.children = make(map[string]*vfsNode, len(node.children))
+		for name, child := range node.children {
+			clone.children[name] = child
+		}
+	}
+	return &clone
+}
+
+func (node *vfsNode) size() int64 {
+	switch {
+	case node.mode.IsDir():
+		return 4096
+	case node.mode&os.ModeSymlink != 0:
+		return int64(len(node.target))
+	case node.generate != nil:
+		// 与/proc中的文件一样大小为0
+		return 0
+	default:
+		return int64(len(node.data))
+	}
+}
+
+// 文件信息 实现os.FileInfo
+type vfsFileInfo struct {
+	name  string
+	mode  os.FileMode
+	size  int64
+	mtime time.Time
+	user  string
+	group string
+	nlink int
+}
+
+func newFileInfo(name string, node *vfsNode) vfsFileInfo {
+	nlink := 1
+	if node.mode.IsDir() {
+		nlink = 2
+		for _, child := range node.children {
+			if child.mode.IsDir() {
+				nlink++
+			}
+		}
+	}
+	return vfsFileInfo{name, node.mode, node.size(), node.mtime, node.user, node.group, nlink}
+}
+
+func (info vfsFileInfo) Name() string       { return info.name }
+func (info vfsFileInfo) Size() int64        { return info.size }
+func (info vfsFileInfo) Mode() os.FileMode  { return info.mode }
+func (info vfsFileInfo) ModTime() time.Time { return info.mtime }
+func (info vfsFileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info vfsFileInfo) Sys() interface{}   { return nil }
+
+// 虚拟文件系统 每个会话一份 会话中的命令和下载可能并发访问
+type vfs struct {
+	mutex    sync.Mutex
+	root     *vfsNode
+	user     string // 新建文件的所有者
+	written  int64  // 会话写入的总字节数
+	maxFile  int64
+	maxTotal int64
+}
+
+// 会话已经写入的字节数
+func (fs *vfs) Written() int64 {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.written
+}
+
+// 从模板创建文件系统 模板的节点在修改前共享
+func (template *vfs) newSession(user string) *vfs {
+	template.mutex.Lock()
+	defer template.mutex.Unlock()
+	return &vfs{root: template.root, user: user, maxFile: template.maxFile, maxTotal: template.maxTotal}
+}
+
+// 创建空的文件系统 用于构建模板
+func newVFS(maxFile int64, maxTotal int64) *vfs {
+	fs := &vfs{maxFile: maxFile, maxTotal: maxTotal, user: "root"}
+	fs.root = &vfsNode{owner: fs, mode: os.ModeDir | 0755, user: "root", group: "root", mtime: time.Now(), children: map[string]*vfsNode{}}
+	return fs
+}
+
+// 冻结文件系统作为模板 之后所有节点都不会再被修改
+func (fs *vfs) freeze() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var walk func(node *vfsNode)
+	walk = func(node *vfsNode) {
+		node.owner = nil
+		for _, child := range node.children {
+			walk(child)
+		}
+	}
+	walk(fs.root)
+}
+
+func splitPath(p string) []string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+// 解析路径中的符号链接 返回不含符号链接的绝对路径和对应的节点
+// 最后一个组成部分不存在时节点为nil 中间的组成部分不存在时返回错误
+func (fs *vfs) resolve(p string, followLast bool) (string, *vfsNode, error) {
+	return fs.resolveDepth(p, followLast, 0)
+}
+
+func (fs *vfs) resolveDepth(p string, followLast bool, depth int) (string, *vfsNode, error) {
+	if !path.IsAbs(p) {
+		return "", nil, errInvalidPath
+	}
+	if depth > 40 {
+		return "", nil, errTooManyLinks
+	}
+	components := splitPath(p)
+	current := "/"
+	node := fs.root
+	for i, name := range components {
+		if !node.mode.IsDir() {
+			return "", nil, errNotDir
+		}
+		child := node.children[name]
+		last := i == len(components)-1
+		if child == nil {
+			if last {
+				return path.Join(current, name), nil, nil
+			}
+			return "", nil, errNoSuchFile
+		}
+		if child.mode&os.ModeSymlink != 0 && (!last || followLast) {
+			target := child.target
+			if !path.IsAbs(target) {
+				target = path.Join(current, target)
+			}
+			rest := path.Join(append([]string{target}, components[i+1:]...)...)
+			return fs.resolveDepth(rest, followLast, depth+1)
+		}
+		current = path.Join(current, name)
+		node = child
+	}
+	return current, node, nil
+}
+
+// 获取可修改的节点 复制从根目录到该节点路径上的共享节点
+// p必须是resolve返回的路径
+func (fs *vfs) mutable(p string) *vfsNode {
+	if fs.root.owner != fs {
+		fs.root = fs.root.clone(fs)
+	}
+	node := fs.root
+	for _, name := range splitPath(p) {
+		child := node.children[name]
+		if child == nil {
+			return nil
+		}
+		if child.owner != fs {
+			child = child.clone(fs)
+			node.children[name] = child
+		}
+		node = child
+	}
+	return node
+}
+
+// 获取已存在文件的父目录(可修改)和文件名
+func (fs *vfs) mutableParent(p string) (*vfsNode, string, error) {
+	resolved, node, err := fs.resolve(path.Dir(path.Clean(p)), true)
+	if err != nil {
+		return nil, "", err
+	}
+	if node == nil {
+		return nil, "", errNoSuchFile
+	}
+	if !node.mode.IsDir() {
+		return nil, "", errNotDir
+	}
+	name := path.Base(path.Clean(p))
+	if name == "/" || name == "." || name == ".." {
+		return nil, "", errInvalidPath
+	}
+	return fs.mutable(resolved), name, nil
+}
+
+func (fs *vfs) Stat(p string) (vfsFileInfo, error) {
+	return fs.stat(p, true)
+}
+
+func (fs *vfs) Lstat(p string) (vfsFileInfo, error) {
+	return fs.stat(p, false)
+}
+
+func (fs *vfs) stat(p string, follow bool) (vfsFileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	resolved, node, err := fs.resolve(p, follow)
+	if err != nil {
+		return vfsFileInfo{}, err
+	}
+	if node == nil {
+		return vfsFileInfo{}, errNoSuchFile
+	}
+	return newFileInfo(path.Base(resolved), node), nil
+}
+
+// 返回不含符号链接的绝对路径
+func (fs *vfs) Realpath(p string) (string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	resolved, node, err := fs.resolve(p, true)
+	if err != nil {
+		return "", err
+	}
+	if node == nil {
+		return "", errNoSuchFile
+	}
+	return resolved, nil
+}
+
+func (fs *vfs) ReadFile(p string) ([]byte, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	_, node, err := fs.resolve(p, true)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, errNoSuchFile
+	}
+	if node.mode.IsDir() {
+		return nil, errIsDir
+	}
+	if node.generate != nil {
+		return node.generate(), nil
+	}
+	// 限制容量 调用者追加时不会写入之后追加到文件的位置
+	return node.data[:len(node.data):len(node.data)], nil
+}
+
+// 写入文件 文件不存在时以perm创建 appendMode为true时追加
+func (fs *vfs) WriteFile(p string, data []byte, perm os.FileMode, appendMode bool) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	resolved, node, err := fs.resolve(p, true)
+	if err != nil {
+		return err
+	}
+	if node != nil && node.mode.IsDir() {
+		return errIsDir
+	}
+	if node != nil && node.mode&os.ModeDevice != 0 {
+		// 设备文件 例如/dev/null 写入的内容丢弃
+		return nil
+	}
+	size := int64(len(data))
+	if appendMode && node != nil {
+		size += int64(len(node.data))
+	}
+	if (fs.maxFile > 0 && size > fs.maxFile) || (fs.maxTotal > 0 && fs.written+int64(len(data)) > fs.maxTotal) {
+		return errNoSpace
+	}
+	fs.written += int64(len(data))
+	if node == nil {
+		parent, name, err := fs.mutableParent(resolved)
+		if err != nil {
+			return err
+		}
+		parent.children[name] = &vfsNode{owner: fs, mode: perm.Perm(), user: fs.user, group: fs.user, mtime: time.Now(), data: append([]byte(nil), data...), ownsData: true}
+		parent.mtime = time.Now()
+		return nil
+	}
+	node = fs.mutable(resolved)
+	node.generate = nil
+	if appendMode {
+		// 第一次追加时复制共享的数据 之后直接追加 重定向等逐块写入时不会每次复制整个文件
+		if !node.ownsData {
+			node.data = append(make([]byte, 0, len(node.data)+len(data)), node.data...)
+			node.ownsData = true
+		}
+		node.data = append(node.data, data...)
+	} else {
+		node.data = append([]byte(nil), data...)
+		node.ownsData = true
+	}
+	node.mtime = time.Now()
+	return nil
+}
+
+func (fs *vfs) Mkdir(p string, perm os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.mkdir(p, perm)
+}
+
+func (fs *vfs) mkdir(p string, perm os.FileMode) error {
+	resolved, node, err := fs.resolve(p, false)
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		return errFileExists
+	}
+	parent, name, err := fs.mutableParent(resolved)
+	if err != nil {
+		return err
+	}
+	parent.children[name] = &vfsNode{owner: fs, mode: os.ModeDir | perm.Perm(), user: fs.user, group: fs.user, mtime: time.Now(), children: map[string]*vfsNode{}}
+	parent.mtime = time.Now()
+	return nil
+}
+
+// 创建目录及其所有上级目录
+func (fs *vfs) MkdirAll(p string, perm os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	current := "/"
+	for _, name := range splitPath(p) {
+		current = path.Join(current, name)
+		_, node, err := fs.resolve(current, true)
+		if err != nil {
+			return err
+		}
+		if node != nil {
+			if !node.mode.IsDir() {
+				return errNotDir
+			}
+			continue
+		}
+		if err := fs.mkdir(current, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 删除文件或空目录
+func (fs *vfs) Remove(p string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	resolved, node, err := fs.resolve(p, false)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return errNoSuchFile
+	}
+	if node.mode.IsDir() && len(node.children) != 0 {
+		return errNotEmpty
+	}
+	if resolved == "/" {
+		return errInvalidPath
+	}
+	parent, name, err := fs.mutableParent(resolved)
+	if err != nil {
+		return err
+	}
+	delete(parent.children, name)
+	parent.mtime = time.Now()
+	return nil
+}
+
+// 删除文件或目录及其中的所有内容
+func (fs *vfs) RemoveAll(p string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	resolved, node, err := fs.resolve(p, false)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return errNoSuchFile
+	}
+	if resolved == "/" {
+		// 与rm一样 删除根目录时只清空其中的内容
+		fs.root = &vfsNode{owner: fs, mode: fs.root.mode, user: fs.root.user, group: fs.root.group, mtime: time.Now(), children: map[string]*vfsNode{}}
+		return nil
+	}
+	parent, name, err := fs.mutableParent(resolved)
+	if err != nil {
+		return err
+	}
+	delete(parent.children, name)
+	parent.mtime = time.Now()
+	return nil
+}
+
+// 重命名 目标存在时覆盖
+func (fs *vfs) Rename(oldPath string, newPath string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	oldResolved, node, err := fs.resolve(oldPath, false)
+	if err != nil {
+		return err
+	}
+	if node == nil || oldResolved == "/" {
+		return errNoSuchFile
+	}
+	newResolved, target, err := fs.resolve(newPath, false)
+	if err != nil {
+		return err
+	}
+	if newResolved == oldResolved {
+		return nil
+	}
+	if node.mode.IsDir() && strings.HasPrefix(newResolved+"/", oldResolved+"/") {
+		return errInvalidPath
+	}
+	if target != nil {
+		if target.mode.IsDir() && !node.mode.IsDir() {
+			return errIsDir
+		}
+		if !target.mode.IsDir() && node.mode.IsDir() {
+			return errNotDir
+		}
+		if target.mode.IsDir() && len(target.children) != 0 {
+			return errNotEmpty
+		}
+	}
+	newParent, newName, err := fs.mutableParent(newResolved)
+	if err != nil {
+		return err
+	}
+	oldParent, oldName, err := fs.mutableParent(oldResolved)
+	if err != nil {
+		return err
+	}
+	newParent.children[newName] = oldParent.children[oldName]
+	delete(oldParent.children, oldName)
+	oldParent.mtime = time.Now()
+	newParent.mtime = time.Now()
+	return nil
+}
+
+// 复制文件 不复制目录
+func (fs *vfs) CopyFile(src string, dst string) error {
+	info, err := fs.Stat(src)
+	if err != nil {
+		return err
+	}
+	data, err := fs.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if dstInfo, err := fs.Stat(dst); err == nil && dstInfo.IsDir() {
+		return errIsDir
+	}
+	return fs.WriteFile(dst, data, info.Mode().Perm(), false)
+}
+
+func (fs *vfs) Symlink(target string, link string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	resolved, node, err := fs.resolve(link, false)
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		return errFileExists
+	}
+	parent, name, err := fs.mutableParent(resolved)
+	if err != nil {
+		return err
+	}
+	parent.children[name] = &vfsNode{owner: fs, mode: os.ModeSymlink | 0777, user: fs.user, group: fs.user, mtime: time.Now(), target: target}
+	parent.mtime = time.Now()
+	return nil
+}
+
+func (fs *vfs) Readlink(p string) (string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	_, node, err := fs.resolve(p, false)
+	if err != nil {
+		return "", err
+	}
+	if node == nil {
+		return "", errNoSuchFile
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		return "", errInvalidPath
+	}
+	return node.target, nil
+}
+
+// 读取目录内容 按名称排序
+func (fs *vfs) ReadDir(p string) ([]vfsFileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	_, node, err := fs.resolve(p, true)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, errNoSuchFile
+	}
+	if !node.mode.IsDir() {
+		return nil, errNotDir
+	}
+	infos := make([]vfsFileInfo, 0, len(node.children))
+	for name, child := range node.children {
+		infos = append(infos, newFileInfo(name, child))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].name < infos[j].name })
+	return infos, nil
+}
+
+// 修改文件权限 保留文件类型
+func (fs *vfs) Chmod(p string, mode os.FileMode) error {
+	return fs.modify(p, func(node *vfsNode) {
+		node.mode = node.mode&os.ModeType | mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	})
+}
+
+func (fs *vfs) Chown(p string, user string, group string) error {
+	return fs.modify(p, func(node *vfsNode) {
+		if user != "" {
+			node.user = user
+		}
+		if group != "" {
+			node.group = group
+		}
+	})
+}
+
+func (fs *vfs) Chtimes(p string, mtime time.Time) error {
+	return fs.modify(p, func(node *vfsNode) {
+		node.mtime = mtime
+	})
+}
+
+func (fs *vfs) modify(p string, f func(node *vfsNode)) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	resolved, node, err := fs.resolve(p, true)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return errNoSuchFile
+	}
+	f(fs.mutable(resolved))
+	return nil
+}
+
+// 添加模板中的节点 已存在时覆盖 用于构建模板
+func (fs *vfs) addNode(p string, node *vfsNode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	parent, name, err := fs.mutableParent(p)
+	if err != nil {
+		return err
+	}
+	node.owner = fs
+	if existing := parent.children[name]; existing != nil && existing.mode.IsDir() && node.mode.IsDir() {
+		node.children = existing.children
+	}
+	if node.mode.IsDir() && node.children == nil {
+		node.children = map[string]*vfsNode{}
+	}
+	parent.children[name] = node
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// 逐块追加的结果正确 且追加不影响之前读取的数据和模板
+func TestAppendInPlace(t *testing.T) {
+	template := newVFS(0, 0)
+	if err := template.WriteFile("/log", []byte("base\n"), 0644, false); err != nil {
+		t.Fatal(err)
+	}
+	template.freeze()
+	fs := template.newSession("root")
+
+	var want []byte
+	want = append(want, "base\n"...)
+	var snapshot []byte
+	for i := 0; i < 100; i++ {
+		chunk := bytes.Repeat([]byte{byte('a' + i%26)}, 1000)
+		if err := fs.WriteFile("/log", chunk, 0644, true); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, chunk...)
+		if i == 10 {
+			data, err := fs.ReadFile("/log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			snapshot = data
+			// 调用者追加到读取的数据时不能影响文件
+			_ = append(data, "garbage"...)
+		}
+	}
+	data, err := fs.ReadFile("/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("file has %v bytes, want %v", len(data), len(want))
+	}
+	if !bytes.Equal(snapshot, want[:len(snapshot)]) {
+		t.Error("earlier read changed after appending")
+	}
+	if data, _ := template.ReadFile("/log"); string(data) != "base\n" {
+		t.Errorf("template = %q, want %q", data, "base\n")
+	}
+}
+
+func TestAppendAfterCopyDoesNotShareData(t *testing.T) {
+	fs := newVFS(0, 0)
+	if err := fs.WriteFile("/a", []byte("a"), 0644, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/a", []byte("1"), 0644, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CopyFile("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/a", []byte("2"), 0644, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/b", []byte("3"), 0644, true); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := fs.ReadFile("/a")
+	b, _ := fs.ReadFile("/b")
+	if string(a) != "a12" || string(b) != "a13" {
+		t.Errorf("a = %q, b = %q, want %q and %q", a, b, "a12", "a13")
+	}
+}
+
+func newTestTemplate(t *testing.T) *vfs {
+	t.Helper()
+	template := newVFS(0, 0)
+	if err := template.MkdirAll("/etc/ssh", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := template.WriteFile("/etc/passwd", []byte("root:x:0:0::/root:/bin/sh\n"), 0644, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := template.WriteFile("/etc/ssh/sshd_config", []byte("Port 22\n"), 0644, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := template.Symlink("/etc/passwd", "/passwd"); err != nil {
+		t.Fatal(err)
+	}
+	template.freeze()
+	return template
+}
+
+// 两个会话从同一个模板创建 修改互不影响 也不影响模板
+func TestCopyOnWriteIsolation(t *testing.T) {
+	template := newTestTemplate(t)
+	a := template.newSession("root")
+	b := template.newSession("admin")
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"overwrite", func() error { return a.WriteFile("/etc/passwd", []byte("hacked\n"), 0644, false) }},
+		{"append through symlink", func() error { return a.WriteFile("/passwd", []byte("more\n"), 0644, true) }},
+		{"create", func() error { return a.WriteFile("/etc/ssh/backdoor", []byte("x"), 0600, false) }},
+		{"mkdir", func() error { return a.MkdirAll("/tmp/.x/y", 0755) }},
+		{"chmod", func() error { return a.Chmod("/etc/ssh/sshd_config", 0777) }},
+		{"chown", func() error { return a.Chown("/etc", "admin", "admin") }},
+		{"rename", func() error { return a.Rename("/etc/ssh/sshd_config", "/etc/ssh/sshd_config.bak") }},
+		{"remove", func() error { return a.Remove("/passwd") }},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%v: %v", step.name, err)
+		}
+	}
+	if data, _ := a.ReadFile("/etc/passwd"); string(data) != "hacked\nmore\n" {
+		t.Errorf("a /etc/passwd = %q", data)
+	}
+	if _, err := a.Lstat("/passwd"); err != errNoSuchFile {
+		t.Errorf("a /passwd: err = %v, want %v", err, errNoSuchFile)
+	}
+	if info, err := a.Stat("/etc/ssh/sshd_config.bak"); err != nil || info.Mode().Perm() != 0777 {
+		t.Errorf("a /etc/ssh/sshd_config.bak: %v %v", info.Mode(), err)
+	}
+
+	// 另一个会话和模板看到的仍然是原来的内容
+	for name, fs := range map[string]*vfs{"b": b, "template": template} {
+		if data, err := fs.ReadFile("/passwd"); err != nil || string(data) != "root:x:0:0::/root:/bin/sh\n" {
+			t.Errorf("%v /passwd = %q, %v", name, data, err)
+		}
+		if info, err := fs.Stat("/etc/ssh/sshd_config"); err != nil || info.Mode().Perm() != 0644 {
+			t.Errorf("%v /etc/ssh/sshd_config: %v %v", name, info.Mode(), err)
+		}
+		if info, err := fs.Stat("/etc"); err != nil || info.user != "root" {
+			t.Errorf("%v /etc owner: %v %v", name, info.user, err)
+		}
+		for _, p := range []string{"/etc/ssh/backdoor", "/etc/ssh/sshd_config.bak", "/tmp"} {
+			if _, err := fs.Stat(p); err != errNoSuchFile {
+				t.Errorf("%v %v: err = %v, want %v", name, p, err, errNoSuchFile)
+			}
+		}
+	}
+
+	// b自己的修改也不影响a
+	if err := b.WriteFile("/etc/ssh/sshd_config", []byte("Port 2222\n"), 0644, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Stat("/etc/ssh/sshd_config"); err != errNoSuchFile {
+		t.Errorf("a /etc/ssh/sshd_config: err = %v, want %v", err, errNoSuchFile)
+	}
+	if data, _ := template.ReadFile("/etc/ssh/sshd_config"); string(data) != "Port 22\n" {
+		t.Errorf("template /etc/ssh/sshd_config = %q", data)
+	}
+}
+
+func TestRemoveAllRootOnlyAffectsSession(t *testing.T) {
+	template := newTestTemplate(t)
+	a := template.newSession("root")
+	b := template.newSession("root")
+	if err := a.RemoveAll("/"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := a.ReadDir("/"); err != nil || len(entries) != 0 {
+		t.Errorf("a / has %v entries, %v", len(entries), err)
+	}
+	if _, err := b.Stat("/etc/passwd"); err != nil {
+		t.Errorf("b /etc/passwd: %v", err)
+	}
+}